@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// requireAdmin returns a handler that only lets admins through to h.
+//
+// Admins log in with HTTP basic auth, with any user name and the password in
+// $CITIES_ADMIN_PASSWORD. Without a password nobody is an admin.
+//
+// Browsers send the password by themselves, so anything but a GET must
+// also come from one of our own pages, see sameOrigin.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, pass, ok := r.BasicAuth()
+		if AdminPassword == "" || !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(AdminPassword)) != 1 {
+			log.Printf("Stop right there, %v is not an admin!\n", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="cities admin"`)
+			http.Error(w, "Madam or Siree, only admins can go here.", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && !sameOrigin(r) {
+			log.Printf("Stop right there, %v came to %v from %q!\n", r.RemoteAddr, r.URL, r.Header.Get("Origin")+r.Header.Get("Referer"))
+			http.Error(w, "Madam or Siree, the admin forms only work from our own pages.", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// sameOrigin returns true if the request comes from one of our own pages,
+// as its Origin header, or else its Referer, says, so that another site
+// can't make an admin's browser post to us.
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(from)
+	return from != "" && err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// adminName returns the user name the admin logged in with.
+func adminName(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	if user == "" {
+		return "admin"
+	}
+	return user
+}
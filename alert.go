@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// alert tells a visitor when a city matching their filters is added or
+	// updated, by email or as a Slack direct message.
+	alert struct {
+		Token     string    `json:"token"` // to unsubscribe, there are no accounts
+		Email     string    `json:"email,omitempty"`
+		Slack     string    `json:"slack,omitempty"` // a Slack member id, e.g. U012AB3CD
+		Query     string    `json:"query"`           // the filters, e.g. "max_cost=2&min_climate=4"
+		Lang      string    `json:"lang"`
+		Notified  []string  `json:"notified,omitempty"` // the ids of the cities they were told about, to only tell them once
+		Confirm   string    `json:"confirm,omitempty"`  // the token of the link that starts the alert, until it is followed
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// alertStore keeps the alerts, and sends them.
+	alertStore struct {
+		mu     sync.Mutex
+		file   string // where the alerts are saved, or "" to not save them
+		alerts map[string]*alert
+		send   func(a *alert, c city) error
+	}
+
+	// alertsPage is the data for the alerts page.
+	alertsPage struct {
+		Title       string
+		Costs       []option
+		Climates    []option
+		Error       string
+		To          string // who the created alert is for
+		Unsubscribe string // the link to unsubscribe from the created alert
+	}
+
+	// unsubscribePage is the data for the page to unsubscribe from an alert.
+	unsubscribePage struct {
+		Title string
+		Token string
+		To    string
+		Done  bool
+	}
+
+	// confirmPage is the data for the page to start an alert.
+	confirmPage struct {
+		Title string
+		Token string
+		To    string
+		Done  bool
+	}
+)
+
+// alertFilters are the query parameters an alert can have.
+var alertFilters = []string{"near", "within_km", "min_population", "max_population", "max_cost", "min_climate"}
+
+// slackMember is what Slack member ids look like.
+var slackMember = regexp.MustCompile(`^[UW][A-Z0-9]{2,}$`)
+
+// alertThrottle stops anyone from sending many confirmations to others.
+var alertThrottle = newThrottle(10, time.Hour)
+
+// Alerts are the alerts of visitors, they are only saved once main sets up the store.
+var Alerts = &alertStore{alerts: map[string]*alert{}, send: sendAlert}
+
+// newAlertStore returns an alert store that saves the alerts in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newAlertStore(file string) (*alertStore, error) {
+	s := &alertStore{file: file, alerts: map[string]*alert{}, send: sendAlert}
+	if err := loadJSON(file, &s.alerts); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the alerts in %v: %v", file, err)
+	}
+	// Alerts from before cities had ids remember the cities by name.
+	all := allCities()
+	for _, a := range s.alerts {
+		for i, n := range a.Notified {
+			if all.indexID(n) >= 0 {
+				continue
+			}
+			if c, ok := all.find(n); ok && c.id != "" {
+				a.Notified[i] = c.id
+			} else if id, ok := History.idOf(n); ok && id != "" {
+				a.Notified[i] = id
+			}
+		}
+	}
+	return s, nil
+}
+
+// save writes the alerts to the file, the caller must hold the lock.
+func (s *alertStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	return saveJSON(s.file, s.alerts)
+}
+
+// add saves a new alert.
+func (s *alertStore) add(a *alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.Token = randomID(16)
+	a.CreatedAt = time.Now()
+	s.alerts[a.Token] = a
+	return s.save()
+}
+
+// confirm starts the alert with the token of its confirmation link.
+//
+// The error is not nil if no alert is waiting for the token.
+func (s *alertStore) confirm(token string) (*alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.alerts {
+		if token != "" && a.Confirm == token {
+			a.Confirm = ""
+			return a, s.save()
+		}
+	}
+	return nil, fmt.Errorf("no alert to confirm with %q", token)
+}
+
+// pending returns the alert waiting for the token of its confirmation link.
+func (s *alertStore) pending(token string) (*alert, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.alerts {
+		if token != "" && a.Confirm == token {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// find returns the alert with the unsubscribe token.
+func (s *alertStore) find(token string) (*alert, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.alerts[token]
+	return a, ok
+}
+
+// remove deletes the alert with the unsubscribe token.
+func (s *alertStore) remove(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.alerts[token]; !ok {
+		return fmt.Errorf("no alert %q", token)
+	}
+	delete(s.alerts, token)
+	return s.save()
+}
+
+// check sends the confirmed alerts that c matches, unless they were already
+// sent for c. It is called whenever a city is added or updated.
+//
+// An alert that can't be put in the outbox is tried again the next time c
+// changes, the outbox takes care of the rest.
+func (s *alertStore) check(c city) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := false
+	for _, a := range s.alerts {
+		if a.Confirm != "" || contains(a.Notified, c.id) || !a.matches(c) {
+			continue
+		}
+		if err := s.send(a, c); err != nil {
+			log.Printf("Oibai, I can't tell %v about %v: %v\n", a.to(), c.name, err)
+			continue
+		}
+		log.Printf("Howdy mam, I told %v about %v\n", a.to(), c.name)
+		a.Notified = append(a.Notified, c.id)
+		sent = true
+	}
+	if !sent {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Oibai, I can't save the alerts: %v\n", err)
+	}
+}
+
+// matches returns true if c passes the filters of the alert.
+func (a *alert) matches(c city) bool {
+	q, err := url.ParseQuery(a.Query)
+	if err != nil {
+		return false
+	}
+	cs, err := allCities().view("", q)
+	if err != nil {
+		return false
+	}
+	return cs.index(c.name) >= 0
+}
+
+// to returns who the alert is for.
+func (a *alert) to() string {
+	if a.Email != "" {
+		return a.Email
+	}
+	return "Slack " + a.Slack
+}
+
+// unsubscribeURL returns the link to unsubscribe from the alert.
+func (a *alert) unsubscribeURL() string {
+	return BaseURL + "/alerts/unsubscribe?token=" + url.QueryEscape(a.Token)
+}
+
+// confirmURL returns the link to start the alert.
+func (a *alert) confirmURL() string {
+	return BaseURL + "/alerts/confirm?token=" + url.QueryEscape(a.Confirm)
+}
+
+// message returns the subject and body that tell about c.
+func (a *alert) message(c city) (string, string) {
+	subject := fmt.Sprintf(tr(a.Lang, "A city for your alert: %s"), c.name)
+	body := strings.Join([]string{
+		fmt.Sprintf(tr(a.Lang, "%s matches your alert. Have a look:"), c.name),
+		BaseURL + c.URL(),
+		"",
+		tr(a.Lang, "To stop these alerts, go to:"),
+		a.unsubscribeURL(),
+	}, "\n")
+	return subject, body
+}
+
+// sendAlert puts the message about c for the visitor of the alert in the
+// outbox, to go by email or as a Slack direct message.
+func sendAlert(a *alert, c city) error {
+	subject, body := a.message(c)
+	return a.enqueue(notification{Subject: subject, Text: body, Unsubscribe: a.unsubscribeURL()})
+}
+
+// sendConfirmation puts the link to start the alert in the outbox, so that
+// nobody gets alerts they didn't ask for.
+func sendConfirmation(a *alert) error {
+	body := strings.Join([]string{
+		tr(a.Lang, "To start your alert about new cities, go to:"),
+		a.confirmURL(),
+		"",
+		tr(a.Lang, "If you didn't ask for it, ignore this message."),
+	}, "\n")
+	return a.enqueue(notification{Subject: tr(a.Lang, "Confirm your alert"), Text: body})
+}
+
+// enqueue puts the notification for the visitor of the alert in the outbox.
+func (a *alert) enqueue(n notification) error {
+	channel := "email"
+	n.To = a.Email
+	if a.Email == "" {
+		channel, n.To = "slack-dm", a.Slack
+	}
+	_, err := Outbox.enqueue(channel, n)
+	return err
+}
+
+// alertFromForm returns the alert in the form of the alerts page, waiting
+// for its confirmation link to be followed.
+//
+// It needs either an email or a Slack member id, and at least one filter.
+func alertFromForm(r *http.Request) (*alert, error) {
+	a := &alert{
+		Email:   strings.TrimSpace(r.PostFormValue("email")),
+		Slack:   strings.TrimSpace(r.PostFormValue("slack")),
+		Confirm: randomID(16),
+	}
+	switch {
+	case a.Email == "" && a.Slack == "":
+		return nil, fmt.Errorf("Give an email or a Slack member id.")
+	case a.Email != "" && a.Slack != "":
+		return nil, fmt.Errorf("Give an email or a Slack member id, not both.")
+	case a.Email != "":
+		addr, err := mail.ParseAddress(a.Email)
+		if err != nil {
+			return nil, fmt.Errorf("This doesn't look like an email.")
+		}
+		a.Email = addr.Address
+	case !slackMember.MatchString(a.Slack):
+		return nil, fmt.Errorf("A Slack member id looks like U012AB3CD.")
+	}
+	q := url.Values{}
+	for _, name := range alertFilters {
+		if v := strings.TrimSpace(r.PostFormValue(name)); v != "" {
+			q.Set(name, v)
+		}
+	}
+	if len(q) == 0 {
+		return nil, fmt.Errorf("Pick at least one filter.")
+	}
+	if _, err := allCities().view("", q); err != nil {
+		log.Printf("Ai-ai-ai, bad filters %q: %v\n", q.Encode(), err)
+		return nil, fmt.Errorf("These filters don't work, is the city near you in our list?")
+	}
+	a.Query = q.Encode()
+	return a, nil
+}
+
+// alertsHandler lets visitors save their filters as an alert with a POST,
+// which starts once they follow the link we send them.
+//
+// Nobody can ask for more than 10 alerts an hour from the same IP.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	lang := visitorLang(w, r)
+	p := alertsPage{Title: "Alerts", Costs: costOptions(), Climates: climateOptions()}
+	if r.Method == "POST" {
+		if !alertThrottle.allow(remoteIP(r)) {
+			log.Printf("Sirree %v, that's enough alerts for now!\n", r.RemoteAddr)
+			serveErrorPage(w, http.StatusTooManyRequests)
+			return
+		}
+		a, err := alertFromForm(r)
+		if err != nil {
+			log.Printf("Bozhechki, the alert wasn't entered properly: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			p.Error = err.Error()
+			render(w, lang, "html/alerts.html.tmpl", p)
+			return
+		}
+		a.Lang = lang
+		if err := Alerts.add(a); err != nil {
+			log.Printf("Oibai, I can't save the alert: %v\n", err)
+			http.Error(w, "Oibai, I can't save the alert", http.StatusInternalServerError)
+			return
+		}
+		if err := sendConfirmation(a); err != nil {
+			log.Printf("Oibai, I can't ask %v to confirm the alert: %v\n", a.to(), err)
+			if err := Alerts.remove(a.Token); err != nil {
+				log.Printf("Oibai, I can't remove the alert: %v\n", err)
+			}
+			http.Error(w, "Oibai, I can't send the link to start the alert", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Howdy mam, %v wants to know about %q\n", a.to(), a.Query)
+		p.To = a.to()
+		p.Unsubscribe = a.unsubscribeURL()
+	} else if r.Method != "GET" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	render(w, lang, "html/alerts.html.tmpl", p)
+}
+
+// unsubscribeHandler asks whether to stop an alert, e.g.
+// /alerts/unsubscribe?token=abc, and stops it with a POST.
+//
+// It asks first so that mail scanners that follow links don't unsubscribe.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" && r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	a, ok := Alerts.find(token)
+	if !ok {
+		log.Printf("Sirree, there is no alert %q!\n", token)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	p := unsubscribePage{Title: "Stop the alert", Token: token, To: a.to()}
+	if r.Method == "POST" {
+		if err := Alerts.remove(token); err != nil {
+			log.Printf("Oibai, I can't remove the alert: %v\n", err)
+			http.Error(w, "Oibai, I can't remove the alert", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Howdy mam, %v doesn't want alerts anymore\n", a.to())
+		p.Done = true
+	}
+	render(w, visitorLang(w, r), "html/unsubscribe.html.tmpl", p)
+}
+
+// confirmHandler asks whether to start an alert, e.g.
+// /alerts/confirm?token=abc, and starts it with a POST.
+//
+// It asks first so that mail scanners that follow links don't confirm.
+func confirmHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" && r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	a, ok := Alerts.pending(token)
+	if !ok {
+		log.Printf("Sirree, there is no alert to confirm with %q!\n", token)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	p := confirmPage{Title: "Start the alert", Token: token, To: a.to()}
+	if r.Method == "POST" {
+		if _, err := Alerts.confirm(token); err != nil {
+			log.Printf("Oibai, I can't start the alert: %v\n", err)
+			http.Error(w, "Oibai, I can't start the alert", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Howdy mam, %v confirmed the alert for %q\n", a.to(), a.Query)
+		p.Done = true
+	}
+	render(w, visitorLang(w, r), "html/confirm.html.tmpl", p)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.json")
+	s, err := newAlertStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newAlertStore() failed: %v", err)
+	}
+	anna := &alert{Email: "anna@example.com", Query: "max_cost=2"}
+	bob := &alert{Slack: "U012AB3CD", Query: "min_climate=4"}
+	s.add(anna)
+	s.add(bob)
+	if anna.Token == "" || anna.Token == bob.Token {
+		t.Errorf("Expected different tokens, got %q and %q", anna.Token, bob.Token)
+	}
+	if err := s.remove(bob.Token); err != nil {
+		t.Errorf("Oibai, remove() failed: %v", err)
+	}
+	if err := s.remove("nope"); err == nil {
+		t.Errorf("remove() of an alert we don't have should fail")
+	}
+
+	reloaded, err := newAlertStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newAlertStore() failed to reload: %v", err)
+	}
+	if a, ok := reloaded.find(anna.Token); !ok || a.Email != "anna@example.com" || a.Query != "max_cost=2" {
+		t.Errorf("find(%v) = %+v, %v after reloading", anna.Token, a, ok)
+	}
+	if _, ok := reloaded.find(bob.Token); ok {
+		t.Errorf("Bob's alert should be gone")
+	}
+
+	// Alerts from before cities had ids remember them by name.
+	if err := ioutil.WriteFile(file, []byte(`{"abc": {"token": "abc", "email": "anna@example.com", "query": "max_cost=2", "notified": ["Barcelona", "Atlantis"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := newAlertStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newAlertStore() failed on the old alerts: %v", err)
+	}
+	if a, _ := legacy.find("abc"); strings.Join(a.Notified, ", ") != "barcelona, Atlantis" {
+		t.Errorf("Expected Barcelona by its id, got %v", a.Notified)
+	}
+}
+
+func TestAlertStore_check(t *testing.T) {
+	defer func(cs cities, h *historyStore, a *alertStore) { setCities(cs); History, Alerts = h, a }(allCities(), History, Alerts)
+	History = &historyStore{}
+	sent := []string{}
+	Alerts = &alertStore{alerts: map[string]*alert{}, send: func(a *alert, c city) error {
+		sent = append(sent, a.Email+": "+c.name)
+		return nil
+	}}
+	Alerts.add(&alert{Email: "anna@example.com", Query: "max_cost=2&min_climate=4"})
+	Alerts.add(&alert{Email: "bob@example.com", Query: "near=Stockholm&within_km=1000"})
+	Alerts.add(&alert{Email: "eve@example.com", Query: "max_cost=5", Confirm: "xyz"})
+
+	oslo := city{name: "Oslo", population: 709037, cost: ExpensiveCost, climate: PoorClimate, lat: 59.9139, lon: 10.7522}
+	addCity(oslo, "aruna")
+	cheaper := oslo
+	cheaper.cost = VeryReasonableCost
+	cheaper.climate = PerfectClimate
+	updateCity("Oslo", cheaper, "aruna")
+	updateCity("Oslo", cheaper, "aruna")
+	renamed := cheaper
+	renamed.name = "Christiania"
+	updateCity("Oslo", renamed, "aruna")
+	addCity(city{name: "Lima", population: 9751000, cost: CheapCost, climate: GoodClimate}, "aruna")
+
+	want := "bob@example.com: Oslo, anna@example.com: Oslo"
+	if got := strings.Join(sent, ", "); got != want {
+		t.Errorf("Expected the alerts %v, got %v", want, got)
+	}
+}
+
+func TestAlertStore_checkRetries(t *testing.T) {
+	defer func(a *alertStore) { Alerts = a }(Alerts)
+	fail := true
+	tries := 0
+	Alerts = &alertStore{alerts: map[string]*alert{}, send: func(a *alert, c city) error {
+		tries++
+		if fail {
+			return net.UnknownNetworkError("down")
+		}
+		return nil
+	}}
+	Alerts.add(&alert{Email: "anna@example.com", Query: "min_climate=5"})
+	paradisio, _ := allCities().find("Paradisio")
+	Alerts.check(paradisio)
+	fail = false
+	Alerts.check(paradisio)
+	Alerts.check(paradisio)
+	if tries != 2 {
+		t.Errorf("Expected an alert that failed to be sent once more, it was tried %v times", tries)
+	}
+}
+
+func TestAlertFromForm(t *testing.T) {
+	type testCase struct {
+		form      url.Values
+		wantQuery string
+		wantErr   string
+	}
+	cases := []testCase{
+		{form: url.Values{"email": {"Anna <anna@example.com>"}, "max_cost": {"2"}, "min_climate": {""}}, wantQuery: "max_cost=2"},
+		{form: url.Values{"slack": {"U012AB3CD"}, "near": {"Stockholm"}, "within_km": {"500"}}, wantQuery: "near=Stockholm&within_km=500"},
+		{form: url.Values{"max_cost": {"2"}}, wantErr: "Give an email or a Slack member id."},
+		{form: url.Values{"email": {"anna@example.com"}, "slack": {"U012AB3CD"}, "max_cost": {"2"}}, wantErr: "Give an email or a Slack member id, not both."},
+		{form: url.Values{"email": {"anna"}, "max_cost": {"2"}}, wantErr: "This doesn't look like an email."},
+		{form: url.Values{"slack": {"@anna"}, "max_cost": {"2"}}, wantErr: "A Slack member id looks like U012AB3CD."},
+		{form: url.Values{"email": {"anna@example.com"}}, wantErr: "Pick at least one filter."},
+		{form: url.Values{"email": {"anna@example.com"}, "near": {"Atlantis"}}, wantErr: "These filters don't work, is the city near you in our list?"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/alerts", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		a, err := alertFromForm(req)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("alertFromForm(%v) error = %v, want %q", tc.form, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || a.Query != tc.wantQuery || a.Confirm == "" {
+			t.Errorf("alertFromForm(%v) = %+v, %v, want the query %q waiting to be confirmed", tc.form, a, err, tc.wantQuery)
+		}
+	}
+}
+
+func TestSendAlert(t *testing.T) {
+	defer func(o *outbox, base string) { Outbox, BaseURL = o, base }(Outbox, BaseURL)
+	Outbox = newOutbox("", map[string]notifier{})
+	BaseURL = "https://cities.example"
+	barcelona, _ := allCities().find("Barcelona")
+	sendAlert(&alert{Token: "abc", Email: "anna@example.com", Lang: "da"}, barcelona)
+	sendAlert(&alert{Token: "def", Slack: "U012AB3CD"}, barcelona)
+
+	if len(Outbox.entries) != 2 {
+		t.Fatalf("Expected 2 notifications in the outbox, got %v", len(Outbox.entries))
+	}
+	email, dm := Outbox.entries[0], Outbox.entries[1]
+	want := notification{
+		To:          "anna@example.com",
+		Subject:     "En by til din alarm: Barcelona",
+		Text:        "Barcelona passer til din alarm. Tag et kig:\nhttps://cities.example/city/Barcelona\n\nFor at stoppe disse alarmer, gå til:\nhttps://cities.example/alerts/unsubscribe?token=abc",
+		Unsubscribe: "https://cities.example/alerts/unsubscribe?token=abc",
+	}
+	if email.Channel != "email" || email.Notification != want {
+		t.Errorf("Expected the email %+v, got %v %+v", want, email.Channel, email.Notification)
+	}
+	if dm.Channel != "slack-dm" || dm.Notification.To != "U012AB3CD" || !strings.Contains(dm.Notification.Text, "Barcelona matches your alert.") {
+		t.Errorf("Unexpected Slack message %v %+v", dm.Channel, dm.Notification)
+	}
+
+	sendConfirmation(&alert{Token: "abc", Confirm: "xyz", Email: "anna@example.com", Lang: "en"})
+	confirm := Outbox.entries[2]
+	want = notification{
+		To:      "anna@example.com",
+		Subject: "Confirm your alert",
+		Text:    "To start your alert about new cities, go to:\nhttps://cities.example/alerts/confirm?token=xyz\n\nIf you didn't ask for it, ignore this message.",
+	}
+	if confirm.Channel != "email" || confirm.Notification != want {
+		t.Errorf("Expected the email %+v, got %v %+v", want, confirm.Channel, confirm.Notification)
+	}
+}
+
+func TestAlertsHandler(t *testing.T) {
+	defer func(a *alertStore, o *outbox, th *throttle) { Alerts, Outbox, alertThrottle = a, o, th }(Alerts, Outbox, alertThrottle)
+	Alerts = &alertStore{alerts: map[string]*alert{}, send: sendAlert}
+	Outbox = newOutbox("", map[string]notifier{})
+	alertThrottle = newThrottle(2, time.Hour)
+
+	rec := httptest.NewRecorder()
+	alertsHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	if !strings.Contains(rec.Body.String(), `name="max_cost"`) {
+		t.Errorf("Expected the alert form:\n%v", rec.Body.String())
+	}
+
+	type testCase struct {
+		form     url.Values
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{form: url.Values{"email": {"anna@example.com"}, "min_climate": {"4"}}, wantCode: http.StatusOK, wantText: "We sent a link to anna@example.com, follow it"},
+		{form: url.Values{"email": {"anna@example.com"}}, wantCode: http.StatusBadRequest, wantText: "Pick at least one filter."},
+		{form: url.Values{"email": {"anna@example.com"}, "min_climate": {"4"}}, wantCode: http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/alerts", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		alertsHandler(rec, req)
+		if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("POST %v: expected %v with %q, got %v:\n%v", tc.form, tc.wantCode, tc.wantText, rec.Code, rec.Body.String())
+		}
+	}
+	if len(Alerts.alerts) != 1 {
+		t.Errorf("Expected one alert, got %v", len(Alerts.alerts))
+	}
+	for _, a := range Alerts.alerts {
+		if a.Confirm == "" || len(Outbox.entries) != 1 || !strings.Contains(Outbox.entries[0].Notification.Text, a.confirmURL()) {
+			t.Errorf("Expected the alert to wait for the link we sent, got %+v and %+v", a, Outbox.entries)
+		}
+	}
+}
+
+func TestConfirmHandler(t *testing.T) {
+	defer func(a *alertStore) { Alerts = a }(Alerts)
+	sent := []string{}
+	Alerts = &alertStore{alerts: map[string]*alert{}, send: func(a *alert, c city) error {
+		sent = append(sent, a.Email+": "+c.name)
+		return nil
+	}}
+	a := &alert{Email: "anna@example.com", Query: "min_climate=5", Confirm: "xyz"}
+	Alerts.add(a)
+	paradisio, _ := allCities().find("Paradisio")
+
+	rec := httptest.NewRecorder()
+	confirmHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/confirm?token=xyz", nil))
+	if !strings.Contains(rec.Body.String(), "Start telling anna@example.com about new cities?") {
+		t.Errorf("Expected to be asked first:\n%v", rec.Body.String())
+	}
+	Alerts.check(paradisio)
+	if len(sent) != 0 {
+		t.Errorf("Following the link shouldn't start the alert yet, sent %v", sent)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/alerts/confirm", strings.NewReader("token=xyz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	confirmHandler(rec, req)
+	if !strings.Contains(rec.Body.String(), "We&#39;ll tell anna@example.com when") {
+		t.Errorf("Expected the alert to start:\n%v", rec.Body.String())
+	}
+	Alerts.check(paradisio)
+	if strings.Join(sent, ", ") != "anna@example.com: Paradisio" {
+		t.Errorf("Expected the confirmed alert to be sent, got %v", sent)
+	}
+
+	for _, token := range []string{"xyz", "", a.Token} {
+		rec = httptest.NewRecorder()
+		confirmHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/confirm?token="+token, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected %v for the token %q, got %v", http.StatusNotFound, token, rec.Code)
+		}
+	}
+}
+
+func TestUnsubscribeHandler(t *testing.T) {
+	defer func(a *alertStore) { Alerts = a }(Alerts)
+	Alerts = &alertStore{alerts: map[string]*alert{}, send: sendAlert}
+	a := &alert{Email: "anna@example.com", Query: "min_climate=4"}
+	Alerts.add(a)
+
+	rec := httptest.NewRecorder()
+	unsubscribeHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/unsubscribe?token="+a.Token, nil))
+	if !strings.Contains(rec.Body.String(), "Stop telling anna@example.com about new cities?") {
+		t.Errorf("Expected to be asked first:\n%v", rec.Body.String())
+	}
+	if _, ok := Alerts.find(a.Token); !ok {
+		t.Errorf("Following the link shouldn't unsubscribe yet")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/alerts/unsubscribe", strings.NewReader("token="+a.Token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	unsubscribeHandler(rec, req)
+	if _, ok := Alerts.find(a.Token); ok || !strings.Contains(rec.Body.String(), "you won&#39;t get this alert anymore") {
+		t.Errorf("Expected the alert to be gone:\n%v", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	unsubscribeHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/unsubscribe?token="+a.Token, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected %v for an alert that is gone, got %v", http.StatusNotFound, rec.Code)
+	}
+}
@@ -6,12 +6,45 @@
 //
 // These are shown on separate pages.
 // - GET /: the index page, gives links to the other pages.
-// - GET /by-cost: ranks cities by cost.
-// - GET /by-climate: ranks cities by climate.
-// - GET /by-population: ranks cities by population.
+// - GET /by-<criterion>: ranks cities by a registered criterion, see criteria.go.
+//   E.g. /by-cost, /by-climate and /by-population. As HTML, plain text, JSON or
+//   CSV depending on the Accept header or e.g. ?format=csv, see negotiate.go.
+// - GET /by-distance?to=Stockholm,Barcelona: ranks cities by distance to the given cities.
+// - GET /rank?climate=2&cost=1: ranks cities by a weighted set of criteria.
+// - GET /quiz: asks a visitor what matters to them and recommends three cities.
+// - GET /compare?cities=Barcelona,Seattle: shows cities side by side, add &format=json for JSON.
+// - GET /similar?city=Barcelona&better=cost: cities like another, here but cheaper, add &format=json for JSON.
+// - GET /pareto?criteria=cost,climate: shows which cities are beaten on every count by another.
+// - GET /cities.geojson: all cities as GeoJSON, ranked if there is e.g. ?by=climate.
+// - GET /cities.kml: the same as KML.
 // - GET /talk: allows a user to fill out a form with a message.
-// - POST /city: allows users to enter a city
-// - POST /message: send a message to Aruna on slack.
+// - POST /city: allows users to enter a city, which waits for an admin to approve it.
+// - GET /city/Barcelona: everything about a city and how its score adds up.
+// - GET /city/Barcelona/history: every change to a city.
+// - POST /rate: allows visitors to rate the cost or climate of a city.
+// - GET /shortlist: the cities a visitor is considering, POST adds or removes one.
+// - GET /alerts: lets visitors be told by email or Slack when a city that matches their filters is added or updated,
+//   once they follow the link to /alerts/confirm that we send them.
+// - POST /r: saves a ranking as a short link, e.g. GET /r/abc123 shows it again.
+// - POST /message: keeps a message for Aruna and sends it on Slack, or wherever notify.go is set up to.
+// - GET /conversation/abc: the message of a visitor and Aruna's answers from its Slack thread.
+// - POST /slack/events: where Slack tells us about the answers, see conversation.go.
+// - POST /slack/commands: the /cities slash command in Slack, see slash.go.
+// - GET /admin/cities: allows admins to approve, edit or reject the cities users entered.
+// - GET /admin/city?name=Barcelona: allows admins to edit, delete or revert a city.
+// - GET /admin/messages?q=oslo: allows admins to search, handle, reply to or delete the messages of visitors.
+//
+// The ranking pages and exports can be limited to cities near another, e.g.
+// /by-climate?near=Stockholm&within_km=1500, and can use the cost and climate
+// visitors rated instead of ours with ?values=crowd. Cities can be ruled out
+// with e.g. ?min_population=500000&max_cost=3&min_climate=3, or limited to the
+// visitor's shortlist with ?shortlist=1.
+//
+// The pages are in English, Russian, Kazakh or Danish as the browser asks
+// with Accept-Language, or as a visitor chooses with e.g. ?lang=kk, see i18n.go.
+//
+// The same rankings are available in a terminal, e.g. `cities rank --by climate=2,cost=1`,
+// see cli.go.
 
 package main
 
@@ -22,9 +55,15 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -38,25 +77,35 @@ type (
 
 	// city is a place where we might want to live.
 	city struct {
+		id         string // stays the same when the city is renamed, "" until it is first saved
 		name       string
 		population int
 		cost       cost
 		climate    climate
+		costs      costBreakdown
+		country    string
+		region     string  // e.g. a state or province
+		lat, lon   float64 // in degrees
 	}
 
 	// cities is a collection of city.
 	cities []city
 
-	criteria struct {
-		weight float64
-		name   string      // e.g. "population"
-		value  interface{} // this is an int or a cost or a climate
-	}
 	pageData struct {
-		Title    string
-		Criteria string
-		Cities   cities
-		Version  string
+		Title       string
+		Criteria    string
+		Cities      cities
+		Version     string
+		ExportQuery template.URL // the query to export the cities for a map
+		Rankings    []criterionLink
+		Crowd       bool         // true if the cost and climate are rated by visitors
+		ToggleQuery template.URL // the query to switch between curated and crowd values
+		Costs       []option
+		Climates    []option
+		Shortlisted map[string]bool // the cities on the visitor's shortlist
+		Shortlist   bool            // true if only the cities on the shortlist are shown
+		OnlyQuery   template.URL    // the query to switch between all cities and the shortlist
+		Back        string          // the page to come back to after changing the shortlist
 	}
 	// indexHandler handles requests for index page.
 	indexHandler struct {
@@ -103,20 +152,95 @@ var (
 		VeryExpensiveCost:  "very expensive",
 	}
 
+	// seedCities are the cities we start with, before anybody changes them.
+	//
 	// TODO: this should be eventually read from a user.
-	Cities = cities{
-		city{name: "Barcelona", population: 1.6e6, cost: ReasonableCost, climate: GreatClimate},
-		city{name: "Seattle", population: 652405, cost: ExpensiveCost, climate: GoodClimate},
-		city{name: "New York", population: 8.406e6, cost: ExpensiveCost, climate: GoodClimate},
-		city{name: "Copenhagen", population: 562379, cost: ExpensiveCost, climate: PoorClimate},
-		city{name: "Stockholm", population: 789024, cost: ExpensiveCost, climate: PoorClimate},
-		city{name: "Deviltown", population: 1233567890, cost: VeryExpensiveCost, climate: NastyClimate},
-		city{name: "Paradisio", population: 1e6, cost: CheapCost, climate: PerfectClimate},
+	// Cities added later get random ids, see putCity.
+	seedCities = cities{
+		city{id: "barcelona", name: "Barcelona", population: 1.6e6, cost: ReasonableCost, climate: GreatClimate,
+			country: "Spain", region: "Catalonia", lat: 41.3874, lon: 2.1686,
+			costs: costBreakdown{currency: "EUR", rent1BR: 1200, rent3BR: 2400, groceries: 300, transport: 40, eatingOut: 300, utilities: 150}},
+		city{id: "seattle", name: "Seattle", population: 652405, cost: ExpensiveCost, climate: GoodClimate,
+			country: "United States", region: "Washington", lat: 47.6062, lon: -122.3321,
+			costs: costBreakdown{currency: "USD", rent1BR: 2400, rent3BR: 4500, groceries: 450, transport: 100, eatingOut: 450, utilities: 200}},
+		city{id: "new-york", name: "New York", population: 8.406e6, cost: ExpensiveCost, climate: GoodClimate,
+			country: "United States", region: "New York", lat: 40.7128, lon: -74.0060,
+			costs: costBreakdown{currency: "USD", rent1BR: 4000, rent3BR: 8000, groceries: 500, transport: 132, eatingOut: 600, utilities: 250}},
+		city{id: "copenhagen", name: "Copenhagen", population: 562379, cost: ExpensiveCost, climate: PoorClimate,
+			country: "Denmark", region: "Capital Region", lat: 55.6761, lon: 12.5683,
+			costs: costBreakdown{currency: "DKK", rent1BR: 14000, rent3BR: 25000, groceries: 3500, transport: 500, eatingOut: 4000, utilities: 1700}},
+		city{id: "stockholm", name: "Stockholm", population: 789024, cost: ExpensiveCost, climate: PoorClimate,
+			country: "Sweden", region: "Stockholm County", lat: 59.3293, lon: 18.0686,
+			costs: costBreakdown{currency: "SEK", rent1BR: 19000, rent3BR: 32000, groceries: 4500, transport: 970, eatingOut: 5000, utilities: 1500}},
+		city{id: "deviltown", name: "Deviltown", population: 1233567890, cost: VeryExpensiveCost, climate: NastyClimate,
+			country: "Hades", region: "Ninth Circle", lat: -89.9, lon: 0,
+			costs: costBreakdown{currency: "USD", rent1BR: 9000, rent3BR: 20000, groceries: 1500, transport: 400, eatingOut: 2000, utilities: 1000}},
+		city{id: "paradisio", name: "Paradisio", population: 1e6, cost: CheapCost, climate: PerfectClimate,
+			country: "Elysium", region: "Fortunate Isles", lat: 28.2916, lon: -16.6291,
+			costs: costBreakdown{currency: "EUR", rent1BR: 300, rent3BR: 600, groceries: 150, transport: 10, eatingOut: 100, utilities: 50}},
 	}
 
 	Prod = os.Getenv("CITIES_ISPROD") == "true"
+
+	// AdminPassword is the password for the admin pages, they are disabled without one.
+	AdminPassword = os.Getenv("CITIES_ADMIN_PASSWORD")
+
+	// DataDir is where we keep what visitors give us, e.g. their ratings.
+	DataDir = getenvDefault("CITIES_DATA_DIR", "data")
+
+	// CostReference is the name of the city whose cost of living is 100.
+	CostReference = getenvDefault("CITIES_COST_REFERENCE", "New York")
+
+	// BaseURL is where visitors find us, for the links in alerts.
+	BaseURL = getenvDefault("CITIES_URL", "http://localhost:1025")
+
+	// SMTPAddr is the mail server for alerts, e.g. "smtp.example.com:587",
+	// alerts can't be emailed without one.
+	SMTPAddr     = os.Getenv("CITIES_SMTP_ADDR")
+	SMTPFrom     = getenvDefault("CITIES_SMTP_FROM", "cities@localhost")
+	SMTPUser     = os.Getenv("CITIES_SMTP_USER")
+	SMTPPassword = os.Getenv("CITIES_SMTP_PASSWORD")
+
+	// SlackToken is the bot token for alerts as Slack direct messages, they
+	// can't be sent without one.
+	SlackToken = os.Getenv("CITIES_SLACK_TOKEN")
+	SlackAPI   = "https://slack.com/api"
+
+	// SlackChannel is where the messages of visitors start a thread that
+	// Aruna can answer in, with SlackToken. SlackSigningSecret checks that
+	// the answers really come from Slack, see conversation.go.
+	SlackChannel       = os.Getenv("CITIES_SLACK_CHANNEL")
+	SlackSigningSecret = os.Getenv("CITIES_SLACK_SIGNING_SECRET")
+
+	// SlackWebhook, NotifyWebhook and NotifyEmail are where the messages of
+	// visitors go, see notify.go.
+	SlackWebhook  = os.Getenv("CITIES_SLACK_WEBHOOK")
+	NotifyWebhook = os.Getenv("CITIES_NOTIFY_WEBHOOK")
+	NotifyEmail   = os.Getenv("CITIES_NOTIFY_EMAIL")
 )
 
+// current holds the cities everyone sees, see allCities.
+var current atomic.Value
+
+func init() {
+	setCities(seedCities)
+}
+
+// allCities returns the cities everyone sees now.
+//
+// The cities are never changed in place, so they can be read without a lock
+// while an admin changes them: changes make a new list and publish it with
+// setCities, under History's lock.
+func allCities() cities {
+	cs, _ := current.Load().(cities)
+	return cs
+}
+
+// setCities publishes the cities for everyone to see.
+func setCities(cs cities) {
+	current.Store(cs)
+}
+
 // Equal returns true if the two cities are equivalent.
 func (c1 cities) Equal(c2 cities) bool {
 	if len(c1) != len(c2) {
@@ -144,6 +268,15 @@ func (c1 city) Equal(c2 city) bool {
 	if c1.climate != c2.climate {
 		return false
 	}
+	if c1.costs != c2.costs {
+		return false
+	}
+	if c1.country != c2.country || c1.region != c2.region {
+		return false
+	}
+	if c1.lat != c2.lat || c1.lon != c2.lon {
+		return false
+	}
 	return true
 }
 
@@ -162,25 +295,22 @@ func (c city) String() string {
 	if c.name == "" {
 		return "city with empty name, you dummy!"
 	}
-	p := ""
-	if c.population < 1e6 {
-		p = fmt.Sprintf("%v", c.population)
-		if len(p) > 3 {
-			from := len(p) - 3
-			p = p[:from] + " " + p[from:]
-		}
-	} else {
-		p = fmt.Sprintf("%.1fM", float64(c.population)/1e6)
-	}
 	return fmt.Sprintf(
 		"%v: %v, cost: %v, climate: %v",
 		c.name,
-		p,
+		formatPopulation(c.population),
 		c.cost,
 		c.climate,
 	)
 }
 
+// formatPopulation returns a short description of the population, e.g. "562 379" or "1.6M".
+//
+// See formatPopulationIn for other languages.
+func formatPopulation(population int) string {
+	return formatPopulationIn("en", population)
+}
+
 // String returns a description of the cities.
 func (cs cities) String() string {
 	desc := make([]string, len(cs), len(cs))
@@ -201,34 +331,88 @@ func (cs cities) getNames() string {
 
 // sortBy sorts cities by given criteria.
 //
-// TODO: We want a way to sort by a weighted set of criteria, e.g:
-// Cities.sortByCriteria(criteria{"climate", 2}, criteria{"cost", 1})
-// Or:
-// Cities.sortByCriteria(map[string]int{"climate": 2, "cost": 1})
-//
-// Regardless of which function signature we pick, we then want results
-// where the cities are sorted in ascending order (worst to best), like:
-//
-// The sorted cities by climate (67%) and cost (33%) are:
-// * Deviltown: 1234.6M, cost: very expensive, climate: nasty
-// * Copenhagen: 562 379, cost: expensive, climate: poor
-// * Stockholm: 789 024, cost: expensive, climate: poor
-// * New York: 8.4M, cost: expensive, climate: good
-// * Barcelona: 1.6M, cost: reasonable, climate: great
-// * Paradisio: 1.0M, cost: cheap, climate: perfect
+// The criteria is "name" or the name of a registered criterion.
+// To sort by a weighted set of criteria, see rankConfig.score.
 func (cs cities) sortBy(criteria string) {
 	if criteria == "name" {
-		sort.Slice(cs, func(i, j int) bool { return cs[i].name < cs[j].name })
+		sort.SliceStable(cs, func(i, j int) bool { return cs[i].name < cs[j].name })
+		return
+	}
+	if c, ok := lookupCriterion(criteria); ok {
+		cs.sortByCriterion(c)
+	}
+}
+
+// view returns a copy of the cities, filtered and sorted by the criteria as
+// asked for in the query.
+//
+// The cities are not sorted if the criteria is empty. With ?values=crowd the
+// cost and climate are the ones visitors rated.
+// The error is not nil when the query doesn't make sense.
+func (cs cities) view(criteria string, q url.Values) (cities, error) {
+	v := make(cities, len(cs))
+	copy(v, cs)
+	if q.Get("values") == "crowd" {
+		v = Ratings.crowdCities(v)
+	}
+	v, err := v.filterNear(q)
+	if err != nil {
+		return nil, err
+	}
+	v, err = v.filterLimits(q)
+	if err != nil {
+		return nil, err
 	}
-	if criteria == "population" {
-		sort.Slice(cs, func(i, j int) bool { return cs[i].population < cs[j].population })
+	v = v.filterOnly(q)
+	if criteria == "" || criteria == "name" {
+		v.sortBy(criteria)
+		return v, nil
 	}
-	if criteria == "cost" {
-		sort.Slice(cs, func(i, j int) bool { return cs[i].cost < cs[j].cost })
+	c, err := criterionFor(criteria, q)
+	if err != nil {
+		return nil, err
 	}
-	if criteria == "climate" {
-		sort.Slice(cs, func(i, j int) bool { return cs[i].climate < cs[j].climate })
+	v.sortByCriterion(c)
+	return v, nil
+}
+
+// limits are the query parameters that rule cities out, with the value to
+// compare with the limit.
+var limits = []struct {
+	param string
+	value func(c city) int
+	max   bool // the limit is the highest value allowed, otherwise the lowest
+}{
+	{"min_population", func(c city) int { return c.population }, false},
+	{"max_population", func(c city) int { return c.population }, true},
+	{"max_cost", func(c city) int { return int(c.cost) }, true},
+	{"min_climate", func(c city) int { return int(c.climate) }, false},
+}
+
+// filterLimits applies the limits in the query, e.g.
+// ?min_population=500000&max_cost=3&min_climate=3, so that the cities that
+// break them aren't even considered.
+//
+// The cities are returned as they are if there are no limits.
+func (cs cities) filterLimits(q url.Values) (cities, error) {
+	for _, l := range limits {
+		s := q.Get(l.param)
+		if s == "" {
+			continue
+		}
+		limit, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad %v %q", l.param, s)
+		}
+		kept := cities{}
+		for _, c := range cs {
+			if v := l.value(c); (l.max && v <= limit) || (!l.max && v >= limit) {
+				kept = append(kept, c)
+			}
+		}
+		cs = kept
 	}
+	return cs, nil
 }
 
 // newIndexHandler return an indexHandler and an error.
@@ -247,7 +431,7 @@ func newIndexHandler(version string) (*indexHandler, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Oibai, there is a problem reading the file: %v", err)
 	}
-	tmpl, err := template.New("webpage").Parse(string(htmlo))
+	tmpl, err := template.New("webpage").Funcs(templateFuncs(languages[0].Tag)).Parse(string(htmlo))
 	if err != nil {
 		return nil, fmt.Errorf("Help, I couldn't parse the %v", err)
 	}
@@ -275,11 +459,19 @@ func (i indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, i.pageBadRequest)
 		return
 	}
+	lang := visitorLang(w, r)
 	data := pageData{
-		Title:   "Welcome",
-		Version: fmt.Sprintf("This is version %v", i.version),
+		Title:    "Welcome",
+		Version:  fmt.Sprintf(tr(lang, "This is version %v"), i.version),
+		Rankings: criteriaLinks(),
+		Costs:    costOptions(),
+		Climates: climateOptions(),
 	}
-	if err := i.tmpl.Execute(w, data); err != nil {
+	t, err := i.tmpl.Clone()
+	if err != nil {
+		panic(err)
+	}
+	if err := t.Funcs(templateFuncs(lang)).Execute(w, data); err != nil {
 		panic(err)
 	}
 }
@@ -289,43 +481,77 @@ func (ch citiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
 	if r.Method != "GET" {
 		log.Printf("This ain't right: %v!\n", r.Method)
-		w.WriteHeader(http.StatusBadRequest)
-		html, err := getFile("html/400.html")
-		if err != nil {
-			log.Panicf("O bozhe moi, I failed to read the file %v\n", err)
-		}
-		fmt.Fprintf(w, string(html))
+		serveErrorPage(w, http.StatusBadRequest)
 		return
 	}
 	if r.URL.Path != fmt.Sprintf("/by-%s", ch.criteria) {
 		log.Printf("This ain't right: %v!\n", r.URL.Path)
-		w.WriteHeader(http.StatusNotFound)
-		htmlo, err := getFile("html/404.html")
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Vary", "Accept, Accept-Language, Cookie")
+	f, ok := negotiateFormat(r)
+	if !ok {
+		log.Printf("Ai-ai-ai, I can't give %q what it accepts: %q\n", r.RemoteAddr, r.Header.Get("Accept"))
+		serveNotAcceptable(w)
+		return
+	}
+	q := r.URL.Query()
+	q.Set("by", ch.criteria)
+	q.Del("lang")
+	q.Del("format")
+	if f.name != "html" {
+		ranked, err := exportView(shortlistQuery(r, q))
 		if err != nil {
-			log.Panicf("Oioioi, there is a problem reading the file: %v\n", err)
+			log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
 		}
-		fmt.Fprintf(w, string(htmlo))
+		writeCities(w, f, ranked)
 		return
 	}
-	htmlo, err := getFile("html/cities.html.tmpl")
+	cs, err := allCities().view(ch.criteria, shortlistQuery(r, r.URL.Query()))
 	if err != nil {
-		log.Panicf("Oivey, there is a problem reading the file: %v\n", err)
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
 	}
-	t, err := template.New("webpage").Parse(string(htmlo))
-	if err != nil {
-		log.Panicf("Help, I couldn't parse the %v\n", err)
+	lang := visitorLang(w, r)
+	criteria := tr(lang, ch.criteria)
+	if ch.criteria == "distance" {
+		criteria = fmt.Sprintf(tr(lang, "distance to %s"), r.URL.Query().Get("to"))
+	}
+	crowd := q.Get("values") == "crowd"
+	toggle := r.URL.Query()
+	toggle.Del("lang")
+	toggle.Del("format")
+	if crowd {
+		toggle.Del("values")
+	} else {
+		toggle.Set("values", "crowd")
+	}
+	shortlist := q.Get("shortlist") != ""
+	only := r.URL.Query()
+	only.Del("lang")
+	only.Del("format")
+	if shortlist {
+		only.Del("shortlist")
+	} else {
+		only.Set("shortlist", "1")
 	}
-	Cities.sortBy(ch.criteria)
 	data := pageData{
-		Title:    fmt.Sprintf("By %s", ch.criteria),
-		Criteria: ch.criteria,
-		Cities:   Cities,
-	}
-
-	err = t.Execute(w, data)
-	if err != nil {
-		panic(err)
-	}
+		Title:       fmt.Sprintf(tr(lang, "By %s"), tr(lang, ch.criteria)),
+		Criteria:    criteria,
+		Cities:      cs,
+		ExportQuery: template.URL(q.Encode()),
+		Crowd:       crowd,
+		ToggleQuery: template.URL(toggle.Encode()),
+		Shortlisted: Shortlists.shortlisted(visitorOf(r)),
+		Shortlist:   shortlist,
+		OnlyQuery:   template.URL(only.Encode()),
+		Back:        r.URL.RequestURI(),
+	}
+	render(w, lang, "html/cities.html.tmpl", data)
 }
 
 // getFile returns the contents of the specified file.
@@ -339,6 +565,44 @@ func getFile(f string) ([]byte, error) {
 	}
 }
 
+// render writes the page from the template file with the data, in the language.
+func render(w http.ResponseWriter, lang, file string, data interface{}) {
+	htmlo, err := getFile(file)
+	if err != nil {
+		log.Panicf("Oivey, there is a problem reading the file: %v\n", err)
+	}
+	t, err := template.New("webpage").Funcs(templateFuncs(lang)).Parse(string(htmlo))
+	if err != nil {
+		log.Panicf("Help, I couldn't parse the %v\n", err)
+	}
+	if err := t.Execute(w, data); err != nil {
+		panic(err)
+	}
+}
+
+// serveErrorPage writes the error page for the status code, which is
+// http.StatusBadRequest or http.StatusNotFound.
+func serveErrorPage(w http.ResponseWriter, code int) {
+	f := "html/400.html"
+	if code == http.StatusNotFound {
+		f = "html/404.html"
+	}
+	html, err := getFile(f)
+	if err != nil {
+		log.Panicf("O bozhe moi, I failed to read the file %v\n", err)
+	}
+	w.WriteHeader(code)
+	w.Write(html)
+}
+
+// getenvDefault returns the value of the environment variable, or def if it's empty.
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 // talkHandler responds with talk.html page
 func talkHandler(w http.ResponseWriter, r *http.Request) {
 	html, err := getFile("html/talk.html")
@@ -348,39 +612,119 @@ func talkHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(html))
 }
 
-// messageHandler sends a slack message.
-func messageHandler(w http.ResponseWriter, r *http.Request) {
-	u := r.PostFormValue("username")
-	m := r.PostFormValue("message")
-	log.Printf("Howdy mam, username is: %q, message is: %q\n", u, m)
-	fmt.Fprintf(w, "I am not ready yet, mam\n")
-	// TODO: need to check for post, username and message.
-	// TODO: need to send the request to slack.
+// messageChannels returns the channels the messages of visitors go to, all
+// that are set up, or Slack if none are so that they wait in the outbox.
+//
+// A Slack thread, which Aruna can answer in, is used instead of the webhook
+// if both are set up.
+func messageChannels() []string {
+	channels := []string{}
+	for _, name := range []string{"slack-thread", "slack", "webhook", "email"} {
+		if _, ok := Outbox.notifiers[name]; ok && !(name == "slack" && contains(channels, "slack-thread")) {
+			channels = append(channels, name)
+		}
+	}
+	if len(channels) == 0 {
+		channels = append(channels, "slack")
+	}
+	return channels
 }
 
-//addCityHandler allows a user to add a city.
+// messageThrottle stops anyone from flooding the inbox and Slack with messages.
+var messageThrottle = newThrottle(10, time.Hour)
+
+// messageHandler keeps a message for Aruna in the inbox, sends it to her
+// through the outbox, and takes the visitor to the conversation page where
+// her answers show up.
+//
+// Nobody can send more than 10 messages an hour from the same IP.
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	if !messageThrottle.allow(remoteIP(r)) {
+		log.Printf("Sirree %v, that's enough messages for now!\n", r.RemoteAddr)
+		serveErrorPage(w, http.StatusTooManyRequests)
+		return
+	}
+	m := &inboxMessage{
+		Username: strings.TrimSpace(r.PostFormValue("username")),
+		Email:    strings.TrimSpace(r.PostFormValue("email")),
+		Text:     strings.TrimSpace(r.PostFormValue("message")),
+		IP:       remoteIP(r),
+	}
+	log.Printf("Howdy mam, username is: %q, message is: %q\n", m.Username, m.Text)
+	if m.Username == "" || m.Text == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Madam or Siree, I need your name and a message!\n")
+		return
+	}
+	if m.Email != "" {
+		addr, err := mail.ParseAddress(m.Email)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Madam or Siree, %q doesn't look like an email!\n", m.Email)
+			return
+		}
+		m.Email = addr.Address
+	}
+	if err := Inbox.add(m); err != nil {
+		log.Printf("Oibai, I can't keep the message: %v\n", err)
+		http.Error(w, "Oibai, I can't keep the message", http.StatusInternalServerError)
+		return
+	}
+	n := notification{Subject: fmt.Sprintf("A message from %v", m.Username), Text: m.Text, Ref: "message:" + m.ID}
+	if m.Email != "" {
+		n.Subject += " <" + m.Email + ">"
+	}
+	ids := []string{}
+	for _, channel := range messageChannels() {
+		e, err := Outbox.enqueue(channel, n)
+		if err != nil {
+			log.Printf("Oibai, I can't send the message %v over %v: %v\n", m.ID, channel, err)
+			continue
+		}
+		ids = append(ids, e.ID)
+	}
+	if err := Inbox.update(m.ID, func(m *inboxMessage) error {
+		m.Deliveries = ids
+		return nil
+	}); err != nil {
+		log.Printf("Oibai, I can't keep how the message %v is sent: %v\n", m.ID, err)
+	}
+	http.Redirect(w, r, m.conversationURL(), http.StatusSeeOther)
+}
 
-// TODO: when a user enters a city, acknowledge that the city was entered.
-// TODO: if a city was entered twice, inform the user that the city already exists. Don't save it again.
-// TODO: need to be able to modify a city or delete it.
+// addCityHandler allows a user to submit a city, which an admin has to
+// approve before everyone can see it.
 func addCityHandler(w http.ResponseWriter, r *http.Request) {
-	n := r.PostFormValue("cityname")
-	if n == "" {
+	if r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	lang := visitorLang(w, r)
+	newCity, err := cityFromForm(r)
+	if err != nil {
+		log.Printf("Bozhechki, the city wasn't entered properly: %v\n", err)
 		w.WriteHeader(http.StatusBadRequest)
-		log.Println("Bozhechki, no city was entered!\n")
-		fmt.Fprintf(w, "Madam or Siree, you have not entered the city name!\n")
+		render(w, lang, "html/invalid_city.html.tmpl", struct {
+			Title  string
+			Errors fieldErrors
+		}{strings.TrimSpace(r.PostFormValue("cityname")), err.(fieldErrors)})
+		return
+	}
+	sub, err := Moderation.submit(newCity, visitorID(w, r), remoteIP(r))
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("Bozhechki, I can't take %q: %v\n", newCity.name, err)
+		fmt.Fprintf(w, "Madam or Siree, %v!\n", err)
 		return
 	}
-	// else {
-	//	fmt.Printf(w, "Here is your city: %v\n", )
-	//	p, err := r.PostFormValue("citypopulation")
-	//	c := r.PostFormValue("citycost")
-	//	cl := r.PostFormValue("cityclimate")
-	newCity := city{name: n, population: 1000, cost: ReasonableCost, climate: GreatClimate}
-	Cities = append(Cities, newCity)
-	log.Printf("Howdy mam, new city is: %q", newCity)
-	http.Redirect(w, r, "/", http.StatusFound)
-	//	fmt.Fprintf(w,"Your city has been entered, madam or siree: %v\n", n)
+	log.Printf("Howdy mam, new city %q is waiting for review as %v", newCity.name, sub.ID)
+	render(w, lang, "html/submitted.html.tmpl", pageData{Title: newCity.name})
 }
 
 // regHandlers registers the handlers and returns an error if there is a problem.
@@ -390,16 +734,120 @@ func regHandlers(version string) error {
 		return err
 	}
 	http.Handle("/", ihandler)
-	http.Handle("/by-cost", citiesHandler{"cost"})
-	http.Handle("/by-population", citiesHandler{"population"})
-	http.Handle("/by-climate", citiesHandler{"climate"})
+	for _, c := range criteriaRegistry {
+		http.Handle("/by-"+c.name, citiesHandler{c.name})
+	}
+	http.Handle("/by-distance", citiesHandler{"distance"})
+	http.HandleFunc("/rank", rankHandler)
+	http.HandleFunc("/r", permalinkHandler)
+	http.HandleFunc("/r/", permalinkHandler)
+	http.HandleFunc("/quiz", quizHandler)
+	http.HandleFunc("/compare", compareHandler)
+	http.HandleFunc("/similar", similarHandler)
+	http.HandleFunc("/pareto", paretoHandler)
+	http.HandleFunc("/cities.geojson", geoJSONHandler)
+	http.HandleFunc("/cities.kml", kmlHandler)
 	http.HandleFunc("/city", addCityHandler)
+	http.HandleFunc("/city/", cityHandler)
+	http.HandleFunc("/rate", rateHandler)
+	http.HandleFunc("/shortlist", shortlistHandler)
+	http.HandleFunc("/alerts", alertsHandler)
+	http.HandleFunc("/alerts/confirm", confirmHandler)
+	http.HandleFunc("/alerts/unsubscribe", unsubscribeHandler)
+	http.HandleFunc("/admin/cities", requireAdmin(moderationHandler))
+	http.HandleFunc("/admin/city", requireAdmin(adminCityHandler))
+	http.HandleFunc("/admin/messages", requireAdmin(inboxHandler))
 	http.HandleFunc("/talk", talkHandler)
 	http.HandleFunc("/message", messageHandler)
+	http.HandleFunc("/conversation/", conversationHandler)
+	http.HandleFunc("/slack/events", slackEventsHandler)
+	http.HandleFunc("/slack/commands", slashHandler)
+	return nil
+}
+
+// loadData loads the cities, their history and what visitors gave us from DataDir.
+//
+// The error is not nil when something there can't be read.
+func loadData() error {
+	history, err := newHistoryStore(filepath.Join(DataDir, "history.json"), filepath.Join(DataDir, "cities.json"))
+	if err != nil {
+		return err
+	}
+	History = history
+	// Only the cities we start with get their cost from the breakdown, the
+	// saved ones keep the cost admins gave them.
+	seeds := append(cities{}, allCities()...)
+	if err := seeds.deriveCosts(CostReference); err != nil {
+		return fmt.Errorf("Oibai, I can't work out the cost of living: %v", err)
+	}
+	loaded, err := loadCities(filepath.Join(DataDir, "cities.json"), seeds)
+	if err != nil {
+		return err
+	}
+	setCities(loaded)
+	// The ids are only saved by the server, see main.
+	History.adopt()
+	ratings, err := newRatingStore(filepath.Join(DataDir, "ratings.json"))
+	if err != nil {
+		return err
+	}
+	Ratings = ratings
+	moderation, err := newModerationStore(filepath.Join(DataDir, "submissions.json"))
+	if err != nil {
+		return err
+	}
+	Moderation = moderation
+	shortlists, err := newShortlistStore(filepath.Join(DataDir, "shortlists.json"))
+	if err != nil {
+		return err
+	}
+	Shortlists = shortlists
+	permalinks, err := newPermalinkStore(filepath.Join(DataDir, "permalinks.json"))
+	if err != nil {
+		return err
+	}
+	Permalinks = permalinks
+	alerts, err := newAlertStore(filepath.Join(DataDir, "alerts.json"))
+	if err != nil {
+		return err
+	}
+	Alerts = alerts
+	outbox, err := loadOutbox(filepath.Join(DataDir, "outbox.json"), configuredNotifiers())
+	if err != nil {
+		return err
+	}
+	Outbox = outbox
+	Outbox.receipts = recordThread
+	Outbox.threads = threadOf
+	inbox, err := newInboxStore(filepath.Join(DataDir, "messages.json"))
+	if err != nil {
+		return err
+	}
+	Inbox = inbox
 	return nil
 }
 
+// main runs the web server, or the command given as arguments, see cli.go.
 func main() {
+	if err := loadData(); err != nil {
+		log.Panicf("%v\n", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+	lock, err := lockData(DataDir)
+	if err != nil {
+		log.Panicf("Oibai, %v\n", err)
+	}
+	defer lock.Close()
+	if err := History.saveIDs(); err != nil {
+		log.Panicf("Oibai, I can't save the ids of the cities: %v\n", err)
+	}
+	serve()
+}
+
+// serve runs the web server forever.
+func serve() {
 	version := os.Getenv("CITIES_VERSION")
 	if version == "" {
 		if Prod {
@@ -424,7 +872,8 @@ func main() {
 		}
 		s.TLSConfig = &tls.Config{GetCertificate: m.GetCertificate}
 	}
-	log.Printf("We have %v cities: %v\n", len(Cities), Cities.getNames())
+	log.Printf("We have %v cities: %v\n", len(allCities()), allCities().getNames())
+	go Outbox.run(time.Minute)
 	log.Printf("I will now be a webe server forever at %v, you puny minions, hahahaha!\n", addr)
 	regHandlers(version)
 	if Prod {
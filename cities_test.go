@@ -3,7 +3,10 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TODO: test rendeing html template
@@ -78,3 +81,46 @@ func TestCitiesHandler(t *testing.T) {
 		t.Errorf("Dude, expected status 200, got %v", rec.Code)
 	}
 }
+
+func TestMessageHandler(t *testing.T) {
+	defer func(o *outbox, i *inboxStore) { Outbox, Inbox = o, i }(Outbox, Inbox)
+	defer func(th *throttle) { messageThrottle = th }(messageThrottle)
+	slack, webhook := &fakeNotifier{}, &fakeNotifier{}
+	Outbox = newOutbox("", map[string]notifier{"slack": slack, "webhook": webhook})
+	Inbox = &inboxStore{}
+	messageThrottle = newThrottle(3, time.Hour)
+
+	type testCase struct {
+		method   string
+		form     url.Values
+		wantCode int
+	}
+	cases := []testCase{
+		{method: http.MethodPost, form: url.Values{"username": {"anna"}, "message": {"Add Oslo, please!"}}, wantCode: http.StatusSeeOther},
+		{method: http.MethodPost, form: url.Values{"username": {"anna"}, "message": {" "}}, wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, form: url.Values{"username": {"anna"}, "email": {"anna"}, "message": {"Hej!"}}, wantCode: http.StatusBadRequest},
+		{method: http.MethodGet, wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, form: url.Values{"username": {"anna"}, "message": {"Add Oslo, please, please!"}}, wantCode: http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, "/message", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		messageHandler(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v /message %v: expected %v, got %v", tc.method, tc.form, tc.wantCode, rec.Code)
+		}
+	}
+	Outbox.deliver()
+	kept := Inbox.search("")
+	if len(kept) != 1 || kept[0].Username != "anna" || kept[0].IP != "192.0.2.1" || len(kept[0].Deliveries) != 2 || deliveryStatus(kept[0].Deliveries...) != "sent" {
+		t.Fatalf("Expected the message in the inbox, sent, got %+v", kept)
+	}
+	if kept[0].Token == "" {
+		t.Errorf("Expected the message to have a conversation, got %+v", kept[0])
+	}
+	want := notification{Subject: "A message from anna", Text: "Add Oslo, please!", Ref: "message:" + kept[0].ID}
+	if len(slack.sent) != 1 || slack.sent[0] != want || len(webhook.sent) != 1 {
+		t.Errorf("Expected %+v on Slack and the webhook, got %+v and %+v", want, slack.sent, webhook.sent)
+	}
+}
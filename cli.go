@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type (
+	// command is something the cities binary can do from a terminal, e.g. "cities list".
+	command struct {
+		name  string
+		usage string // the arguments, e.g. "[--json] NAME"
+		help  string
+		run   func(args []string, stdout io.Writer) error
+	}
+
+	// scoredJSON is a city in a ranking by a weighted set of criteria, as JSON.
+	scoredJSON struct {
+		Rank   int                `json:"rank"`
+		Name   string             `json:"name"`
+		Score  float64            `json:"score"`
+		Scores map[string]float64 `json:"scores"` // the normalized score for each criterion
+	}
+
+	// viewFlags are the flags that choose which cities to look at, like the
+	// query parameters of the ranking pages.
+	viewFlags struct {
+		near     string
+		withinKm string
+		crowd    bool
+	}
+)
+
+// commands are the commands of the cities binary, "serve" is handled by main.
+var commands = []command{
+	{
+		name:  "list",
+		usage: "[--by CRITERIA] [--near CITY --within-km KM] [--crowd] [--json]",
+		help:  "list the cities, sorted by name or a criterion like on /by-climate",
+		run:   listCommand,
+	},
+	{
+		name:  "rank",
+		usage: "--by climate=2,cost=1 [--norm minmax|rank|zscore] [--log population] [--better population:lower] [--near CITY --within-km KM] [--crowd] [--json]",
+		help:  "rank the cities by a weighted set of criteria like on /rank, the best last",
+		run:   rankCommand,
+	},
+	{
+		name:  "show",
+		usage: "[--by climate=2,cost=1] [--json] NAME",
+		help:  "show everything about a city like on /city/NAME",
+		run:   showCommand,
+	},
+	{
+		name:  "import",
+		usage: "[--min-population 100000] [--country ES,DK] [--countries countryInfo.txt] [--admin1 admin1CodesASCII.txt] [--dry-run] FILE",
+		help:  "queue the cities in a GeoNames dump, e.g. cities15000.txt, for admins to review on /admin/cities",
+		run:   importCommand,
+	},
+}
+
+// runCommand runs the command in the arguments, e.g. ["rank", "--by", "climate=1"],
+// and returns the exit code.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stdout)
+		return 0
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		if err := c.run(args[1:], stdout); err != nil {
+			fmt.Fprintf(stderr, "Oibai, %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stderr, "Madam or Siree, I don't know how to %q.\n\n", args[0])
+	usage(stderr)
+	return 2
+}
+
+// usage writes how to use the cities binary.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: cities [command]\n\nCommands:\n")
+	fmt.Fprintf(w, "  serve\n\trun the web server, the same as no command\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\n\t%s\n", c.name, c.usage, c.help)
+	}
+}
+
+// newFlagSet returns the flag set for the command, which doesn't print
+// anything itself since errors are returned.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+// add adds the flags to the flag set.
+func (vf *viewFlags) add(fs *flag.FlagSet) {
+	fs.StringVar(&vf.near, "near", "", "only cities near this one")
+	fs.StringVar(&vf.withinKm, "within-km", "", "how near, with --near")
+	fs.BoolVar(&vf.crowd, "crowd", false, "use the cost and climate visitors rated")
+}
+
+// query returns the flags as the query parameters of the ranking pages.
+func (vf viewFlags) query() url.Values {
+	q := url.Values{}
+	if vf.near != "" {
+		q.Set("near", vf.near)
+		q.Set("within_km", vf.withinKm)
+	}
+	if vf.crowd {
+		q.Set("values", "crowd")
+	}
+	return q
+}
+
+// parseWeights adds the weights, e.g. "climate=2,cost=1", to the query.
+func parseWeights(weights string, q url.Values) error {
+	for _, w := range splitList(weights) {
+		parts := strings.SplitN(w, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad weight %q, want e.g. climate=2", w)
+		}
+		q.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return nil
+}
+
+// printJSON writes v as indented JSON.
+func printJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// listCommand lists the cities, e.g. cities list --by climate --near Stockholm --within-km 1500.
+func listCommand(args []string, stdout io.Writer) error {
+	fs := newFlagSet("list")
+	by := fs.String("by", "", `"name" or a criterion, e.g. "climate"`)
+	to := fs.String("to", "", `the cities for --by distance, e.g. "Stockholm,Barcelona"`)
+	asJSON := fs.Bool("json", false, "print JSON")
+	vf := viewFlags{}
+	vf.add(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := vf.query()
+	if *to != "" {
+		q.Set("to", *to)
+	}
+	var ranked []rankedCity
+	if *by == "name" {
+		cs, err := allCities().view(*by, q)
+		if err != nil {
+			return err
+		}
+		for _, c := range cs {
+			ranked = append(ranked, rankedCity{city: c})
+		}
+	} else {
+		if *by != "" {
+			q.Set("by", *by)
+		}
+		var err error
+		if ranked, err = exportView(q); err != nil {
+			return err
+		}
+	}
+	if *asJSON {
+		return printJSON(stdout, toCitiesJSON(ranked))
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tCity\tCountry\tPopulation\tCost\tClimate")
+	for i, rc := range ranked {
+		rank := rc.rank
+		if rank == 0 {
+			rank = i + 1
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", rank, rc.name, rc.country, formatPopulation(rc.population), rc.cost, rc.climate)
+	}
+	return tw.Flush()
+}
+
+// rankCommand ranks the cities by a weighted set of criteria, e.g. cities rank --by climate=2,cost=1.
+func rankCommand(args []string, stdout io.Writer) error {
+	fs := newFlagSet("rank")
+	by := fs.String("by", "", `the weights, e.g. "climate=2,cost=1"`)
+	to := fs.String("to", "", `the cities for a distance weight, e.g. "Stockholm,Barcelona"`)
+	norm := fs.String("norm", "", "the normalization: minmax, rank or zscore")
+	logged := fs.String("log", "", `the criteria to log scale, e.g. "population"`)
+	better := fs.String("better", "", `whether higher or lower is better, e.g. "population:lower"`)
+	asJSON := fs.Bool("json", false, "print JSON")
+	vf := viewFlags{}
+	vf.add(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := vf.query()
+	if err := parseWeights(*by, q); err != nil {
+		return err
+	}
+	for name, v := range map[string]string{"to": *to, "norm": *norm, "better": *better} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "log" {
+			q.Set("log", *logged)
+		}
+	})
+	rc, err := parseRankConfig(q)
+	if err != nil {
+		return err
+	}
+	cs, err := allCities().view("", q)
+	if err != nil {
+		return err
+	}
+	scored := rc.score(cs)
+	if *asJSON {
+		list := make([]scoredJSON, len(scored))
+		for i, sc := range scored {
+			list[i] = scoredJSON{Rank: len(scored) - i, Name: sc.name, Score: sc.score, Scores: map[string]float64{}}
+			for j, wc := range rc.criteria {
+				list[i].Scores[wc.name] = sc.scores[j]
+			}
+		}
+		return printJSON(stdout, list)
+	}
+	p := newRankPage(rc, scored, "en")
+	fmt.Fprintf(stdout, "By %s, normalized with %s, higher is better:\n\n", p.Summary, p.Norm)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "#\tCity\tScore\t%s\n", strings.Join(p.Labels, "\t"))
+	for _, row := range p.Rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", row.Rank, row.City.name, row.Score, strings.Join(row.Scores, "\t"))
+	}
+	return tw.Flush()
+}
+
+// showCommand shows everything about a city, e.g. cities show Barcelona.
+func showCommand(args []string, stdout io.Writer) error {
+	fs := newFlagSet("show")
+	by := fs.String("by", "", `the weights for the score, e.g. "climate=2,cost=1"`)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if fs.NArg() > 1 {
+		// Allow the flags after the name too, e.g. cities show Barcelona --json.
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			return fmt.Errorf("one city at a time, put quotes around names like \"New York\"")
+		}
+	}
+	all := allCities()
+	c, ok := all.find(name)
+	if !ok {
+		return fmt.Errorf("no city called %q", name)
+	}
+	q := defaultRankQuery()
+	if *by != "" {
+		q = url.Values{}
+		if err := parseWeights(*by, q); err != nil {
+			return err
+		}
+	}
+	rc, err := parseRankConfig(q)
+	if err != nil {
+		return err
+	}
+	p := newCityPage(c, all, rc, q, "", "en")
+	if *asJSON {
+		return printJSON(stdout, p)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\n", p.Title)
+	for _, a := range p.Attributes {
+		fmt.Fprintf(tw, "  %s\t%s\n", a.Label, a.Value)
+	}
+	if len(p.Costs) > 0 {
+		fmt.Fprintf(tw, "\nCost of living per month\n")
+		for _, a := range p.Costs {
+			fmt.Fprintf(tw, "  %s\t%s\n", a.Label, a.Value)
+		}
+	}
+	fmt.Fprintf(tw, "\nRankings out of %d cities, where 1 is the best\n", p.Of)
+	for _, r := range p.Ranks {
+		fmt.Fprintf(tw, "  %s\t%s\t%d\n", r.Label, r.Value, r.Rank)
+	}
+	fmt.Fprintf(tw, "\nBy %s, %s scores %s and is number %d of %d.\n", p.Summary, p.Title, p.Score, p.ScoreRank, p.Of)
+	return tw.Flush()
+}
+
+// importCommand queues the cities in a GeoNames dump for review, e.g.
+// cities import --min-population 100000 --country ES cities15000.txt.
+//
+// The country and region codes are turned into names with the GeoNames
+// countryInfo.txt and admin1CodesASCII.txt files if they are given.
+func importCommand(args []string, stdout io.Writer) error {
+	fs := newFlagSet("import")
+	minPopulation := fs.Int("min-population", 100000, "only cities with at least this many people")
+	country := fs.String("country", "", `only cities in these countries, e.g. "ES,DK"`)
+	countriesFile := fs.String("countries", "", "the GeoNames countryInfo.txt, for country names")
+	admin1File := fs.String("admin1", "", "the GeoNames admin1CodesASCII.txt, for region names")
+	dryRun := fs.Bool("dry-run", false, "only show what would be imported")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("need one GeoNames file to import, e.g. cities15000.txt")
+	}
+	countries, err := readNamesFile(*countriesFile, 4)
+	if err != nil {
+		return err
+	}
+	regions, err := readNamesFile(*admin1File, 1)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	filter := geoNamesFilter{minPopulation: *minPopulation, countries: splitList(strings.ToUpper(*country))}
+	cs, dropped, err := readGeoNames(f, filter, countries, regions)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fs.Arg(0), err)
+	}
+	skipped := []error{}
+	for _, c := range dropped {
+		bigger, _ := cs.find(c.name)
+		skipped = append(skipped, fmt.Errorf("%v in %v: we only take the bigger %v in %v", c.name, c.country, bigger.name, bigger.country))
+	}
+	if *dryRun {
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "City\tCountry\tRegion\tPopulation")
+		for _, c := range cs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.name, c.country, c.region, formatPopulation(c.population))
+		}
+		fmt.Fprintf(tw, "\n%d cities would be queued for review.\n", len(cs))
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		printSkipped(stdout, "%d would be skipped:\n", skipped)
+		return nil
+	}
+	// The server keeps the submissions in memory and would overwrite ours,
+	// so it must not run, and we read them again now that nobody else can.
+	lock, err := lockData(DataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if Moderation, err = newModerationStore(Moderation.file); err != nil {
+		return err
+	}
+	added, errs := Moderation.submitAll(cs, "geonames", "")
+	fmt.Fprintf(stdout, "Queued %d cities for review on /admin/cities.\n", added)
+	printSkipped(stdout, "Skipped %d:\n", append(skipped, errs...))
+	return nil
+}
+
+// printSkipped writes why the cities weren't imported, if any weren't, after
+// the heading with how many, e.g. "Skipped %d:\n".
+func printSkipped(stdout io.Writer, heading string, errs []error) {
+	if len(errs) > 0 {
+		fmt.Fprintf(stdout, heading, len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(stdout, "  %v\n", err)
+		}
+	}
+}
+
+// readNamesFile returns the names in a GeoNames file by their code, see
+// readGeoNamesNames, or none if there is no file.
+func readNamesFile(file string, column int) (map[string]string, error) {
+	if file == "" {
+		return map[string]string{}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := readGeoNamesNames(f, column)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return names, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	type testCase struct {
+		args     []string
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{args: []string{"help"}, wantCode: 0, wantText: "rank --by climate=2,cost=1"},
+		{args: []string{"dance"}, wantCode: 2, wantText: "I don't know how to \"dance\""},
+		{args: []string{"list"}, wantCode: 0, wantText: "1  Barcelona"},
+		{args: []string{"list", "--by", "climate", "--near", "Stockholm", "--within-km", "1500"}, wantCode: 0, wantText: "1  Stockholm"},
+		{args: []string{"list", "--by", "population"}, wantCode: 0, wantText: "1  Deviltown"},
+		{args: []string{"list", "--by", "happiness"}, wantCode: 1, wantText: `no criteria called "happiness"`},
+		{args: []string{"rank", "--by", "climate=2,cost=1"}, wantCode: 0, wantText: "1  Paradisio   1.00"},
+		{args: []string{"rank", "--by", "climate=2,cost=1"}, wantCode: 0, wantText: "By cost (33%) and climate (67%)"},
+		{args: []string{"rank", "--by", "climate"}, wantCode: 1, wantText: "bad weight"},
+		{args: []string{"rank"}, wantCode: 1, wantText: "no criteria with a weight"},
+		{args: []string{"show", "Barcelona"}, wantCode: 0, wantText: "is number 2 of 7"},
+		{args: []string{"show", "New York", "--by", "population=1"}, wantCode: 0, wantText: "By population (100%)"},
+		{args: []string{"show", "Atlantis"}, wantCode: 1, wantText: `no city called "Atlantis"`},
+	}
+	for _, tc := range cases {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := runCommand(tc.args, stdout, stderr)
+		if code != tc.wantCode {
+			t.Errorf("runCommand(%q) = %v, want %v, stderr:\n%v", tc.args, code, tc.wantCode, stderr)
+		}
+		if out := stdout.String() + stderr.String(); !strings.Contains(out, tc.wantText) {
+			t.Errorf("runCommand(%q): expected %q in:\n%v", tc.args, tc.wantText, out)
+		}
+	}
+}
+
+func TestRunCommand_json(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	if code := runCommand([]string{"rank", "--by", "climate=1", "--json"}, stdout, stdout); code != 0 {
+		t.Fatalf("Oibai, rank --json failed:\n%v", stdout)
+	}
+	got := []scoredJSON{}
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("Oibai, the JSON doesn't parse: %v", err)
+	}
+	if len(got) != len(allCities()) || got[len(got)-1].Name != "Paradisio" || got[len(got)-1].Rank != 1 || got[len(got)-1].Scores["climate"] != 1 {
+		t.Errorf("Unexpected ranking: %+v", got)
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"show", "--json", "Barcelona"}, stdout, stdout); code != 0 {
+		t.Fatalf("Oibai, show --json failed:\n%v", stdout)
+	}
+	page := map[string]interface{}{}
+	if err := json.Unmarshal(stdout.Bytes(), &page); err != nil {
+		t.Fatalf("Oibai, the JSON doesn't parse: %v", err)
+	}
+	if page["name"] != "Barcelona" || page["score_rank"] != 2.0 {
+		t.Errorf("Unexpected city: %v", page)
+	}
+}
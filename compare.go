@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type (
+	// comparison is a few cities side by side, with a row per criterion.
+	comparison struct {
+		Title  string       `json:"-"`
+		Cities []string     `json:"cities"`
+		Links  []string     `json:"-"`
+		Rows   []compareRow `json:"rows"`
+	}
+	compareRow struct {
+		Criteria string        `json:"criteria"`
+		Label    string        `json:"label"`
+		Cells    []compareCell `json:"values"`
+	}
+	// compareCell is the value of a criterion for one of the cities.
+	compareCell struct {
+		City        string  `json:"city"`
+		Value       float64 `json:"value"`
+		Description string  `json:"description"`
+		Best        bool    `json:"best"`
+		Difference  string  `json:"difference,omitempty"` // compared to the first city
+	}
+)
+
+// monthlyCostCriterion is the monthly cost for one person in euros.
+//
+// It isn't registered since not all cities have a cost breakdown, so it's
+// only used when comparing cities that do.
+var monthlyCostCriterion = &criterion{
+	name:  "monthly_cost",
+	label: "Monthly cost",
+	value: func(c city) float64 {
+		eur, _ := c.costs.inEUR()
+		return eur
+	},
+	describe: func(c city, lang string) string {
+		eur, _ := c.costs.inEUR()
+		return fmt.Sprintf("%.0f EUR", eur)
+	},
+	ratio: true,
+}
+
+// compare returns the cities side by side, described in the language.
+func compare(cs cities, lang string) comparison {
+	cmp := comparison{Title: fmt.Sprintf(tr(lang, "Comparing %s"), cs.getNames())}
+	for _, c := range cs {
+		cmp.Cities = append(cmp.Cities, c.name)
+		cmp.Links = append(cmp.Links, c.URL())
+	}
+	crs := append([]*criterion{}, criteriaRegistry...)
+	allCosts := true
+	for _, c := range cs {
+		if _, err := c.costs.inEUR(); !c.costs.known() || err != nil {
+			allCosts = false
+		}
+	}
+	if allCosts {
+		crs = append(crs, monthlyCostCriterion)
+	}
+	for _, cr := range crs {
+		row := compareRow{Criteria: cr.name, Label: cr.label}
+		for i, c := range cs {
+			cell := compareCell{
+				City:        c.name,
+				Value:       cr.value(c),
+				Description: cr.describe(c, lang),
+				Best:        cs.rankOf(c, cr) == 1,
+			}
+			if i > 0 {
+				cell.Difference = difference(cr, c, cs[0], lang)
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		cmp.Rows = append(cmp.Rows, row)
+	}
+	return cmp
+}
+
+// difference describes how c compares to the first city by the criterion,
+// e.g. "2.4x the population" or "worse".
+func difference(cr *criterion, c, first city, lang string) string {
+	v, f := cr.value(c), cr.value(first)
+	if cr.ratio && f > 0 {
+		return fmt.Sprintf(tr(lang, "%.1fx the %s of %s"), v/f, strings.ToLower(tr(lang, cr.label)), first.name)
+	}
+	switch {
+	case cr.better(c, first):
+		return fmt.Sprintf(tr(lang, "better than %s"), first.name)
+	case cr.better(first, c):
+		return fmt.Sprintf(tr(lang, "worse than %s"), first.name)
+	}
+	return fmt.Sprintf(tr(lang, "same as %s"), first.name)
+}
+
+// compareHandler shows cities side by side, e.g. /compare?cities=Barcelona,Seattle.
+//
+// With ?format=json the comparison is JSON.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	cs, err := allCities().lookup(r.URL.Query().Get("cities"))
+	if err == nil && len(cs) < 2 {
+		err = fmt.Errorf("need at least two cities to compare")
+	}
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		cmp := compare(cs, languages[0].Tag)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cmp); err != nil {
+			log.Printf("Oibai, I couldn't write the JSON: %v\n", err)
+		}
+		return
+	}
+	lang := visitorLang(w, r)
+	render(w, lang, "html/compare.html.tmpl", compare(cs, lang))
+}
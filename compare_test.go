@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	cs, err := allCities().lookup("Stockholm,Barcelona")
+	if err != nil {
+		t.Fatalf("Oibai, lookup() failed: %v", err)
+	}
+	cmp := compare(cs, "en")
+	type testCase struct {
+		criteria string
+		wantBest []bool
+		wantDiff string
+	}
+	cases := []testCase{
+		{criteria: "cost", wantBest: []bool{false, true}, wantDiff: "better than Stockholm"},
+		{criteria: "climate", wantBest: []bool{false, true}, wantDiff: "better than Stockholm"},
+		{criteria: "population", wantBest: []bool{false, true}, wantDiff: "2.0x the population of Stockholm"},
+		{criteria: "monthly_cost", wantBest: []bool{false, true}, wantDiff: "0.7x the monthly cost of Stockholm"},
+	}
+	for _, tc := range cases {
+		var row *compareRow
+		for i := range cmp.Rows {
+			if cmp.Rows[i].Criteria == tc.criteria {
+				row = &cmp.Rows[i]
+			}
+		}
+		if row == nil {
+			t.Errorf("No row for %v", tc.criteria)
+			continue
+		}
+		for i, want := range tc.wantBest {
+			if row.Cells[i].Best != want {
+				t.Errorf("%v: best for %v = %v, want %v", tc.criteria, row.Cells[i].City, row.Cells[i].Best, want)
+			}
+		}
+		if got := row.Cells[1].Difference; got != tc.wantDiff {
+			t.Errorf("%v: difference = %q, want %q", tc.criteria, got, tc.wantDiff)
+		}
+	}
+}
+
+func TestCompareHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+	}
+	cases := []testCase{
+		{url: "/compare?cities=Barcelona,Seattle,Stockholm", wantCode: http.StatusOK},
+		{url: "/compare?cities=Barcelona", wantCode: http.StatusBadRequest},
+		{url: "/compare?cities=Barcelona,Atlantis", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		compareHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	compareHandler(rec, httptest.NewRequest(http.MethodGet, "/compare?cities=Barcelona,Seattle&format=json", nil))
+	got := comparison{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Oibai, the JSON doesn't parse: %v\n%v", err, rec.Body.String())
+	}
+	if len(got.Cities) != 2 || len(got.Rows) == 0 {
+		t.Errorf("Unexpected comparison: %+v", got)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// slackEvent is what Slack posts to the Events API endpoint, see
+	// https://api.slack.com/apis/connections/events-api.
+	slackEvent struct {
+		Type      string `json:"type"`      // "url_verification" or "event_callback"
+		Challenge string `json:"challenge"` // to answer the url_verification with
+		Event     struct {
+			Type     string `json:"type"` // e.g. "message"
+			Subtype  string `json:"subtype"`
+			BotID    string `json:"bot_id"`
+			User     string `json:"user"`
+			Channel  string `json:"channel"`
+			Text     string `json:"text"`
+			TS       string `json:"ts"`
+			ThreadTS string `json:"thread_ts"`
+		} `json:"event"`
+	}
+
+	// conversationPage is the data for the page of a visitor's conversation
+	// with Aruna, and its JSON to check for answers.
+	conversationPage struct {
+		Title    string              `json:"-"`
+		Username string              `json:"username"`
+		Text     string              `json:"text"`
+		At       time.Time           `json:"at"`
+		Replies  []conversationReply `json:"replies"`
+	}
+
+	// conversationReply is an answer, or more from the visitor.
+	conversationReply struct {
+		Text        string    `json:"text"`
+		FromVisitor bool      `json:"from_visitor"`
+		At          time.Time `json:"at"`
+	}
+)
+
+// maxSlackAge is how old a request from Slack may be, to not be replayed.
+const maxSlackAge = 5 * time.Minute
+
+// conversationURL returns the link to the conversation for the visitor.
+func (m *inboxMessage) conversationURL() string {
+	return "/conversation/" + m.Token
+}
+
+// recordThread remembers the Slack thread a message started, when the
+// outbox tells where it went.
+func recordThread(e outboxEntry) {
+	id := strings.TrimPrefix(e.Notification.Ref, "message:")
+	if e.Channel != "slack-thread" || id == e.Notification.Ref {
+		return
+	}
+	if err := Inbox.update(id, func(m *inboxMessage) error {
+		if m.Thread == "" {
+			m.Thread = e.Receipt
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Oibai, I can't remember the Slack thread of %v: %v\n", id, err)
+	}
+}
+
+// threadOf returns the Slack thread that the message in the ref, e.g.
+// "message:abc123", started, or "" if it hasn't started one yet.
+func threadOf(ref string) string {
+	id := strings.TrimPrefix(ref, "message:")
+	if id == ref {
+		return ""
+	}
+	Inbox.mu.Lock()
+	defer Inbox.mu.Unlock()
+	m, err := Inbox.find(id)
+	if err != nil {
+		return ""
+	}
+	return m.Thread
+}
+
+// byToken returns the message with the token of its conversation.
+func (s *inboxStore) byToken(token string) (inboxMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if token != "" && m.Token == token {
+			return *m, true
+		}
+	}
+	return inboxMessage{}, false
+}
+
+// answer adds the Slack message ts in the thread as an answer to the
+// message that started the thread, once even if Slack tells us again.
+// The answer is kept as plain text, see slackUnescape.
+//
+// The error is not nil if no message started the thread.
+func (s *inboxStore) answer(thread, ts, user, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.Thread != thread {
+			continue
+		}
+		for _, re := range m.Replies {
+			if re.SlackTS == ts {
+				return nil
+			}
+		}
+		before := *m
+		m.Replies = append(m.Replies, reply{Text: slackUnescape(text), By: user, At: time.Now(), SlackTS: ts})
+		m.Handled, m.HandledBy = true, user
+		if err := s.save(); err != nil {
+			*m = before
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("no message started the thread %q", thread)
+}
+
+// followUp adds more from the visitor to the conversation with the token,
+// and sends it to Aruna in the same Slack thread, once the message has
+// started it, see threadOf.
+func (s *inboxStore) followUp(token, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("the message is empty")
+	}
+	m, ok := s.byToken(token)
+	if !ok {
+		return fmt.Errorf("no conversation %q", token)
+	}
+	// It is only sent once it is kept, so a failed save sends nothing.
+	i := 0 // of the reply, replies are only ever added
+	if err := s.update(m.ID, func(m *inboxMessage) error {
+		i = len(m.Replies)
+		m.Replies = append(m.Replies, reply{Text: text, By: m.Username, At: time.Now(), FromVisitor: true})
+		m.Handled = false
+		return nil
+	}); err != nil {
+		return err
+	}
+	n := notification{Subject: fmt.Sprintf("More from %v", m.Username), Text: text, Ref: "message:" + m.ID, Reply: true}
+	ids := []string{}
+	for _, channel := range messageChannels() {
+		e, err := Outbox.enqueue(channel, n)
+		if err != nil {
+			log.Printf("Oibai, I can't send more of the message %v over %v: %v\n", m.ID, channel, err)
+			continue
+		}
+		ids = append(ids, e.ID)
+	}
+	return s.update(m.ID, func(m *inboxMessage) error {
+		m.Replies[i].Delivery = strings.Join(ids, ",")
+		return nil
+	})
+}
+
+// verifySlack returns an error unless the request was signed by Slack with
+// the signing secret in the last few minutes, see
+// https://api.slack.com/authentication/verifying-requests-from-slack.
+func verifySlack(r *http.Request, body []byte, secret string, now time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("no signing secret, set CITIES_SLACK_SIGNING_SECRET")
+	}
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", ts)
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > maxSlackAge || age < -maxSlackAge {
+		return fmt.Errorf("the request is from %v ago", age)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// readSlackRequest returns the body of a request from Slack, if Slack signed it.
+func readSlackRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		log.Printf("Ai-ai-ai, I can't read what Slack sent: %v\n", err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return nil, false
+	}
+	if err := verifySlack(r, body, SlackSigningSecret, time.Now()); err != nil {
+		log.Printf("Stop right there, %v is not Slack: %v\n", r.RemoteAddr, err)
+		http.Error(w, "Madam or Siree, only Slack can go here.", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// slackEventsHandler takes Aruna's answers in the Slack threads of messages
+// to the conversation pages, from the Events API.
+//
+// Everything else is ignored: other channels, other messages in the channel
+// and our own messages.
+func slackEventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	body, ok := readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	ev := slackEvent{}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		log.Printf("Ai-ai-ai, I can't read what Slack sent: %v\n", err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	switch {
+	case ev.Type == "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, ev.Challenge)
+		return
+	case ev.Type != "event_callback" || ev.Event.Type != "message" || ev.Event.Subtype != "" || ev.Event.BotID != "":
+		return
+	case SlackChannel == "" || ev.Event.Channel != SlackChannel:
+		return
+	case ev.Event.ThreadTS == "" || ev.Event.ThreadTS == ev.Event.TS:
+		return
+	}
+	if err := Inbox.answer(ev.Event.ThreadTS, ev.Event.TS, ev.Event.User, ev.Event.Text); err != nil {
+		log.Printf("Sirree, that's not an answer to a visitor: %v\n", err)
+		return
+	}
+	log.Printf("Howdy mam, %v answered in the thread %v\n", ev.Event.User, ev.Event.ThreadTS)
+}
+
+// conversationHandler shows a visitor's message and the answers to it, e.g.
+// /conversation/abc, and takes more from the visitor with a POST of "message".
+//
+// With ?format=json the conversation is JSON, for the page to check for answers.
+func conversationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	token := strings.TrimPrefix(r.URL.Path, "/conversation/")
+	m, ok := Inbox.byToken(token)
+	if !ok {
+		log.Printf("Sirree, there is no conversation %q!\n", token)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		if err := Inbox.followUp(token, r.PostFormValue("message")); err != nil {
+			log.Printf("Bozhechki, I can't add to the conversation: %v\n", err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, m.conversationURL(), http.StatusSeeOther)
+		return
+	}
+	if r.Method != "GET" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	p := conversationPage{Title: "Your conversation with Aruna", Username: m.Username, Text: m.Text, At: m.CreatedAt, Replies: []conversationReply{}}
+	for _, re := range m.Replies {
+		p.Replies = append(p.Replies, conversationReply{Text: re.Text, FromVisitor: re.FromVisitor, At: re.At})
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			log.Printf("Oibai, I couldn't write the JSON: %v\n", err)
+		}
+		return
+	}
+	render(w, visitorLang(w, r), "html/conversation.html.tmpl", p)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackRequest returns a request to the url with the body, signed with the secret at the time.
+func slackRequest(url, body, secret string, at time.Time) *http.Request {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestVerifySlack(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	type testCase struct {
+		name    string
+		secret  string
+		at      time.Time
+		body    string
+		wantErr bool
+	}
+	cases := []testCase{
+		{name: "signed", secret: "s3cret", at: now, body: "token=x"},
+		{name: "a bit early", secret: "s3cret", at: now.Add(time.Minute), body: "token=x"},
+		{name: "wrong secret", secret: "guess", at: now, body: "token=x", wantErr: true},
+		{name: "replayed", secret: "s3cret", at: now.Add(-10 * time.Minute), body: "token=x", wantErr: true},
+		{name: "changed", secret: "s3cret", at: now, body: "token=y", wantErr: true},
+	}
+	for _, tc := range cases {
+		req := slackRequest("/slack/events", "token=x", tc.secret, tc.at)
+		if err := verifySlack(req, []byte(tc.body), "s3cret", now); (err != nil) != tc.wantErr {
+			t.Errorf("%v: verifySlack() = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if err := verifySlack(slackRequest("/slack/events", "", "", now), nil, "", now); err == nil {
+		t.Errorf("verifySlack() without a signing secret should fail")
+	}
+}
+
+func TestSlackEventsHandler(t *testing.T) {
+	defer func(i *inboxStore, secret, channel string) {
+		Inbox, SlackSigningSecret, SlackChannel = i, secret, channel
+	}(Inbox, SlackSigningSecret, SlackChannel)
+	SlackSigningSecret = "s3cret"
+	SlackChannel = "C1"
+	Inbox = &inboxStore{}
+	anna := &inboxMessage{Username: "anna", Text: "Please add Oslo", Thread: "1585742400.000100"}
+	Inbox.add(anna)
+
+	type testCase struct {
+		name     string
+		body     string
+		secret   string
+		wantCode int
+		wantBody string
+	}
+	event := `{"type":"event_callback","event":{"type":"message","channel":"C1","user":"UARUNA","text":%q,"ts":%q,"thread_ts":"1585742400.000100"%v}}`
+	cases := []testCase{
+		{name: "verification", body: `{"type":"url_verification","challenge":"abc"}`, secret: "s3cret", wantCode: http.StatusOK, wantBody: "abc"},
+		{name: "forged", body: fmt.Sprintf(event, "Forged", "1585742500.000200", ""), secret: "guess", wantCode: http.StatusUnauthorized},
+		{name: "answer", body: fmt.Sprintf(event, "Oslo is in! <https://cities.example/city/Oslo|See> &amp; enjoy", "1585742500.000200", ""), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "retried", body: fmt.Sprintf(event, "Oslo is in! <https://cities.example/city/Oslo|See> &amp; enjoy", "1585742500.000200", ""), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "ours", body: fmt.Sprintf(event, "More from anna", "1585742600.000300", `,"bot_id":"B1"`), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "edited", body: fmt.Sprintf(event, "Oslo is in!!", "1585742700.000400", `,"subtype":"message_changed"`), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "other thread", body: strings.Replace(fmt.Sprintf(event, "Hej", "1585742800.000500", ""), "1585742400", "1585740000", 1), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "other channel", body: strings.Replace(fmt.Sprintf(event, "Not for you", "1585742900.000600", ""), "C1", "C2", 1), secret: "s3cret", wantCode: http.StatusOK},
+		{name: "garbage", body: "{", secret: "s3cret", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		slackEventsHandler(rec, slackRequest("/slack/events", tc.body, tc.secret, time.Now()))
+		if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantBody) {
+			t.Errorf("%v: expected %v with %q, got %v: %v", tc.name, tc.wantCode, tc.wantBody, rec.Code, rec.Body.String())
+		}
+	}
+	got, _ := Inbox.byToken(anna.Token)
+	if len(got.Replies) != 1 || got.Replies[0].Text != "Oslo is in! See (https://cities.example/city/Oslo) & enjoy" || got.Replies[0].FromVisitor || !got.Handled || got.HandledBy != "UARUNA" {
+		t.Errorf("Expected one answer from Aruna, got %+v", got)
+	}
+}
+
+func TestConversationHandler(t *testing.T) {
+	defer func(o *outbox, i *inboxStore) { Outbox, Inbox = o, i }(Outbox, Inbox)
+	slack := &fakeNotifier{}
+	Outbox = newOutbox("", map[string]notifier{"slack": slack})
+	Outbox.threads = threadOf
+	Inbox = &inboxStore{}
+	anna := &inboxMessage{Username: "anna", Email: "anna@example.com", Text: "Please add Oslo", IP: "10.0.0.1", Thread: "1585742400.000100"}
+	Inbox.add(anna)
+	Inbox.answer(anna.Thread, "1585742500.000200", "UARUNA", "Which Oslo?")
+
+	rec := httptest.NewRecorder()
+	conversationHandler(rec, httptest.NewRequest(http.MethodGet, anna.conversationURL(), nil))
+	for _, want := range []string{"Please add Oslo", "Aruna answered on", "Which Oslo?"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q on the conversation page:\n%v", want, rec.Body.String())
+		}
+	}
+
+	form := url.Values{"message": {"The one in Norway"}}
+	req := httptest.NewRequest(http.MethodPost, anna.conversationURL(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	conversationHandler(rec, req)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != anna.conversationURL() {
+		t.Errorf("Expected a redirect back to the conversation, got %v to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	Outbox.deliver()
+	if len(slack.sent) != 1 || slack.sent[0].Thread != anna.Thread || slack.sent[0].Text != "The one in Norway" {
+		t.Errorf("Expected the follow-up in anna's thread, got %+v", slack.sent)
+	}
+
+	rec = httptest.NewRecorder()
+	conversationHandler(rec, httptest.NewRequest(http.MethodGet, anna.conversationURL()+"?format=json", nil))
+	if strings.Contains(rec.Body.String(), "anna@example.com") || strings.Contains(rec.Body.String(), "10.0.0.1") {
+		t.Errorf("The conversation shouldn't show the email or IP: %v", rec.Body.String())
+	}
+	got := conversationPage{}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Oibai, the conversation isn't JSON: %v", err)
+	}
+	if len(got.Replies) != 2 || got.Replies[0].FromVisitor || !got.Replies[1].FromVisitor || got.Replies[1].Text != "The one in Norway" {
+		t.Errorf("Expected an answer and a follow-up, got %+v", got)
+	}
+
+	type testCase struct {
+		method   string
+		url      string
+		form     url.Values
+		wantCode int
+	}
+	cases := []testCase{
+		{method: http.MethodGet, url: "/conversation/nope", wantCode: http.StatusNotFound},
+		{method: http.MethodGet, url: "/conversation/", wantCode: http.StatusNotFound},
+		{method: http.MethodPost, url: anna.conversationURL(), form: url.Values{"message": {" "}}, wantCode: http.StatusBadRequest},
+		{method: http.MethodDelete, url: anna.conversationURL(), wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		conversationHandler(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v %v: expected %v, got %v", tc.method, tc.url, tc.wantCode, rec.Code)
+		}
+	}
+}
+
+func TestRecordThread(t *testing.T) {
+	defer func(o *outbox, i *inboxStore) { Outbox, Inbox = o, i }(Outbox, Inbox)
+	threads := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		threads = append(threads, msg["thread_ts"])
+		fmt.Fprintf(w, `{"ok":true,"ts":"1585742400.00010%v"}`, len(threads))
+	}))
+	defer ts.Close()
+	Outbox = newOutbox("", map[string]notifier{"slack-thread": slackThread{api: ts.URL, token: "xoxb-secret", channel: "C1"}})
+	Outbox.receipts = recordThread
+	Outbox.threads = threadOf
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	Outbox.now = func() time.Time { return now }
+	Inbox = &inboxStore{}
+	anna := &inboxMessage{Username: "anna", Text: "Please add Oslo"}
+	Inbox.add(anna)
+
+	Outbox.enqueue("slack-thread", notification{Text: anna.Text, Ref: "message:" + anna.ID})
+	Outbox.deliver()
+	if got, _ := Inbox.byToken(anna.Token); got.Thread != "1585742400.000101" {
+		t.Fatalf("Expected anna's message to start a thread, got %q", got.Thread)
+	}
+	if err := Inbox.followUp(anna.Token, "The one in Norway"); err != nil {
+		t.Fatalf("Oibai, followUp() failed: %v", err)
+	}
+	Outbox.deliver()
+	if got, _ := Inbox.byToken(anna.Token); got.Thread != "1585742400.000101" || len(threads) != 2 || threads[1] != "1585742400.000101" {
+		t.Errorf("Expected the follow-up in the same thread, got %q and %v", got.Thread, threads)
+	}
+
+	// A follow-up before the message has started its thread waits for it.
+	bob := &inboxMessage{Username: "bob", Text: "Deviltown is too hot"}
+	Inbox.add(bob)
+	Outbox.enqueue("slack-thread", notification{Text: bob.Text, Ref: "message:" + bob.ID})
+	if err := Inbox.followUp(bob.Token, "Way too hot"); err != nil {
+		t.Fatalf("Oibai, followUp() failed: %v", err)
+	}
+	Outbox.deliver()
+	now = now.Add(firstRetry)
+	Outbox.deliver()
+	if got, _ := Inbox.byToken(bob.Token); got.Thread != "1585742400.000103" || len(threads) != 4 || threads[2] != "" || threads[3] != got.Thread {
+		t.Errorf("Expected the follow-up in bob's thread, got %q and %v", got.Thread, threads)
+	}
+}
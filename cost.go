@@ -0,0 +1,127 @@
+package main
+
+import "fmt"
+
+// costBreakdown is the typical monthly cost of living in a city.
+//
+// All amounts are in the local currency of the city.
+type costBreakdown struct {
+	currency  string  // ISO 4217 code, e.g. "EUR"
+	rent1BR   float64 // one bedroom apartment in the city centre
+	rent3BR   float64 // three bedroom apartment in the city centre
+	groceries float64 // groceries for one person
+	transport float64 // monthly public transport pass
+	eatingOut float64 // eating out a couple of times a week
+	utilities float64 // electricity, heating, water and internet
+}
+
+var (
+	// EURRates is how many euros one unit of each currency is worth.
+	//
+	// TODO: these are rough and should eventually be fetched from a bank.
+	EURRates = map[string]float64{
+		"EUR": 1,
+		"USD": 0.92,
+		"GBP": 1.17,
+		"DKK": 0.134,
+		"SEK": 0.087,
+		"NOK": 0.086,
+		"CHF": 1.04,
+	}
+
+	// costBuckets are the upper bounds of the cost index for each cost.
+	//
+	// Anything at or above the last bound is VeryExpensiveCost.
+	costBuckets = []struct {
+		below float64
+		cost  cost
+	}{
+		{20, CheapCost},
+		{35, VeryReasonableCost},
+		{50, ReasonableCost},
+		{110, ExpensiveCost},
+	}
+)
+
+// known returns true if we have a breakdown of costs.
+func (b costBreakdown) known() bool {
+	return b.currency != ""
+}
+
+// total returns the monthly cost for one person renting a one bedroom apartment.
+func (b costBreakdown) total() float64 {
+	return b.rent1BR + b.groceries + b.transport + b.eatingOut + b.utilities
+}
+
+// inEUR returns the total monthly cost in euros.
+func (b costBreakdown) inEUR() (float64, error) {
+	rate, ok := EURRates[b.currency]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for currency %q", b.currency)
+	}
+	return b.total() * rate, nil
+}
+
+// costIndex returns the cost of living in c relative to ref, where ref is 100.
+func costIndex(c, ref city) (float64, error) {
+	if !c.costs.known() {
+		return 0, fmt.Errorf("no cost breakdown for %v", c.name)
+	}
+	if !ref.costs.known() {
+		return 0, fmt.Errorf("no cost breakdown for reference city %v", ref.name)
+	}
+	eur, err := c.costs.inEUR()
+	if err != nil {
+		return 0, err
+	}
+	refEUR, err := ref.costs.inEUR()
+	if err != nil {
+		return 0, err
+	}
+	if refEUR == 0 {
+		return 0, fmt.Errorf("reference city %v costs nothing", ref.name)
+	}
+	return eur / refEUR * 100, nil
+}
+
+// costBucket returns the cost for the given cost index.
+func costBucket(index float64) cost {
+	for _, b := range costBuckets {
+		if index < b.below {
+			return b.cost
+		}
+	}
+	return VeryExpensiveCost
+}
+
+// find returns the city with the given name, and false if there is no such city.
+func (cs cities) find(name string) (city, bool) {
+	for _, c := range cs {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return city{}, false
+}
+
+// deriveCosts sets the cost of each city with a cost breakdown from its
+// cost index relative to the reference city.
+//
+// Cities without a breakdown keep the cost they have.
+func (cs cities) deriveCosts(reference string) error {
+	ref, ok := cs.find(reference)
+	if !ok {
+		return fmt.Errorf("no reference city %q", reference)
+	}
+	for i := range cs {
+		if !cs[i].costs.known() {
+			continue
+		}
+		index, err := costIndex(cs[i], ref)
+		if err != nil {
+			return err
+		}
+		cs[i].cost = costBucket(index)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCostBucket(t *testing.T) {
+	type testCase struct {
+		index float64
+		want  cost
+	}
+	cases := []testCase{
+		{index: 0, want: CheapCost},
+		{index: 19.9, want: CheapCost},
+		{index: 20, want: VeryReasonableCost},
+		{index: 40, want: ReasonableCost},
+		{index: 100, want: ExpensiveCost},
+		{index: 250, want: VeryExpensiveCost},
+	}
+	for _, tc := range cases {
+		if got := costBucket(tc.index); got != tc.want {
+			t.Errorf("costBucket(%v) = %q, want %q", tc.index, got, tc.want)
+		}
+	}
+}
+
+func TestCostIndex(t *testing.T) {
+	ref := city{name: "Euroville", costs: costBreakdown{currency: "EUR", rent1BR: 1000}}
+	half := city{name: "Dollartown", costs: costBreakdown{currency: "USD", rent1BR: 500 / EURRates["USD"]}}
+	got, err := costIndex(half, ref)
+	if err != nil {
+		t.Fatalf("Oibai, costIndex() failed: %v", err)
+	}
+	if math.Abs(got-50) > 1e-9 {
+		t.Errorf("costIndex() = %v, want 50", got)
+	}
+
+	if _, err := costIndex(city{name: "Nowhere"}, ref); err == nil {
+		t.Errorf("costIndex() for a city without costs should fail")
+	}
+	unknown := city{name: "Gold City", costs: costBreakdown{currency: "XAU", rent1BR: 1}}
+	if _, err := costIndex(unknown, ref); err == nil {
+		t.Errorf("costIndex() for an unknown currency should fail")
+	}
+}
+
+func TestCities_deriveCosts(t *testing.T) {
+	c := make(cities, len(allCities()))
+	copy(c, allCities())
+	if err := c.deriveCosts("New York"); err != nil {
+		t.Fatalf("Dude, deriveCosts() failed: %v", err)
+	}
+	if !c.Equal(allCities()) {
+		t.Errorf("Curated costs don't match the breakdowns, got:\n%v\nWant\n%v\n", c, allCities())
+	}
+	if err := c.deriveCosts("Atlantis"); err == nil {
+		t.Errorf("deriveCosts() with an unknown reference city should fail")
+	}
+}
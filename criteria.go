@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+)
+
+type (
+	// criterion is something we can rank cities by, e.g. climate.
+	//
+	// Adding a criterion with registerCriterion gives it a /by-<name> page,
+	// a link on the index page and makes it available for sorting.
+	criterion struct {
+		name           string                           // used in URLs, e.g. "population"
+		label          string                           // shown to people, e.g. "Population"
+		value          func(c city) float64             // cities are compared by this value
+		describe       func(c city, lang string) string // e.g. "1.6M" in English
+		higherIsBetter bool
+		ratio          bool   // values can be compared as ratios, e.g. "2.4x the population"
+		improved       string // a better city is this, e.g. "cheaper"
+	}
+
+	// criterionLink is a link to the ranking page of a criterion.
+	criterionLink struct {
+		Name  string
+		Label string
+	}
+)
+
+// criteriaRegistry has all registered criteria in the order they were registered.
+var criteriaRegistry []*criterion
+
+func init() {
+	registerCriterion(criterion{
+		name:           "cost",
+		label:          "Cost",
+		value:          func(c city) float64 { return float64(c.cost) },
+		describe:       func(c city, lang string) string { return tr(lang, c.cost.String()) },
+		higherIsBetter: false,
+		improved:       "cheaper",
+	})
+	registerCriterion(criterion{
+		name:           "climate",
+		label:          "Climate",
+		value:          func(c city) float64 { return float64(c.climate) },
+		describe:       func(c city, lang string) string { return tr(lang, c.climate.String()) },
+		higherIsBetter: true,
+		improved:       "with better weather",
+	})
+	registerCriterion(criterion{
+		name:           "population",
+		label:          "Population",
+		value:          func(c city) float64 { return float64(c.population) },
+		describe:       func(c city, lang string) string { return formatPopulationIn(lang, c.population) },
+		higherIsBetter: true,
+		ratio:          true,
+		improved:       "bigger",
+	})
+}
+
+// registerCriterion adds a criterion to the registry.
+//
+// It panics if the criterion is incomplete or there already is one with the same name,
+// since that is a programming error.
+func registerCriterion(c criterion) {
+	if c.name == "" || c.value == nil || c.describe == nil {
+		log.Panicf("Oibai, criterion %q is missing something\n", c.name)
+	}
+	if _, ok := lookupCriterion(c.name); ok || c.name == "name" || c.name == "distance" {
+		log.Panicf("Oibai, criterion %q is already registered\n", c.name)
+	}
+	if c.label == "" {
+		c.label = c.name
+	}
+	if c.improved == "" {
+		c.improved = "better by " + c.name
+	}
+	criteriaRegistry = append(criteriaRegistry, &c)
+}
+
+// lookupCriterion returns the registered criterion with the given name.
+func lookupCriterion(name string) (*criterion, bool) {
+	for _, c := range criteriaRegistry {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// distanceCriterion returns a criterion for the average distance to the anchor cities.
+//
+// It isn't registered since it depends on the anchors.
+func distanceCriterion(anchors cities) *criterion {
+	return &criterion{
+		name:     "distance",
+		label:    fmt.Sprintf("Distance to %v", anchors.getNames()),
+		value:    func(c city) float64 { return meanDistanceKm(c, anchors) },
+		describe: func(c city, lang string) string { return fmt.Sprintf("%.0f km", meanDistanceKm(c, anchors)) },
+		ratio:    true,
+	}
+}
+
+// criterionFor returns the criterion with the given name.
+//
+// The "distance" criterion is to the cities in the "to" query parameter.
+// The error is not nil when there is no such criterion.
+func criterionFor(name string, q url.Values) (*criterion, error) {
+	if name == "distance" {
+		anchors, err := allCities().lookup(q.Get("to"))
+		if err != nil {
+			return nil, err
+		}
+		return distanceCriterion(anchors), nil
+	}
+	c, ok := lookupCriterion(name)
+	if !ok {
+		return nil, fmt.Errorf("no criteria called %q", name)
+	}
+	return c, nil
+}
+
+// less returns true if a has a smaller value than b.
+func (c *criterion) less(a, b city) bool {
+	return c.value(a) < c.value(b)
+}
+
+// better returns true if a is better than b.
+func (c *criterion) better(a, b city) bool {
+	if c.higherIsBetter {
+		return c.less(b, a)
+	}
+	return c.less(a, b)
+}
+
+// sortByCriterion sorts cities in ascending order of the criterion's value.
+func (cs cities) sortByCriterion(c *criterion) {
+	sort.SliceStable(cs, func(i, j int) bool { return c.less(cs[i], cs[j]) })
+}
+
+// criteriaLinks returns links to the ranking pages of all registered criteria.
+func criteriaLinks() []criterionLink {
+	links := make([]criterionLink, len(criteriaRegistry))
+	for i, c := range criteriaRegistry {
+		links[i] = criterionLink{Name: c.name, Label: c.label}
+	}
+	return links
+}
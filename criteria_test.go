@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterCriterion_duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering the cost criterion twice should panic")
+		}
+	}()
+	registerCriterion(criterion{
+		name:     "cost",
+		value:    func(c city) float64 { return 0 },
+		describe: func(c city, lang string) string { return "" },
+	})
+}
+
+func TestCities_sortBy_registered(t *testing.T) {
+	c := cities{
+		city{name: "Barcelona", population: 1.6e6, cost: ReasonableCost, climate: GreatClimate},
+		city{name: "Deviltown", population: 1233567890, cost: VeryExpensiveCost, climate: NastyClimate},
+		city{name: "Paradisio", population: 1e6, cost: CheapCost, climate: PerfectClimate},
+	}
+	type testCase struct {
+		criteria string
+		want     string
+	}
+	cases := []testCase{
+		{criteria: "cost", want: "Paradisio, Barcelona, Deviltown"},
+		{criteria: "climate", want: "Deviltown, Barcelona, Paradisio"},
+		{criteria: "population", want: "Paradisio, Barcelona, Deviltown"},
+	}
+	for _, tc := range cases {
+		c.sortBy(tc.criteria)
+		if c.getNames() != tc.want {
+			t.Errorf("sortBy(%q) = %v, want %v", tc.criteria, c.getNames(), tc.want)
+		}
+	}
+}
+
+func TestIndexHandler_links(t *testing.T) {
+	ih, err := newIndexHandler("test")
+	if err != nil {
+		t.Fatalf("Oibai, newIndexHandler() failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	ih.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for _, c := range criteriaRegistry {
+		link := `href="/by-` + c.name + `"`
+		if !strings.Contains(rec.Body.String(), link) {
+			t.Errorf("Expected a link %v on the index page:\n%v", link, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	// cityPage is the data for the page of a single city.
+	cityPage struct {
+		Title         string          `json:"name"`
+		City          city            `json:"-"`
+		Attributes    []attribute     `json:"attributes"`
+		Costs         []attribute     `json:"costs,omitempty"`
+		Ranks         []criterionRank `json:"ranks"`
+		Summary       string          `json:"weights"`
+		Contributions []contribution  `json:"contributions"`
+		Score         string          `json:"score"`
+		ScoreRank     int             `json:"score_rank"`
+		Of            int             `json:"of"`
+		RankQuery     template.URL    `json:"-"`
+		Ratings       []crowdRating   `json:"-"`
+		Similar       []similarCity   `json:"similar"`
+		BetterLinks   []betterLink    `json:"-"`
+	}
+
+	// crowdRating is what visitors think of an attribute of a city, next to what we think.
+	crowdRating struct {
+		Attribute string
+		Curated   string
+		Mean      string
+		Count     int
+		Bars      []ratingBar
+		Mine      int // the visitor's own rating, 0 if they haven't rated it
+	}
+	// ratingBar is how many visitors gave a rating.
+	ratingBar struct {
+		Rating      int
+		Description string
+		Count       int
+	}
+
+	// attribute is something about a city, e.g. its population.
+	attribute struct {
+		Label string `json:"label"`
+		Value string `json:"value"`
+	}
+
+	// criterionRank is where a city is when ranked by a criterion, 1 being the best.
+	criterionRank struct {
+		Name  string `json:"criteria"`
+		Label string `json:"label"`
+		Value string `json:"value"`
+		Rank  int    `json:"rank"`
+	}
+
+	// contribution is how much a criterion adds to the score of a city.
+	contribution struct {
+		Label        string `json:"label"`
+		Weight       string `json:"weight"`       // share of all the weights, e.g. "67%"
+		Score        string `json:"score"`        // normalized score for the criterion
+		Contribution string `json:"contribution"` // weight times score
+	}
+)
+
+// Name returns the name of the city, for templates.
+func (c city) Name() string {
+	return c.name
+}
+
+// URL returns the path of the page for the city.
+func (c city) URL() string {
+	return "/city/" + url.PathEscape(c.name)
+}
+
+// rankOf returns the rank of c among the cities by the criterion, 1 being the best.
+//
+// Cities that are equally good share a rank.
+func (cs cities) rankOf(c city, cr *criterion) int {
+	rank := 1
+	for _, other := range cs {
+		if cr.better(other, c) {
+			rank++
+		}
+	}
+	return rank
+}
+
+// costAttributes returns the cost breakdown of the city in the language, or nil if we don't have one.
+func costAttributes(c city, lang string) []attribute {
+	if !c.costs.known() {
+		return nil
+	}
+	money := func(v float64) string { return fmt.Sprintf("%.0f %s", v, c.costs.currency) }
+	attrs := []attribute{
+		{"Rent, one bedroom", money(c.costs.rent1BR)},
+		{"Rent, three bedrooms", money(c.costs.rent3BR)},
+		{"Groceries", money(c.costs.groceries)},
+		{"Transport", money(c.costs.transport)},
+		{"Eating out", money(c.costs.eatingOut)},
+		{"Utilities", money(c.costs.utilities)},
+		{"Total for one person", money(c.costs.total())},
+	}
+	if ref, ok := allCities().find(CostReference); ok {
+		if index, err := costIndex(c, ref); err == nil {
+			attrs = append(attrs, attribute{fmt.Sprintf(tr(lang, "Cost index (%s is 100)"), ref.name), fmt.Sprintf("%.0f", index)})
+		}
+	}
+	return attrs
+}
+
+// newCityPage returns the data for the page of the city among all cities,
+// with its score for the rank config, described in the language.
+func newCityPage(c city, all cities, rc rankConfig, q url.Values, visitor, lang string) cityPage {
+	p := cityPage{
+		Title: c.name,
+		City:  c,
+		Attributes: []attribute{
+			{"Country", c.country},
+			{"Region", c.region},
+			{"Location", fmt.Sprintf("%.4f, %.4f", c.lat, c.lon)},
+			{"Population", formatPopulationIn(lang, c.population)},
+			{"Cost", tr(lang, c.cost.String())},
+			{"Climate", tr(lang, c.climate.String())},
+		},
+		Costs:     costAttributes(c, lang),
+		Summary:   rc.describe(lang),
+		Of:        len(all),
+		RankQuery: template.URL(q.Encode()),
+	}
+	for _, cr := range criteriaRegistry {
+		p.Ranks = append(p.Ranks, criterionRank{
+			Name:  cr.name,
+			Label: cr.label,
+			Value: cr.describe(c, lang),
+			Rank:  all.rankOf(c, cr),
+		})
+	}
+	scored := rc.score(all)
+	total := rc.totalWeight()
+	for i, sc := range scored {
+		if sc.name != c.name {
+			continue
+		}
+		// The scores are sorted worst to best.
+		p.ScoreRank = len(scored) - i
+		p.Score = fmt.Sprintf("%.2f", sc.score)
+		for j, wc := range rc.criteria {
+			p.Contributions = append(p.Contributions, contribution{
+				Label:        wc.label,
+				Weight:       fmt.Sprintf("%.0f%%", 100*wc.weight/total),
+				Score:        fmt.Sprintf("%.2f", sc.scores[j]),
+				Contribution: fmt.Sprintf("%.2f", wc.weight/total*sc.scores[j]),
+			})
+		}
+	}
+	for _, attr := range []string{"cost", "climate"} {
+		p.Ratings = append(p.Ratings, newCrowdRating(c, attr, visitor, lang))
+	}
+	p.Similar = all.similarTo(c, nil, lang)
+	if len(p.Similar) > 3 {
+		p.Similar = p.Similar[:3]
+	}
+	p.BetterLinks = betterLinks()
+	return p
+}
+
+// newCrowdRating returns what visitors think of an attribute of the city, described in the language.
+func newCrowdRating(c city, attr, visitor, lang string) crowdRating {
+	desc := func(rating int) string { return tr(lang, ratedAttributes[attr](rating)) }
+	curated := int(c.cost)
+	if attr == "climate" {
+		curated = int(c.climate)
+	}
+	sum := Ratings.summary(c.id, attr)
+	cr := crowdRating{
+		Attribute: attr,
+		Curated:   desc(curated),
+		Count:     sum.Count,
+		Mine:      Ratings.mine(c.id, attr, visitor),
+	}
+	if sum.Count > 0 {
+		cr.Mean = fmt.Sprintf("%.1f (%s)", sum.Mean, desc(int(sum.Mean+0.5)))
+	}
+	for i, n := range sum.Distribution {
+		cr.Bars = append(cr.Bars, ratingBar{Rating: i + 1, Description: desc(i + 1), Count: n})
+	}
+	return cr
+}
+
+// cityHandler shows everything about a city, e.g. /city/Barcelona, or its
+// history, e.g. /city/Barcelona/history.
+//
+// The weights for the score are given like on the rank page.
+func cityHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	if name, ok := splitHistoryPath(r.URL.Path); ok {
+		historyHandler(w, r, name)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/city/")
+	all := allCities()
+	c, ok := all.find(name)
+	if !ok {
+		log.Printf("Sirree, there is no city %q!\n", name)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	q.Del("lang")
+	if len(q) == 0 {
+		q = defaultRankQuery()
+	}
+	rc, err := parseRankConfig(q)
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	lang := visitorLang(w, r)
+	render(w, lang, "html/city.html.tmpl", newCityPage(c, all, rc, q, visitorID(w, r), lang))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCities_rankOf(t *testing.T) {
+	cost, _ := lookupCriterion("cost")
+	climate, _ := lookupCriterion("climate")
+	type testCase struct {
+		name string
+		cr   *criterion
+		want int
+	}
+	cases := []testCase{
+		{name: "Paradisio", cr: cost, want: 1},
+		{name: "Deviltown", cr: cost, want: 7},
+		{name: "Seattle", cr: cost, want: 3},
+		{name: "Paradisio", cr: climate, want: 1},
+		{name: "Stockholm", cr: climate, want: 5},
+	}
+	for _, tc := range cases {
+		c, _ := allCities().find(tc.name)
+		if got := allCities().rankOf(c, tc.cr); got != tc.want {
+			t.Errorf("rankOf(%v) by %v = %v, want %v", tc.name, tc.cr.name, got, tc.want)
+		}
+	}
+}
+
+func TestCityHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{url: "/city/Barcelona", wantCode: http.StatusOK, wantText: "number 2 of 7"},
+		{url: "/city/New%20York", wantCode: http.StatusOK, wantText: "8.4M"},
+		{url: "/city/Barcelona?population=1", wantCode: http.StatusOK, wantText: "population (100%)"},
+		{url: "/city/Atlantis", wantCode: http.StatusNotFound},
+		{url: "/city/Barcelona?climate=lots", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		cityHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("GET %v: expected %q in:\n%v", tc.url, tc.wantText, rec.Body.String())
+		}
+	}
+}
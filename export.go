@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type (
+	// rankedCity is a city with its place in a ranking.
+	//
+	// The rank and score are zero when the cities are not ranked.
+	rankedCity struct {
+		city
+		rank  int
+		score float64
+	}
+
+	// geoJSON is a GeoJSON FeatureCollection.
+	geoJSON struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}
+	geoJSONFeature struct {
+		Type       string            `json:"type"`
+		Geometry   geoJSONPoint      `json:"geometry"`
+		Properties geoJSONProperties `json:"properties"`
+	}
+	geoJSONPoint struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+	}
+	geoJSONProperties struct {
+		Name       string   `json:"name"`
+		Country    string   `json:"country,omitempty"`
+		Region     string   `json:"region,omitempty"`
+		Population int      `json:"population"`
+		Cost       string   `json:"cost"`
+		Climate    string   `json:"climate"`
+		Criteria   string   `json:"criteria,omitempty"`
+		Rank       int      `json:"rank,omitempty"`
+		Score      *float64 `json:"score,omitempty"`
+	}
+
+	// kml is a KML document with a placemark per city.
+	kml struct {
+		XMLName  xml.Name `xml:"http://www.opengis.net/kml/2.2 kml"`
+		Document kmlDocument
+	}
+	kmlDocument struct {
+		Name       string         `xml:"name"`
+		Placemarks []kmlPlacemark `xml:"Placemark"`
+	}
+	kmlPlacemark struct {
+		Name        string    `xml:"name"`
+		Description string    `xml:"description"`
+		Data        []kmlData `xml:"ExtendedData>Data"`
+		Coordinates string    `xml:"Point>coordinates"`
+	}
+	kmlData struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value"`
+	}
+)
+
+// exportView returns the cities asked for in the query.
+//
+// If the "by" parameter is given, the cities are ranked by that criteria
+// like on the /by-* pages, and the other parameters of those pages apply.
+// Rank 1 is then the best city of the view, whichever way the criteria
+// goes, as on the city page.
+func exportView(q url.Values) ([]rankedCity, error) {
+	criteria := q.Get("by")
+	if criteria == "" {
+		cs, err := allCities().view("", q)
+		if err != nil {
+			return nil, err
+		}
+		ranked := make([]rankedCity, len(cs))
+		for i := range cs {
+			ranked[i] = rankedCity{city: cs[i]}
+		}
+		return ranked, nil
+	}
+	c, err := criterionFor(criteria, q)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := allCities().view(criteria, q)
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]rankedCity, len(cs))
+	for i := range cs {
+		ranked[i] = rankedCity{city: cs[i], rank: cs.rankOf(cs[i], c), score: c.value(cs[i])}
+	}
+	return ranked, nil
+}
+
+// toGeoJSON returns the cities as GeoJSON point features.
+func toGeoJSON(ranked []rankedCity, criteria string) geoJSON {
+	g := geoJSON{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, rc := range ranked {
+		p := geoJSONProperties{
+			Name:       rc.name,
+			Country:    rc.country,
+			Region:     rc.region,
+			Population: rc.population,
+			Cost:       rc.cost.String(),
+			Climate:    rc.climate.String(),
+		}
+		if rc.rank > 0 {
+			score := rc.score
+			p.Criteria = criteria
+			p.Rank = rc.rank
+			p.Score = &score
+		}
+		g.Features = append(g.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{rc.lon, rc.lat}},
+			Properties: p,
+		})
+	}
+	return g
+}
+
+// toKML returns the cities as a KML document.
+func toKML(ranked []rankedCity, criteria string) kml {
+	doc := kmlDocument{Name: "Cities"}
+	if criteria != "" {
+		doc.Name = fmt.Sprintf("Cities by %s", criteria)
+	}
+	for _, rc := range ranked {
+		pm := kmlPlacemark{
+			Name:        rc.name,
+			Description: rc.city.String(),
+			Data: []kmlData{
+				{Name: "population", Value: strconv.Itoa(rc.population)},
+				{Name: "cost", Value: rc.cost.String()},
+				{Name: "climate", Value: rc.climate.String()},
+			},
+			Coordinates: fmt.Sprintf("%v,%v", rc.lon, rc.lat),
+		}
+		if rc.rank > 0 {
+			pm.Data = append(pm.Data,
+				kmlData{Name: "rank", Value: strconv.Itoa(rc.rank)},
+				kmlData{Name: "score", Value: strconv.FormatFloat(rc.score, 'g', -1, 64)},
+			)
+		}
+		doc.Placemarks = append(doc.Placemarks, pm)
+	}
+	return kml{Document: doc}
+}
+
+// geoJSONHandler responds with the cities as GeoJSON.
+func geoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	ranked, err := exportView(shortlistQuery(r, r.URL.Query()))
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	if err := json.NewEncoder(w).Encode(toGeoJSON(ranked, r.URL.Query().Get("by"))); err != nil {
+		log.Printf("Oibai, I couldn't write the GeoJSON: %v\n", err)
+	}
+}
+
+// kmlHandler responds with the cities as KML.
+func kmlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	ranked, err := exportView(shortlistQuery(r, r.URL.Query()))
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(toKML(ranked, r.URL.Query().Get("by"))); err != nil {
+		log.Printf("Oibai, I couldn't write the KML: %v\n", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGeoJSONHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/cities.geojson?by=climate&near=Stockholm&within_km=1500", nil)
+	rec := httptest.NewRecorder()
+	geoJSONHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Dude, expected status 200, got %v", rec.Code)
+	}
+	got := geoJSON{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Oibai, the GeoJSON doesn't parse: %v", err)
+	}
+	if len(got.Features) != 2 {
+		t.Fatalf("Expected 2 features near Stockholm, got %v", len(got.Features))
+	}
+	p := got.Features[0].Properties
+	if p.Name != "Copenhagen" || p.Rank != 1 || p.Score == nil || *p.Score != float64(PoorClimate) {
+		t.Errorf("Unexpected first feature: %+v", p)
+	}
+	if c := got.Features[0].Geometry.Coordinates; c[0] != 12.5683 || c[1] != 55.6761 {
+		t.Errorf("Expected longitude before latitude, got %v", c)
+	}
+}
+
+func TestExportView_bestIsFirst(t *testing.T) {
+	ranked, err := exportView(url.Values{"by": {"population"}})
+	if err != nil {
+		t.Fatalf("Oibai, exportView failed: %v", err)
+	}
+	best := ranked[len(ranked)-1]
+	if best.name != "Deviltown" || best.rank != 1 {
+		t.Errorf("Expected the biggest city Deviltown to be number 1, got %v number %v", best.name, best.rank)
+	}
+	if worst := ranked[0]; worst.rank != len(ranked) {
+		t.Errorf("Expected the smallest city %v to be number %v, got %v", worst.name, len(ranked), worst.rank)
+	}
+}
+
+func TestKMLHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+	}
+	cases := []testCase{
+		{url: "/cities.kml", wantCode: http.StatusOK},
+		{url: "/cities.kml?by=distance&to=Barcelona", wantCode: http.StatusOK},
+		{url: "/cities.kml?by=happiness", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		rec := httptest.NewRecorder()
+		kmlHandler(rec, req)
+
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		got := kml{}
+		if err := xml.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("GET %v: the KML doesn't parse: %v", tc.url, err)
+			continue
+		}
+		if len(got.Document.Placemarks) != len(allCities()) {
+			t.Errorf("GET %v: expected %v placemarks, got %v", tc.url, len(allCities()), len(got.Document.Placemarks))
+		}
+	}
+	rec := httptest.NewRecorder()
+	kmlHandler(rec, httptest.NewRequest(http.MethodGet, "/cities.kml?by=distance&to=Barcelona", nil))
+	if !strings.Contains(rec.Body.String(), "<name>Barcelona</name>") {
+		t.Errorf("Expected Barcelona in the KML:\n%v", rec.Body.String())
+	}
+}
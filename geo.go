@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusKm is the mean radius of the earth.
+const earthRadiusKm = 6371.0
+
+// distanceKm returns the great-circle distance between two cities.
+//
+// It uses the haversine formula, which is good enough for choosing where to live.
+func distanceKm(c1, c2 city) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(c2.lat - c1.lat)
+	dLon := rad(c2.lon - c1.lon)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(c1.lat))*math.Cos(rad(c2.lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// meanDistanceKm returns the average distance from c to the anchor cities.
+func meanDistanceKm(c city, anchors cities) float64 {
+	if len(anchors) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, a := range anchors {
+		total += distanceKm(c, a)
+	}
+	return total / float64(len(anchors))
+}
+
+// lookup returns the cities with the given comma separated names.
+//
+// The error is not nil when one of the names is not a city we know.
+func (cs cities) lookup(names string) (cities, error) {
+	found := cities{}
+	for _, n := range strings.Split(names, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		c, ok := cs.find(n)
+		if !ok {
+			return nil, fmt.Errorf("no city called %q", n)
+		}
+		found = append(found, c)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no cities given")
+	}
+	return found, nil
+}
+
+// within returns the cities that are at most km away from the anchor city.
+func (cs cities) within(anchor city, km float64) cities {
+	near := cities{}
+	for _, c := range cs {
+		if distanceKm(c, anchor) <= km {
+			near = append(near, c)
+		}
+	}
+	return near
+}
+
+// filterNear applies the "near" and "within_km" query parameters, e.g.
+// ?near=Stockholm&within_km=1500.
+//
+// The cities are returned as they are if there is no "near" parameter.
+func (cs cities) filterNear(q url.Values) (cities, error) {
+	near := q.Get("near")
+	if near == "" {
+		return cs, nil
+	}
+	anchor, ok := cs.find(near)
+	if !ok {
+		return nil, fmt.Errorf("no city called %q", near)
+	}
+	km, err := strconv.ParseFloat(q.Get("within_km"), 64)
+	if err != nil || km < 0 {
+		return nil, fmt.Errorf("bad within_km %q", q.Get("within_km"))
+	}
+	return cs.within(anchor, km), nil
+}
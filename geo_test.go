@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDistanceKm(t *testing.T) {
+	type testCase struct {
+		from, to string
+		want     float64
+	}
+	cases := []testCase{
+		{from: "Barcelona", to: "Barcelona", want: 0},
+		{from: "Copenhagen", to: "Stockholm", want: 522},
+		{from: "Barcelona", to: "New York", want: 6166},
+	}
+	for _, tc := range cases {
+		from, _ := allCities().find(tc.from)
+		to, _ := allCities().find(tc.to)
+		got := distanceKm(from, to)
+		if math.Abs(got-tc.want) > 10 {
+			t.Errorf("distanceKm(%v, %v) = %.0f, want about %.0f", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestCities_view(t *testing.T) {
+	type testCase struct {
+		criteria string
+		query    string
+		want     string
+		wantErr  bool
+	}
+	cases := []testCase{
+		{criteria: "name", query: "near=Stockholm&within_km=1500", want: "Copenhagen, Stockholm"},
+		{criteria: "distance", query: "to=Copenhagen", want: "Copenhagen, Stockholm, Barcelona, Paradisio, New York, Seattle, Deviltown"},
+		{criteria: "name", query: "near=Atlantis&within_km=1500", wantErr: true},
+		{criteria: "name", query: "near=Stockholm&within_km=far", wantErr: true},
+		{criteria: "distance", query: "to=", wantErr: true},
+	}
+	for _, tc := range cases {
+		q, _ := url.ParseQuery(tc.query)
+		got, err := allCities().view(tc.criteria, q)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("view(%q, %q) should fail", tc.criteria, tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("view(%q, %q) failed: %v", tc.criteria, tc.query, err)
+			continue
+		}
+		if got.getNames() != tc.want {
+			t.Errorf("view(%q, %q) = %v, want %v", tc.criteria, tc.query, got.getNames(), tc.want)
+		}
+	}
+}
+
+func TestCitiesHandler_badQuery(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/by-distance?to=Atlantis", nil)
+	rec := httptest.NewRecorder()
+	citiesHandler{"distance"}.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Dude, expected status 400, got %v", rec.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geoNamesFilter is which cities of a GeoNames dump to import.
+type geoNamesFilter struct {
+	minPopulation int
+	countries     []string // ISO 3166 country codes, e.g. "ES", or empty for all
+}
+
+// The columns of a GeoNames cities file, see https://download.geonames.org/export/dump/readme.txt.
+const (
+	geoNamesName         = 1
+	geoNamesLat          = 4
+	geoNamesLon          = 5
+	geoNamesFeatureClass = 6
+	geoNamesCountry      = 8
+	geoNamesAdmin1       = 10
+	geoNamesPopulation   = 14
+	geoNamesColumns      = 19
+)
+
+// scanGeoNames calls f with the columns of each line of a tab separated
+// GeoNames file, skipping comments and empty lines.
+//
+// The error is not nil if the file can't be read or f returns an error.
+func scanGeoNames(r io.Reader, f func(line int, cols []string) error) error {
+	s := bufio.NewScanner(r)
+	// The alternate names of big cities make for long lines.
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		if s.Text() == "" || strings.HasPrefix(s.Text(), "#") {
+			continue
+		}
+		if err := f(line, strings.Split(s.Text(), "\t")); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// readGeoNamesNames returns the names in a GeoNames file like countryInfo.txt
+// or admin1CodesASCII.txt, by the code in the first column.
+//
+// The name is in the column given, e.g. 4 for the countries and 1 for the regions.
+func readGeoNamesNames(r io.Reader, column int) (map[string]string, error) {
+	names := map[string]string{}
+	err := scanGeoNames(r, func(line int, cols []string) error {
+		if len(cols) <= column {
+			return fmt.Errorf("line %v has %v columns, want more than %v", line, len(cols), column)
+		}
+		names[cols[0]] = cols[column]
+		return nil
+	})
+	return names, err
+}
+
+// readGeoNames returns the cities in a GeoNames cities file, e.g.
+// cities15000.txt, that pass the filter, the most populous first.
+//
+// The country and region names are looked up by their codes, e.g. "ES" and
+// "ES.56", and left as codes or empty if they aren't there. The cost and
+// climate are left unset, for an admin to fill in.
+//
+// We know cities by their names, so if there are several cities with the same
+// name only the most populous is kept, and the others are returned as dropped,
+// e.g. Valencia in Spain for the bigger one in Venezuela.
+func readGeoNames(r io.Reader, filter geoNamesFilter, countries, regions map[string]string) (kept, dropped cities, err error) {
+	byName := map[string]city{}
+	err = scanGeoNames(r, func(line int, cols []string) error {
+		if len(cols) != geoNamesColumns {
+			return fmt.Errorf("line %v has %v columns, want %v", line, len(cols), geoNamesColumns)
+		}
+		if cols[geoNamesFeatureClass] != "P" {
+			return nil
+		}
+		code := cols[geoNamesCountry]
+		if len(filter.countries) > 0 && !contains(filter.countries, code) {
+			return nil
+		}
+		population, err := strconv.Atoi(cols[geoNamesPopulation])
+		if err != nil {
+			return fmt.Errorf("line %v has a bad population %q", line, cols[geoNamesPopulation])
+		}
+		if population < filter.minPopulation {
+			return nil
+		}
+		c := city{
+			name:       strings.TrimSpace(cols[geoNamesName]),
+			population: population,
+			country:    code,
+			region:     regions[code+"."+cols[geoNamesAdmin1]],
+		}
+		if name, ok := countries[code]; ok {
+			c.country = name
+		}
+		if c.lat, err = strconv.ParseFloat(cols[geoNamesLat], 64); err != nil {
+			return fmt.Errorf("line %v has a bad latitude %q", line, cols[geoNamesLat])
+		}
+		if c.lon, err = strconv.ParseFloat(cols[geoNamesLon], 64); err != nil {
+			return fmt.Errorf("line %v has a bad longitude %q", line, cols[geoNamesLon])
+		}
+		other, ok := byName[c.name]
+		switch {
+		case !ok:
+			byName[c.name] = c
+		case other.population < c.population:
+			byName[c.name] = c
+			dropped = append(dropped, other)
+		default:
+			dropped = append(dropped, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range byName {
+		kept = append(kept, c)
+	}
+	kept.sortByPopulation()
+	dropped.sortByPopulation()
+	return kept, dropped, nil
+}
+
+// sortByPopulation sorts the cities, the most populous first.
+func (cs cities) sortByPopulation() {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].population != cs[j].population {
+			return cs[i].population > cs[j].population
+		}
+		return cs[i].name < cs[j].name
+	})
+}
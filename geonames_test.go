@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// geoNamesLine returns a line of a GeoNames cities file.
+func geoNamesLine(name, lat, lon, class, country, admin1, population string) string {
+	cols := []string{"1", name, name, "", lat, lon, class, "PPLA", country, "", admin1, "", "", "", population, "", "10", "Europe/Somewhere", "2024-01-01"}
+	return strings.Join(cols, "\t")
+}
+
+var geoNamesSample = strings.Join([]string{
+	"# a comment",
+	geoNamesLine("Barcelona", "41.38879", "2.15899", "P", "ES", "56", "1620343"),
+	geoNamesLine("Valencia", "39.47391", "-0.37966", "P", "ES", "60", "814208"),
+	geoNamesLine("Valencia", "10.16202", "-68.00765", "P", "VE", "07", "1385083"),
+	geoNamesLine("Aarhus", "56.15674", "10.21076", "P", "DK", "18", "285273"),
+	geoNamesLine("Tiny", "56.0", "10.0", "P", "DK", "18", "5000"),
+	geoNamesLine("Big Hill", "56.0", "10.0", "T", "DK", "18", "500000"),
+	"",
+}, "\n")
+
+func TestReadGeoNames(t *testing.T) {
+	countries := map[string]string{"ES": "Spain", "DK": "Denmark"}
+	regions := map[string]string{"ES.56": "Catalonia", "DK.18": "Central Jutland"}
+	type testCase struct {
+		filter geoNamesFilter
+		want   string
+	}
+	cases := []testCase{
+		{filter: geoNamesFilter{minPopulation: 100000}, want: "Barcelona, Valencia, Aarhus"},
+		{filter: geoNamesFilter{minPopulation: 1}, want: "Barcelona, Valencia, Aarhus, Tiny"},
+		{filter: geoNamesFilter{minPopulation: 100000, countries: []string{"ES"}}, want: "Barcelona, Valencia"},
+		{filter: geoNamesFilter{minPopulation: 1000000}, want: "Barcelona, Valencia"},
+	}
+	for _, tc := range cases {
+		cs, _, err := readGeoNames(strings.NewReader(geoNamesSample), tc.filter, countries, regions)
+		if err != nil {
+			t.Fatalf("Oibai, readGeoNames() failed: %v", err)
+		}
+		if cs.getNames() != tc.want {
+			t.Errorf("readGeoNames(%+v) = %v, want %v", tc.filter, cs.getNames(), tc.want)
+		}
+	}
+
+	cs, dropped, _ := readGeoNames(strings.NewReader(geoNamesSample), geoNamesFilter{}, countries, regions)
+	b, _ := cs.find("Barcelona")
+	want := city{name: "Barcelona", population: 1620343, country: "Spain", region: "Catalonia", lat: 41.38879, lon: 2.15899}
+	if !b.Equal(want) {
+		t.Errorf("Expected %+v, got %+v", want, b)
+	}
+	v, _ := cs.find("Valencia")
+	if v.country != "VE" || v.region != "" {
+		t.Errorf("Expected the bigger Valencia with the country code and no region, got %+v", v)
+	}
+	if len(dropped) != 1 || dropped[0].name != "Valencia" || dropped[0].country != "Spain" {
+		t.Errorf("Expected the smaller Valencia in Spain to be dropped, got %+v", dropped)
+	}
+
+	if _, _, err := readGeoNames(strings.NewReader("1\tBroken\t2\n"), geoNamesFilter{}, nil, nil); err == nil {
+		t.Errorf("readGeoNames() of a line with 3 columns should fail")
+	}
+}
+
+func TestReadGeoNamesNames(t *testing.T) {
+	names, err := readGeoNamesNames(strings.NewReader("#ISO\tISO3\tISO-Numeric\tfips\tCountry\nES\tESP\t724\tSP\tSpain\n"), 4)
+	if err != nil {
+		t.Fatalf("Oibai, readGeoNamesNames() failed: %v", err)
+	}
+	if len(names) != 1 || names["ES"] != "Spain" {
+		t.Errorf("Unexpected names: %v", names)
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	defer func(m *moderationStore, dir string) { Moderation, DataDir = m, dir }(Moderation, DataDir)
+	Moderation = &moderationStore{}
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	DataDir = dir
+	file := filepath.Join(dir, "cities15000.txt")
+	if err := ioutil.WriteFile(file, []byte(geoNamesSample), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if code := runCommand([]string{"import", "--dry-run", file}, out, out); code != 0 || !strings.Contains(out.String(), "3 cities would be queued") {
+		t.Errorf("Unexpected dry run, exit code %v:\n%v", code, out)
+	}
+	if !strings.Contains(out.String(), "1 would be skipped:\n  Valencia in ES: we only take the bigger Valencia in VE") {
+		t.Errorf("Expected the dry run to tell about the smaller Valencia:\n%v", out)
+	}
+	if pending, _ := Moderation.list(); len(pending) != 0 {
+		t.Errorf("A dry run shouldn't queue anything, got %v", len(pending))
+	}
+
+	lock, err := lockData(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if code := runCommand([]string{"import", file}, out, out); code != 1 || !strings.Contains(out.String(), "is the server running?") {
+		t.Errorf("Expected the import to refuse to run next to the server, exit code %v:\n%v", code, out)
+	}
+	lock.Close()
+
+	out.Reset()
+	if code := runCommand([]string{"import", file}, out, out); code != 0 {
+		t.Fatalf("Oibai, import failed:\n%v", out)
+	}
+	if !strings.Contains(out.String(), "Queued 2 cities") || !strings.Contains(out.String(), "we already have Barcelona") {
+		t.Errorf("Expected Barcelona to be skipped since we have it:\n%v", out)
+	}
+	if !strings.Contains(out.String(), "Skipped 2:\n  Valencia in ES") {
+		t.Errorf("Expected the smaller Valencia to be skipped too:\n%v", out)
+	}
+	pending, _ := Moderation.list()
+	if len(pending) != 2 || pending[0].Submitter != "geonames" || pending[0].City.Cost != 0 {
+		t.Errorf("Expected 2 cities waiting for an admin to set the cost, got %+v", pending)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// historyEntry is a change to a city, it is never changed once recorded.
+	historyEntry struct {
+		ID     string      `json:"id"`
+		Action string      `json:"action"` // create, update or delete
+		Who    string      `json:"who"`
+		When   time.Time   `json:"when"`
+		Before *cityRecord `json:"before,omitempty"` // nil when created
+		After  *cityRecord `json:"after,omitempty"`  // nil when deleted
+	}
+
+	// historyStore keeps the history of all cities, and saves the cities
+	// whenever they change.
+	historyStore struct {
+		mu         sync.Mutex
+		file       string // where the history is saved, or "" to not save it
+		citiesFile string // where the cities are saved, or "" to not save them
+		entries    []historyEntry
+		legacy     map[string]string // of the cities of the entries without ids, by entry id
+		unsaved    bool              // true if adopt gave cities ids that aren't saved yet
+	}
+
+	// historyPage is the data for the history page of a city.
+	historyPage struct {
+		Title   string
+		Deleted bool
+		Entries []historyRow
+	}
+	historyRow struct {
+		historyEntry
+		BeforeDesc string
+		AfterDesc  string
+		Revertible bool
+	}
+)
+
+const (
+	createAction = "create"
+	updateAction = "update"
+	deleteAction = "delete"
+)
+
+// History has the changes to all cities, they are only saved once main sets up the store.
+var History = &historyStore{}
+
+// newHistoryStore returns a history store that saves the history and cities in the files.
+//
+// The error is not nil when the history file exists but can't be read.
+func newHistoryStore(file, citiesFile string) (*historyStore, error) {
+	s := &historyStore{file: file, citiesFile: citiesFile}
+	if err := loadJSON(file, &s.entries); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the history in %v: %v", file, err)
+	}
+	return s, nil
+}
+
+// loadCities returns the cities saved in the file, or the cities we are
+// given if nobody has changed them yet.
+func loadCities(file string, cs cities) (cities, error) {
+	records := []cityRecord{}
+	if err := loadJSON(file, &records); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the cities in %v: %v", file, err)
+	}
+	if len(records) == 0 {
+		return cs, nil
+	}
+	loaded := make(cities, len(records))
+	for i, r := range records {
+		loaded[i] = r.city()
+	}
+	return loaded, nil
+}
+
+// record adds a change to the history and saves it with the updated
+// cities, which everyone sees only once both are saved, so that a failed
+// save changes nothing. The caller must hold the lock.
+func (s *historyStore) record(action, who string, before, after *city, updated cities) error {
+	e := historyEntry{ID: randomID(8), Action: action, Who: who, When: time.Now()}
+	if before != nil {
+		r := before.record()
+		e.Before = &r
+	}
+	if after != nil {
+		r := after.record()
+		e.After = &r
+	}
+	entries := append(s.entries[:len(s.entries):len(s.entries)], e)
+	if s.file != "" {
+		if err := saveJSON(s.file, entries); err != nil {
+			return err
+		}
+		if err := s.saveCities(updated); err != nil {
+			// Put the history back the way it was, the change didn't happen.
+			saveJSON(s.file, s.entries)
+			return err
+		}
+	}
+	s.entries = entries
+	setCities(updated)
+	log.Printf("Hear ye, %v did %v %v\n", who, action, e.name())
+	return nil
+}
+
+// saveCities writes the cities to their file.
+func (s *historyStore) saveCities(cs cities) error {
+	if s.citiesFile == "" {
+		return nil
+	}
+	records := make([]cityRecord, len(cs))
+	for i := range cs {
+		records[i] = cs[i].record()
+	}
+	return saveJSON(s.citiesFile, records)
+}
+
+// adopt works out the ids of the cities the changes recorded before cities
+// had ids are about, following renames, and gives them to the cities that
+// have none yet. Cities that still have no id get a new one. Nothing is
+// saved, so that commands that only read don't write, see saveIDs.
+//
+// The entries themselves are never changed: a change without an id belongs
+// to the city that later changes had under its name, to the city of that
+// name if nobody changed it since, or else, if it was deleted, to an id
+// made from the first change to it, which stays the same after a restart.
+func (s *historyStore) adopt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := map[string]string{} // of the entries without an id, the first entry of their city
+	open := map[string]string{}  // by the name the city has after the changes so far, its first entry
+	ids := map[string]string{}   // of the cities by their first entry
+	for _, e := range s.entries {
+		if id := e.cityID(); id != "" {
+			if e.Before != nil && open[e.Before.Name] != "" {
+				ids[open[e.Before.Name]] = id
+				delete(open, e.Before.Name)
+			}
+			continue
+		}
+		f := e.ID
+		if e.Before != nil && open[e.Before.Name] != "" {
+			f = open[e.Before.Name]
+			delete(open, e.Before.Name)
+		}
+		first[e.ID] = f
+		if e.After != nil {
+			open[e.After.Name] = f
+		}
+	}
+	adopted := append(cities{}, allCities()...)
+	given := false
+	for i := range adopted {
+		f := open[adopted[i].name]
+		if adopted[i].id != "" {
+			if f != "" {
+				ids[f] = adopted[i].id
+			}
+			continue
+		}
+		if adopted[i].id = ids[f]; adopted[i].id == "" {
+			adopted[i].id = f
+		}
+		if adopted[i].id == "" {
+			adopted[i].id = randomID(8)
+		}
+		if f != "" {
+			ids[f] = adopted[i].id
+		}
+		given = true
+	}
+	s.legacy = map[string]string{}
+	for entry, f := range first {
+		if s.legacy[entry] = ids[f]; s.legacy[entry] == "" {
+			s.legacy[entry] = f
+		}
+	}
+	s.unsaved = given
+	setCities(adopted)
+}
+
+// saveIDs saves the cities if adopt gave them ids, so that they keep them
+// after a restart. Only the server does it, once it has the data to itself.
+func (s *historyStore) saveIDs() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.unsaved {
+		return nil
+	}
+	if err := s.saveCities(allCities()); err != nil {
+		return err
+	}
+	s.unsaved = false
+	return nil
+}
+
+// name returns the name of the city the entry is about.
+func (e historyEntry) name() string {
+	if e.After != nil {
+		return e.After.Name
+	}
+	return e.Before.Name
+}
+
+// cityID returns the id of the city the entry is about, or "" if it was
+// recorded before cities had ids.
+func (e historyEntry) cityID() string {
+	if e.After != nil {
+		return e.After.ID
+	}
+	return e.Before.ID
+}
+
+// cityIDOf returns the id of the city the entry is about, the one adopt
+// worked out if it was recorded before cities had ids. The caller must hold
+// the lock.
+func (s *historyStore) cityIDOf(e historyEntry) string {
+	if id := e.cityID(); id != "" {
+		return id
+	}
+	return s.legacy[e.ID]
+}
+
+// of returns the history of the city with the id, most recent first.
+func (s *historyStore) of(id string) []historyEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []historyEntry{}
+	for i := len(s.entries) - 1; i >= 0 && id != ""; i-- {
+		if s.cityIDOf(s.entries[i]) == id {
+			entries = append(entries, s.entries[i])
+		}
+	}
+	return entries
+}
+
+// idOf returns the id of the city that last had the name, e.g. before it
+// was renamed or deleted, and false if no city ever had it.
+func (s *historyStore) idOf(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if (e.Before != nil && e.Before.Name == name) || (e.After != nil && e.After.Name == name) {
+			return s.cityIDOf(e), true
+		}
+	}
+	return "", false
+}
+
+// addCity adds a city for everyone to see, and sends the alerts it matches.
+//
+// The error is not nil if the city isn't valid or there already is a city
+// with the same name.
+func addCity(c city, who string) (err error) {
+	c, err = validateCity(c)
+	if err != nil {
+		return err
+	}
+	// The alerts go out once the city is in and the lock is released.
+	defer func() {
+		if err == nil {
+			Alerts.check(c)
+		}
+	}()
+	History.mu.Lock()
+	defer History.mu.Unlock()
+	c, err = putCity(-1, c, who)
+	return err
+}
+
+// updateCity replaces the city with the name, and sends the alerts it matches.
+func updateCity(name string, c city, who string) (err error) {
+	c, err = validateCity(c)
+	if err != nil {
+		return err
+	}
+	// The alerts go out once the city is in and the lock is released.
+	defer func() {
+		if err == nil {
+			Alerts.check(c)
+		}
+	}()
+	History.mu.Lock()
+	defer History.mu.Unlock()
+	i := allCities().index(name)
+	if i < 0 {
+		return fmt.Errorf("no city called %q", name)
+	}
+	c, err = putCity(i, c, who)
+	return err
+}
+
+// putCity replaces the city at the index with c, keeping its id, or adds c
+// as a new city if the index is -1, and records the change. It returns the
+// city as it was put. The caller must hold History's lock.
+func putCity(i int, c city, who string) (city, error) {
+	cs := allCities()
+	if j := cs.indexFold(c.name); j >= 0 && j != i {
+		return c, fmt.Errorf("we already have %v", cs[j].name)
+	}
+	updated := append(cities{}, cs...)
+	if i < 0 {
+		if c.id == "" {
+			c.id = randomID(8)
+		}
+		return c, History.record(createAction, who, nil, &c, append(updated, c))
+	}
+	before := cs[i]
+	if before.id == "" {
+		before.id = randomID(8)
+	}
+	c.id = before.id
+	updated[i] = c
+	return c, History.record(updateAction, who, &before, &c, updated)
+}
+
+// deleteCity removes the city with the name.
+func deleteCity(name, who string) error {
+	History.mu.Lock()
+	defer History.mu.Unlock()
+	cs := allCities()
+	i := cs.index(name)
+	if i < 0 {
+		return fmt.Errorf("no city called %q", name)
+	}
+	before := cs[i]
+	if before.id == "" {
+		before.id = randomID(8)
+	}
+	remaining := append(cities{}, cs[:i]...)
+	return History.record(deleteAction, who, &before, nil, append(remaining, cs[i+1:]...))
+}
+
+// revertCity puts a city back the way it was after the change with the id,
+// whatever it is called now, and sends the alerts it matches.
+//
+// Reverting a deletion restores the city as it was before it was deleted.
+func revertCity(id, who string) (err error) {
+	var c city
+	// The alerts go out once the city is back and the lock is released.
+	defer func() {
+		if err == nil {
+			Alerts.check(c)
+		}
+	}()
+	History.mu.Lock()
+	defer History.mu.Unlock()
+	var entry *historyEntry
+	for i := range History.entries {
+		if History.entries[i].ID == id {
+			entry = &History.entries[i]
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("no change %q", id)
+	}
+	r := entry.After
+	if r == nil {
+		r = entry.Before
+	}
+	if c, err = validateCity(r.city()); err != nil {
+		return err
+	}
+	c.id = History.cityIDOf(*entry)
+	c, err = putCity(allCities().indexID(c.id), c, who)
+	return err
+}
+
+// indexID returns the index of the city with the id, or -1 if there is none.
+func (cs cities) indexID(id string) int {
+	for i := range cs {
+		if id != "" && cs[i].id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// index returns the index of the city with the name, or -1 if there is none.
+func (cs cities) index(name string) int {
+	for i := range cs {
+		if cs[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexFold returns the index of the city with the name, ignoring case, or -1
+// if there is none, so that "barcelona" doesn't become a second Barcelona.
+func (cs cities) indexFold(name string) int {
+	for i := range cs {
+		if strings.EqualFold(cs[i].name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// historyHandler shows the history of a city, e.g. /city/Barcelona/history.
+//
+// The history follows the city through renames, and a deleted city is found
+// by the name it had last.
+func historyHandler(w http.ResponseWriter, r *http.Request, name string) {
+	c, exists := allCities().find(name)
+	id := c.id
+	if !exists {
+		id, _ = History.idOf(name)
+	}
+	entries := History.of(id)
+	if len(entries) == 0 && !exists {
+		log.Printf("Sirree, there is no city %q!\n", name)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	lang := visitorLang(w, r)
+	p := historyPage{Title: name, Deleted: !exists}
+	for _, e := range entries {
+		row := historyRow{historyEntry: e, Revertible: true}
+		if e.Before != nil {
+			row.BeforeDesc = e.Before.city().localString(lang)
+		}
+		if e.After != nil {
+			row.AfterDesc = e.After.city().localString(lang)
+		}
+		p.Entries = append(p.Entries, row)
+	}
+	if len(p.Entries) > 0 && exists {
+		// The most recent change is how the city is now.
+		p.Entries[0].Revertible = false
+	}
+	render(w, lang, "html/history.html.tmpl", p)
+}
+
+// adminCityHandler allows admins to edit, delete and revert a city.
+//
+// GET shows the form for the city in the "name" parameter, POST does the
+// "action": update, delete or revert.
+func adminCityHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method == "GET" {
+		c, ok := allCities().find(r.URL.Query().Get("name"))
+		if !ok {
+			serveErrorPage(w, http.StatusNotFound)
+			return
+		}
+		render(w, languages[0].Tag, "html/admin_city.html.tmpl", struct {
+			Title    string
+			City     cityRecord
+			Costs    []option
+			Climates []option
+		}{c.name, c.record(), costOptions(), climateOptions()})
+		return
+	}
+	if r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	name := r.PostFormValue("name")
+	admin := adminName(r)
+	var err error
+	switch action := r.PostFormValue("action"); action {
+	case "update":
+		var c city
+		c, err = cityFromForm(r)
+		if old, ok := allCities().find(name); ok {
+			// The form doesn't have the cost breakdown.
+			c.costs = old.costs
+		}
+		if err == nil {
+			err = updateCity(name, c, admin)
+			name = c.name
+		}
+	case "delete":
+		err = deleteCity(name, admin)
+	case "revert":
+		err = revertCity(r.PostFormValue("id"), admin)
+	default:
+		err = fmt.Errorf("no action %q", action)
+	}
+	if err != nil {
+		log.Printf("Bozhechki, I can't do that: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Madam or Siree, %v\n", err)
+		return
+	}
+	http.Redirect(w, r, "/city/"+url.PathEscape(name)+"/history", http.StatusFound)
+}
+
+// splitHistoryPath returns the city name in a path like /city/Barcelona/history,
+// and false if it is not a history path.
+func splitHistoryPath(path string) (string, bool) {
+	name := strings.TrimPrefix(path, "/city/")
+	if !strings.HasSuffix(name, "/history") {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "/history"), true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	citiesFile := filepath.Join(dir, "cities.json")
+	History, err = newHistoryStore(filepath.Join(dir, "history.json"), citiesFile)
+	if err != nil {
+		t.Fatalf("Oibai, newHistoryStore() failed: %v", err)
+	}
+
+	oslo := city{name: "Oslo", population: 709037, cost: ExpensiveCost, climate: PoorClimate}
+	if err := addCity(oslo, "aruna"); err != nil {
+		t.Fatalf("Oibai, addCity() failed: %v", err)
+	}
+	if err := addCity(oslo, "aruna"); err == nil {
+		t.Errorf("addCity() of Oslo twice should fail")
+	}
+	warmer := oslo
+	warmer.climate = GreatClimate
+	if err := updateCity("Oslo", warmer, "bob"); err != nil {
+		t.Fatalf("Oibai, updateCity() failed: %v", err)
+	}
+	if err := deleteCity("Oslo", "mallory"); err != nil {
+		t.Fatalf("Oibai, deleteCity() failed: %v", err)
+	}
+	if _, ok := allCities().find("Oslo"); ok {
+		t.Errorf("Oslo should be deleted")
+	}
+
+	id, ok := History.idOf("Oslo")
+	if !ok {
+		t.Fatalf("Expected the deleted Oslo to be found by its name")
+	}
+	entries := History.of(id)
+	if len(entries) != 3 || entries[0].Action != deleteAction || entries[2].Who != "aruna" {
+		t.Fatalf("Unexpected history: %+v", entries)
+	}
+	// Restoring brings back the warmer Oslo, then we revert to how aruna added it.
+	if err := revertCity(entries[0].ID, "aruna"); err != nil {
+		t.Fatalf("Oibai, revertCity() failed to restore: %v", err)
+	}
+	if err := revertCity(entries[2].ID, "aruna"); err != nil {
+		t.Fatalf("Oibai, revertCity() failed: %v", err)
+	}
+	if c, _ := allCities().find("Oslo"); !c.Equal(oslo) {
+		t.Errorf("Expected Oslo to be reverted to %v, got %v", oslo, c)
+	}
+	if len(History.of(id)) != 5 {
+		t.Errorf("Expected the restore and revert in the history, got %+v", History.of(id))
+	}
+
+	// Renaming keeps the history, and reverting across it doesn't make a second Oslo.
+	kristiania := oslo
+	kristiania.name = "Kristiania"
+	if err := updateCity("Oslo", kristiania, "bob"); err != nil {
+		t.Fatalf("Oibai, updateCity() failed to rename: %v", err)
+	}
+	renamed, _ := History.idOf("Kristiania")
+	if entries := History.of(renamed); renamed != id || len(entries) != 6 {
+		t.Errorf("Expected the rename in Oslo's history, got %v: %+v", renamed, entries)
+	}
+	if err := revertCity(entries[2].ID, "aruna"); err != nil {
+		t.Fatalf("Oibai, revertCity() failed across the rename: %v", err)
+	}
+	_, hasOslo := allCities().find("Oslo")
+	_, hasKristiania := allCities().find("Kristiania")
+	if !hasOslo || hasKristiania {
+		t.Errorf("Expected Kristiania to be Oslo again, got %v", allCities().getNames())
+	}
+
+	loaded, err := loadCities(citiesFile, nil)
+	if err != nil {
+		t.Fatalf("Oibai, loadCities() failed: %v", err)
+	}
+	if !loaded.Equal(allCities()) {
+		t.Errorf("Saved cities:\n%v\nWant\n%v\n", loaded, allCities())
+	}
+}
+
+func TestHistory_failedSave(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The history can't be saved under a file.
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	History = &historyStore{file: filepath.Join(blocker, "history.json"), citiesFile: filepath.Join(dir, "cities.json")}
+	before := allCities()
+
+	if err := addCity(city{name: "Oslo"}, "aruna"); err == nil {
+		t.Errorf("addCity() should fail when the history can't be saved")
+	}
+	if err := deleteCity("Barcelona", "aruna"); err == nil {
+		t.Errorf("deleteCity() should fail when the history can't be saved")
+	}
+	if !allCities().Equal(before) || len(History.entries) != 0 {
+		t.Errorf("Expected a failed save to change nothing, got %v and %+v", allCities().getNames(), History.entries)
+	}
+}
+
+func TestHistoryStore_adopt(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A history from before cities had ids: Oslo was added and renamed, Lima added and deleted.
+	historyFile := filepath.Join(dir, "history.json")
+	saveJSON(historyFile, []historyEntry{
+		{ID: "1", Action: createAction, After: &cityRecord{Name: "Oslo"}},
+		{ID: "2", Action: updateAction, Before: &cityRecord{Name: "Oslo"}, After: &cityRecord{Name: "Kristiania"}},
+		{ID: "3", Action: createAction, After: &cityRecord{Name: "Lima"}},
+		{ID: "4", Action: deleteAction, Before: &cityRecord{Name: "Lima"}},
+	})
+	History, err = newHistoryStore(historyFile, filepath.Join(dir, "cities.json"))
+	if err != nil {
+		t.Fatalf("Oibai, newHistoryStore() failed: %v", err)
+	}
+	setCities(cities{{name: "Kristiania"}, {name: "Barcelona"}})
+	History.adopt()
+	if _, err := os.Stat(filepath.Join(dir, "cities.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected adopt() to save nothing, got %v", err)
+	}
+	if err := History.saveIDs(); err != nil {
+		t.Fatalf("Oibai, saveIDs() failed: %v", err)
+	}
+	kristiania, _ := allCities().find("Kristiania")
+	if entries := History.of(kristiania.id); len(entries) != 2 || entries[1].ID != "1" {
+		t.Errorf("Expected Kristiania to keep Oslo's history, got %+v", entries)
+	}
+	barcelona, _ := allCities().find("Barcelona")
+	if barcelona.id == "" || barcelona.id == kristiania.id {
+		t.Errorf("Expected Barcelona to get its own id, got %q", barcelona.id)
+	}
+	lima, _ := History.idOf("Lima")
+	if entries := History.of(lima); len(entries) != 2 || lima == kristiania.id {
+		t.Errorf("Expected Lima's own history, got %+v", entries)
+	}
+
+	// The ids of the cities are saved, the history is left as it was, and
+	// the ids stay the same after a restart.
+	reloaded, err := newHistoryStore(historyFile, filepath.Join(dir, "cities.json"))
+	if err != nil {
+		t.Fatalf("Oibai, newHistoryStore() failed to reload: %v", err)
+	}
+	if id := reloaded.entries[1].cityID(); id != "" {
+		t.Errorf("Expected the recorded changes to stay without ids, got %q", id)
+	}
+	saved, err := loadCities(filepath.Join(dir, "cities.json"), nil)
+	if err != nil {
+		t.Fatalf("Oibai, loadCities() failed: %v", err)
+	}
+	if got, _ := saved.find("Barcelona"); got.id != barcelona.id {
+		t.Errorf("Expected Barcelona to keep the id %q, got %q", barcelona.id, got.id)
+	}
+	setCities(saved)
+	reloaded.adopt()
+	if got, _ := reloaded.idOf("Kristiania"); got != kristiania.id {
+		t.Errorf("Expected Kristiania to keep the id %q in the history, got %q", kristiania.id, got)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	History = &historyStore{}
+	addCity(city{name: "Oslo"}, "aruna")
+	deleteCity("Oslo", "aruna")
+
+	type testCase struct {
+		url      string
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{url: "/city/Oslo/history", wantCode: http.StatusOK, wantText: "Restore"},
+		{url: "/city/Barcelona/history", wantCode: http.StatusOK, wantText: "Nobody has changed"},
+		{url: "/city/Atlantis/history", wantCode: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		cityHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("GET %v: expected %q in:\n%v", tc.url, tc.wantText, rec.Body.String())
+		}
+	}
+}
+
+func TestLoadData_keepsEdits(t *testing.T) {
+	defer func(dir string, cs cities, h *historyStore, r *ratingStore, m *moderationStore, s *shortlistStore, p *permalinkStore, a *alertStore, o *outbox, i *inboxStore) {
+		setCities(cs)
+		DataDir, History, Ratings, Moderation, Shortlists, Permalinks, Alerts, Outbox, Inbox = dir, h, r, m, s, p, a, o, i
+	}(DataDir, allCities(), History, Ratings, Moderation, Shortlists, Permalinks, Alerts, Outbox, Inbox)
+	seeds := allCities()
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	DataDir = dir
+	restart := func() {
+		setCities(seeds)
+		if err := loadData(); err != nil {
+			t.Fatalf("Oibai, loadData() failed: %v", err)
+		}
+	}
+
+	restart()
+	barcelona, _ := allCities().find("Barcelona")
+	if barcelona.id == "" {
+		t.Fatalf("Expected Barcelona to get an id")
+	}
+	cheaper := barcelona
+	cheaper.cost = CheapCost
+	if err := updateCity("Barcelona", cheaper, "aruna"); err != nil {
+		t.Fatalf("Oibai, updateCity() failed: %v", err)
+	}
+	restart()
+	if got, _ := allCities().find("Barcelona"); got.cost != CheapCost || got.id != barcelona.id {
+		t.Errorf("Expected the cheaper Barcelona with the id %q after a restart, got %+v", barcelona.id, got)
+	}
+}
+
+func TestCities_concurrent(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	History = &historyStore{}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if _, err := allCities().view("climate", nil); err != nil {
+				t.Errorf("Oibai, view() failed: %v", err)
+				return
+			}
+			allCities().find("Oslo")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		oslo := city{name: "Oslo", population: 709037 + i}
+		if i == 0 {
+			addCity(oslo, "aruna")
+		} else {
+			updateCity("Oslo", oslo, "aruna")
+		}
+	}
+	<-done
+	if c, _ := allCities().find("Oslo"); c.population != 709037+19 {
+		t.Errorf("Expected the last Oslo, got %+v", c)
+	}
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type (
+	// language is a language the pages can be shown in.
+	language struct {
+		Tag  string // e.g. "ru", as in Accept-Language
+		Name string // in the language itself, e.g. "Русский"
+	}
+
+	// numberFormat is how a language writes numbers.
+	numberFormat struct {
+		thousands string // between groups of three digits, e.g. "," in 1,000
+		decimal   string // e.g. "." in 1.6
+		million   string // after a number of millions, e.g. "M" in 1.6M
+		// groupMillions is true to group the digits of millions too, e.g.
+		// 1.233,6 mio. rather than 1233,6 mio.
+		groupMillions bool
+	}
+)
+
+// langCookie is the name of the cookie that remembers the language a visitor chose with ?lang=.
+const langCookie = "cities_lang"
+
+var (
+	// languages are the languages we have catalogs for, the first is the default.
+	languages = []language{
+		{"en", "English"},
+		{"ru", "Русский"},
+		{"kk", "Қазақша"},
+		{"da", "Dansk"},
+	}
+
+	// numberFormats are how each language writes populations.
+	//
+	// English keeps what we always had, a space between thousands and
+	// millions as e.g. 1233.6M. The others use a non-breaking space so
+	// numbers don't wrap.
+	numberFormats = map[string]numberFormat{
+		"en": {" ", ".", "M", false},
+		"ru": {"\u00a0", ",", "\u00a0млн", true},
+		"kk": {"\u00a0", ",", "\u00a0млн", true},
+		"da": {".", ",", "\u00a0mio.", true},
+	}
+
+	// catalogs translate the English text of the pages, keyed by language.
+	//
+	// Anything missing from a catalog is shown in English.
+	catalogs = map[string]map[string]string{
+		"ru": {
+			// Costs and climates.
+			"cheap":           "дёшево",
+			"very reasonable": "очень доступно",
+			"reasonable":      "доступно",
+			"expensive":       "дорого",
+			"very expensive":  "очень дорого",
+			"nasty":           "ужасный",
+			"poor":            "плохой",
+			"good":            "хороший",
+			"great":           "отличный",
+			"perfect":         "идеальный",
+
+			// Criteria.
+			"cost":           "стоимость",
+			"climate":        "климат",
+			"population":     "население",
+			"distance":       "расстояние",
+			"Cost":           "Стоимость",
+			"Climate":        "Климат",
+			"Population":     "Население",
+			"Monthly cost":   "Расходы в месяц",
+			"distance to %s": "расстояние до %s",
+			" and ":          " и ",
+
+			// Cities.
+			"%v: %v, cost: %v, climate: %v": "%v: %v, стоимость: %v, климат: %v",
+			"Country":                       "Страна",
+			"Region":                        "Регион",
+			"Location":                      "Координаты",
+			"Rent, one bedroom":             "Аренда, одна спальня",
+			"Rent, three bedrooms":          "Аренда, три спальни",
+			"Groceries":                     "Продукты",
+			"Transport":                     "Транспорт",
+			"Eating out":                    "Кафе и рестораны",
+			"Utilities":                     "Коммунальные услуги",
+			"Total for one person":          "Всего на одного человека",
+			"Cost index (%s is 100)":        "Индекс стоимости (%s = 100)",
+
+			// Pages.
+			"Welcome":                               "Добро пожаловать",
+			"This is version %v":                    "Это версия %v",
+			"Language:":                             "Язык:",
+			"Are you in search of your dream city?": "Ищете город своей мечты?",
+			"Is this your dream city?":              "Это город вашей мечты?",
+			"Which one is your dream city?":         "Какой из них город вашей мечты?",
+			"Check out the sorted cities:":          "Посмотрите на отсортированные города:",
+			"by %s":                                 "сортировка: %s",
+			"by distance to Stockholm":              "по расстоянию до Стокгольма",
+			"by climate and cost, or any mix":       "по климату и стоимости, или как угодно",
+			"Too many cities?":                      "Слишком много городов?",
+			"Drop the no-brainers":                  "Отбросьте очевидное",
+			"Can't decide?":                         "Не можете выбрать?",
+			"Compare cities side by side":           "Сравните города рядом",
+			"Put all cities on a map:":              "Все города на карте:",
+			"Put these on a map:":                   "Эти города на карте:",
+			"Enter your city":                       "Добавьте свой город",
+			"City name:":                            "Город:",
+			"Country:":                              "Страна:",
+			"Population:":                           "Население:",
+			"Cost:":                                 "Стоимость:",
+			"Climate:":                              "Климат:",
+			"don't know":                            "не знаю",
+			"Enter":                                 "Добавить",
+			"By %s":                                 "Сортировка: %s",
+			"The sorted cities by %s are:":          "Города, отсортированные по критерию «%s»:",
+			"The cost and climate are as rated by visitors,": "Стоимость и климат — по оценкам посетителей,",
+			"use ours instead":                      "показать наши",
+			"The cost and climate are our guesses,": "Стоимость и климат — наши догадки,",
+			"use the ones visitors rated instead":   "показать оценки посетителей",
+			"Go back to:":                           "Вернуться:",
+			"home":                                  "на главную",
+			"By a mix of criteria":                  "По смеси критериев",
+			"City":                                  "Город",
+			"Score":                                 "Баллы",
+			"The scores are normalized with %s, higher is better.": "Баллы нормализованы методом %s, чем выше, тем лучше.",
+			"Change the weights":                     "Изменить веса",
+			"Criteria":                               "Критерий",
+			"Weight":                                 "Вес",
+			"Log scale":                              "Логарифм",
+			"Better is":                              "Лучше",
+			"higher":                                 "больше",
+			"lower":                                  "меньше",
+			"Normalize with:":                        "Нормализация:",
+			"Cost and climate:":                      "Стоимость и климат:",
+			"our guesses":                            "наши догадки",
+			"as rated by visitors":                   "по оценкам посетителей",
+			"Rank":                                   "Место",
+			"Cost of living per month":               "Стоимость жизни в месяц",
+			"What visitors think":                    "Что думают посетители",
+			"The %s of %s":                           "%[2]s: %[1]s",
+			"We think it's %s.":                      "Мы думаем: %s.",
+			"%d visitors rated it %s on average:":    "Посетителей оценило: %d, в среднем %s:",
+			"Nobody has rated it yet.":               "Пока никто не оценил.",
+			"Your rating:":                           "Ваша оценка:",
+			"Rate":                                   "Оценить",
+			"Rankings":                               "Рейтинги",
+			"Out of %d cities, where 1 is the best:": "Из %d городов, где 1 — лучший:",
+			"Value":                                  "Значение",
+			"By %s, %s scores %s and is number %d of %d.": "По критериям «%s» у города %s %s баллов, это место %d из %d.",
+			"Adds":                       "Вклад",
+			"See":                        "Посмотрите",
+			"all cities ranked this way": "все города в этом порядке",
+			"the history of %s":          "историю города %s",
+			"or":                         "или",
+			"edit it":                    "измените его",
+			"if you are an admin.":       "если вы администратор.",
+			"Comparing %s":               "Сравнение: %s",
+			"%.1fx the %s of %s":         "%.1f× %s города %s",
+			"better than %s":             "лучше, чем %s",
+			"worse than %s":              "хуже, чем %s",
+			"same as %s":                 "как в %s",
+			"The best value in each row is highlighted.": "Лучшее значение в каждой строке выделено.",
+			"No-brainers": "Очевидное",
+			"Which cities can we drop before arguing over weights?":                                                   "Какие города отбросить, не споря о весах?",
+			"By %s, no other city beats these on every count:":                                                        "По критериям «%s» эти города никто не обходит во всём:",
+			"These are no-brainers to drop, since another city is at least as good on every count and better on one:": "Эти можно смело отбросить: другой город не хуже во всём и лучше в чём-то:",
+			"beaten by":                        "уступает",
+			"Compare by:":                      "Сравнить по:",
+			"Show":                             "Показать",
+			"Thank you":                        "Спасибо",
+			"Thank you for %s!":                "Спасибо за %s!",
+			"Your city is waiting for review.": "Ваш город ждёт проверки.",
+			"Once we have checked it, everyone will be able to see it.": "Когда мы его проверим, его увидят все.",
+			"Wanna find an ideal city?":                                 "Хотите найти идеальный город?",
+			"History of %s":                                             "История города %s",
+			"%s has been deleted.":                                      "%s удалён.",
+			"When":                                                      "Когда",
+			"Who":                                                       "Кто",
+			"What":                                                      "Что",
+			"Before":                                                    "До",
+			"After":                                                     "После",
+			"Nobody has changed %s yet.":                                "%s ещё никто не менял.",
+			"create":                                                    "создание",
+			"update":                                                    "изменение",
+			"delete":                                                    "удаление",
+			"The name is missing.":                                      "Не указано название.",
+			"The name needs a letter.":                                  "В названии должна быть хотя бы одна буква.",
+			"The name is too long, at most %d characters.":          "Название слишком длинное, не больше %d символов.",
+			"The country is too long, at most %d characters.":       "Название страны слишком длинное, не больше %d символов.",
+			"The region is too long, at most %d characters.":        "Название региона слишком длинное, не больше %d символов.",
+			"The population must be between 0 and %s.":              "Население должно быть от 0 до %s.",
+			"The population must be a whole number.":                "Население должно быть целым числом.",
+			"Pick a cost from the list.":                            "Выберите стоимость из списка.",
+			"Pick a climate from the list.":                         "Выберите климат из списка.",
+			"The latitude must be between -90 and 90.":              "Широта должна быть от -90 до 90.",
+			"The longitude must be between -180 and 180.":           "Долгота должна быть от -180 до 180.",
+			"Please check the city":                                 "Проверьте город",
+			"Please check %s":                                       "Проверьте город %s",
+			"Go back and try again":                                 "Вернуться и попробовать ещё раз",
+			"Find my dream city":                                    "Найти город мечты",
+			"Step %d of 3":                                          "Шаг %d из 3",
+			"How much do you care about":                            "Насколько для вас важны",
+			"the weather":                                           "погода",
+			"the cost of living":                                    "стоимость жизни",
+			"the size of the city":                                  "размер города",
+			"not at all":                                            "совсем не важно",
+			"a little":                                              "немного",
+			"a lot":                                                 "очень",
+			"above all":                                             "важнее всего",
+			"How big a city would you like?":                        "Какой величины город вам нужен?",
+			"small, under 500 000 people":                           "небольшой, до 500 000 жителей",
+			"medium, 500 000 to 2 million people":                   "средний, от 500 000 до 2 миллионов жителей",
+			"big, over 2 million people":                            "большой, больше 2 миллионов жителей",
+			"any size":                                              "любой",
+			"Which of these are deal-breakers?":                     "Что для вас совершенно неприемлемо?",
+			"an expensive city":                                     "дорогой город",
+			"nasty or poor weather":                                 "ужасная или плохая погода",
+			"Show my cities":                                        "Показать мои города",
+			"Next":                                                  "Дальше",
+			"Your dream cities":                                     "Ваши города мечты",
+			"By %s, out of %d cities that pass your deal-breakers:": "Сортировка: %s, из %d городов, которые вам подходят:",
+			"No city passes your deal-breakers. Try fewer of them.": "Ни один город вам не подходит. Попробуйте убрать какое-нибудь условие.",
+			"Recommend":                                             "Подобрать",
+			"See all the cities ranked this way":                    "Посмотреть все города в таком порядке",
+			"Start again":                                           "Начать заново",
+			"%s, better than %d of the other %d cities":             "%s, лучше, чем у %d из %d других городов",
+			"Answer a few questions and we'll recommend three":      "Ответьте на несколько вопросов, и мы посоветуем три города",
+			"%s: %s instead of %s":                                  "%s: %s, а не %s",
+			"Cities like %s":                                        "Города, похожие на %s",
+			"Cities like %s but %s":                                 "Города как %s, но %s",
+			"cheaper":                                               "дешевле",
+			"with better weather":                                   "с погодой получше",
+			"bigger":                                                "больше",
+			"%s alike":                                              "сходство %s",
+			"Like %s, but:":                                         "Как %s, но:",
+			"Alike":                                                 "Сходство",
+			"Differences":                                           "Отличия",
+			"There are no such cities yet.":                         "Таких городов пока нет.",
+			"Add to shortlist":                                      "В избранное",
+			"Remove from shortlist":                                 "Убрать из избранного",
+			"Only the cities on your shortlist are shown,":          "Показаны только города из вашего избранного,",
+			"show all cities":                                       "показать все города",
+			"Only show my shortlist":                                "Показать только избранное",
+			"My shortlist":                                          "Моё избранное",
+			"Keep track of the cities you like:":                    "Сохраняйте понравившиеся города:",
+			"Rank just these:":                                      "Отсортировать только их:",
+			"Compare them side by side":                             "Сравнить их",
+			"Your shortlist is empty. Add cities to it from the rankings, e.g.": "В избранном пока пусто. Добавляйте города со страниц рейтингов, например",
+			"This ranking was saved on %s.":                                     "Этот рейтинг сохранён %s.",
+			"The cities have changed since:":                                    "С тех пор города изменились:",
+			"added":                                                             "добавлены",
+			"removed":                                                           "убраны",
+			"The order is different.":                                           "Порядок другой.",
+			"The cities are the same as then.":                                  "Города те же, что и тогда.",
+			"Share this ranking":                                                "Поделиться этим рейтингом",
+			"A city for your alert: %s":                                         "Город для вашего оповещения: %s",
+			"%s matches your alert. Have a look:":                               "%s подходит под ваше оповещение. Посмотрите:",
+			"To stop these alerts, go to:":                                      "Чтобы больше не получать эти оповещения, перейдите сюда:",
+			"Give an email or a Slack member id.":                               "Укажите почту или ID участника Slack.",
+			"Give an email or a Slack member id, not both.":                     "Укажите почту или ID участника Slack, но не то и другое.",
+			"This doesn't look like an email.":                                  "Это не похоже на адрес почты.",
+			"A Slack member id looks like U012AB3CD.":                           "ID участника Slack выглядит как U012AB3CD.",
+			"Pick at least one filter.":                                         "Выберите хотя бы один фильтр.",
+			"These filters don't work, is the city near you in our list?":       "Эти фильтры не работают, есть ли город рядом с вами в нашем списке?",
+			"Alerts": "Оповещения",
+			"Done! We'll tell %s when a city that matches is added or updated.": "Готово! Мы сообщим %s, когда подходящий город добавят или обновят.",
+			"To stop the alert:": "Чтобы отключить оповещение:",
+			"Tell me when a city like this is added or updated.": "Сообщите мне, когда такой город добавят или обновят.",
+			"Cost at most:":            "Стоимость не выше:",
+			"any":                      "любая",
+			"Climate at least:":        "Климат не хуже:",
+			"Population from:":         "Население от:",
+			"to":                       "до",
+			"Near:":                    "Рядом с:",
+			"within km:":               "в пределах км:",
+			"Your email:":              "Ваша почта:",
+			"or your Slack member id:": "или ваш ID участника Slack:",
+			"Save the alert":           "Сохранить оповещение",
+			"Stop the alert":           "Отключить оповещение",
+			"Done, you won't get this alert anymore.":          "Готово, вы больше не получите это оповещение.",
+			"Stop telling %s about new cities?":                "Больше не сообщать %s о новых городах?",
+			"Unsubscribe":                                      "Отписаться",
+			"Waiting for the right city?":                      "Ждёте подходящий город?",
+			"Get an alert when it's added":                     "Получите оповещение, когда его добавят",
+			"Your conversation with Aruna":                     "Ваша переписка с Аруной",
+			"Keep this link to come back to the conversation.": "Сохраните эту ссылку, чтобы вернуться к переписке.",
+			"You wrote on %s:":                                 "Вы написали %s:",
+			"Aruna answered on %s:":                            "Аруна ответила %s:",
+			"This page checks for answers every 15 seconds.":   "Эта страница проверяет ответы каждые 15 секунд.",
+			"Send":                               "Отправить",
+			"Start the alert":                    "Включить оповещение",
+			"Start telling %s about new cities?": "Сообщать %s о новых городах?",
+			"Almost done! We sent a link to %s, follow it to start the alert.": "Почти готово! Мы отправили ссылку на %s, перейдите по ней, чтобы включить оповещение.",
+			"To start your alert about new cities, go to:":                     "Чтобы включить оповещение о новых городах, перейдите сюда:",
+			"If you didn't ask for it, ignore this message.":                   "Если вы его не просили, просто проигнорируйте это сообщение.",
+			"Confirm your alert":             "Подтвердите оповещение",
+			"We don't know the currency %s.": "Мы не знаем валюту %s.",
+			"The costs can't be negative.":   "Расходы не могут быть отрицательными.",
+		},
+		"kk": {
+			"cheap":           "арзан",
+			"very reasonable": "өте қолжетімді",
+			"reasonable":      "қолжетімді",
+			"expensive":       "қымбат",
+			"very expensive":  "өте қымбат",
+			"nasty":           "сұмдық",
+			"poor":            "нашар",
+			"good":            "жақсы",
+			"great":           "керемет",
+			"perfect":         "тамаша",
+
+			"cost":           "құны",
+			"climate":        "климаты",
+			"population":     "халқы",
+			"distance":       "қашықтығы",
+			"Cost":           "Құны",
+			"Climate":        "Климаты",
+			"Population":     "Халқы",
+			"Monthly cost":   "Айлық шығын",
+			"distance to %s": "%s дейінгі қашықтығы",
+			" and ":          " және ",
+
+			"%v: %v, cost: %v, climate: %v": "%v: %v, құны: %v, климаты: %v",
+			"Country":                       "Ел",
+			"Region":                        "Аймақ",
+			"Location":                      "Орны",
+			"Rent, one bedroom":             "Жалға алу, бір бөлме",
+			"Rent, three bedrooms":          "Жалға алу, үш бөлме",
+			"Groceries":                     "Азық-түлік",
+			"Transport":                     "Көлік",
+			"Eating out":                    "Мейрамханалар",
+			"Utilities":                     "Коммуналдық қызметтер",
+			"Total for one person":          "Бір адамға барлығы",
+			"Cost index (%s is 100)":        "Құн индексі (%s = 100)",
+
+			"Welcome":                               "Қош келдіңіз",
+			"This is version %v":                    "Бұл %v нұсқасы",
+			"Language:":                             "Тіл:",
+			"Are you in search of your dream city?": "Арман қалаңызды іздеп жүрсіз бе?",
+			"Is this your dream city?":              "Бұл сіздің арман қалаңыз ба?",
+			"Which one is your dream city?":         "Қайсысы сіздің арман қалаңыз?",
+			"Check out the sorted cities:":          "Сұрыпталған қалаларды қараңыз:",
+			"by %s":                                 "%s бойынша",
+			"by distance to Stockholm":              "Стокгольмге дейінгі қашықтық бойынша",
+			"by climate and cost, or any mix":       "климаты мен құны бойынша, не кез келген қоспамен",
+			"Too many cities?":                      "Қала тым көп пе?",
+			"Drop the no-brainers":                  "Анық нашарларын алып тастаңыз",
+			"Can't decide?":                         "Таңдай алмайсыз ба?",
+			"Compare cities side by side":           "Қалаларды қатар салыстырыңыз",
+			"Put all cities on a map:":              "Барлық қалалар картада:",
+			"Put these on a map:":                   "Бұл қалалар картада:",
+			"Enter your city":                       "Қалаңызды қосыңыз",
+			"City name:":                            "Қала:",
+			"Country:":                              "Ел:",
+			"Population:":                           "Халқы:",
+			"Cost:":                                 "Құны:",
+			"Climate:":                              "Климаты:",
+			"don't know":                            "білмеймін",
+			"Enter":                                 "Қосу",
+			"By %s":                                 "%s бойынша",
+			"The sorted cities by %s are:":          "%s бойынша сұрыпталған қалалар:",
+			"The cost and climate are as rated by visitors,": "Құны мен климаты келушілердің бағасы бойынша,",
+			"use ours instead":                      "біздікін көрсету",
+			"The cost and climate are our guesses,": "Құны мен климаты біздің болжамымыз,",
+			"use the ones visitors rated instead":   "келушілердің бағасын көрсету",
+			"Go back to:":                           "Қайту:",
+			"home":                                  "басты бет",
+			"By a mix of criteria":                  "Бірнеше өлшем бойынша",
+			"City":                                  "Қала",
+			"Score":                                 "Ұпай",
+			"The scores are normalized with %s, higher is better.": "Ұпайлар %s әдісімен қалыпқа келтірілген, жоғарысы жақсы.",
+			"Change the weights":                     "Салмақтарды өзгерту",
+			"Criteria":                               "Өлшем",
+			"Weight":                                 "Салмақ",
+			"Log scale":                              "Логарифм",
+			"Better is":                              "Жақсысы",
+			"higher":                                 "көбі",
+			"lower":                                  "азы",
+			"Normalize with:":                        "Қалыпқа келтіру:",
+			"Cost and climate:":                      "Құны мен климаты:",
+			"our guesses":                            "біздің болжам",
+			"as rated by visitors":                   "келушілердің бағасы",
+			"Rank":                                   "Орны",
+			"Cost of living per month":               "Айлық өмір сүру құны",
+			"What visitors think":                    "Келушілер не ойлайды",
+			"The %s of %s":                           "%[2]s: %[1]s",
+			"We think it's %s.":                      "Біздіңше: %s.",
+			"%d visitors rated it %s on average:":    "%d келуші бағалады, орташа %s:",
+			"Nobody has rated it yet.":               "Әзірге ешкім бағаламады.",
+			"Your rating:":                           "Сіздің бағаңыз:",
+			"Rate":                                   "Бағалау",
+			"Rankings":                               "Рейтингтер",
+			"Out of %d cities, where 1 is the best:": "%d қаланың ішінде, 1 — ең жақсысы:",
+			"Value":                                  "Мәні",
+			"By %s, %s scores %s and is number %d of %d.": "%s бойынша %s %s ұпай алып, %d/%d орында.",
+			"Adds":                       "Үлесі",
+			"See":                        "Қараңыз:",
+			"all cities ranked this way": "барлық қалалар осы ретпен",
+			"the history of %s":          "%s тарихы",
+			"or":                         "немесе",
+			"edit it":                    "өңдеңіз",
+			"if you are an admin.":       "егер әкімші болсаңыз.",
+			"Comparing %s":               "Салыстыру: %s",
+			"%.1fx the %s of %s":         "%[3]s қаласымен салыстырғанда %[2]s %.1[1]f есе",
+			"better than %s":             "%s қаласынан жақсы",
+			"worse than %s":              "%s қаласынан нашар",
+			"same as %s":                 "%s қаласымен бірдей",
+			"The best value in each row is highlighted.": "Әр жолдағы ең жақсы мән белгіленген.",
+			"No-brainers": "Анық нашарлар",
+			"Which cities can we drop before arguing over weights?":                                                   "Салмақ туралы дауласпас бұрын қай қалаларды алып тастауға болады?",
+			"By %s, no other city beats these on every count:":                                                        "%s бойынша бұл қалаларды ешкім бәрінен озбайды:",
+			"These are no-brainers to drop, since another city is at least as good on every count and better on one:": "Бұларды алып тастауға болады, басқа қала бәрінен кем емес және бірінен жақсы:",
+			"beaten by":                        "озғандар:",
+			"Compare by:":                      "Салыстыру:",
+			"Show":                             "Көрсету",
+			"Thank you":                        "Рақмет",
+			"Thank you for %s!":                "%s үшін рақмет!",
+			"Your city is waiting for review.": "Қалаңыз тексеруді күтіп тұр.",
+			"Once we have checked it, everyone will be able to see it.": "Тексергеннен кейін оны бәрі көре алады.",
+			"Wanna find an ideal city?":                                 "Тамаша қала іздейсіз бе?",
+			"History of %s":                                             "%s тарихы",
+			"%s has been deleted.":                                      "%s жойылды.",
+			"When":                                                      "Қашан",
+			"Who":                                                       "Кім",
+			"What":                                                      "Не",
+			"Before":                                                    "Бұрын",
+			"After":                                                     "Кейін",
+			"Nobody has changed %s yet.":                                "%s әлі ешкім өзгертпеді.",
+			"create":                                                    "қосу",
+			"update":                                                    "өзгерту",
+			"delete":                                                    "жою",
+			"The name is missing.":                                      "Атауы көрсетілмеген.",
+			"The name needs a letter.":                                  "Атауында кемінде бір әріп болуы керек.",
+			"The name is too long, at most %d characters.":          "Атауы тым ұзын, ең көбі %d таңба.",
+			"The country is too long, at most %d characters.":       "Ел атауы тым ұзын, ең көбі %d таңба.",
+			"The region is too long, at most %d characters.":        "Аймақ атауы тым ұзын, ең көбі %d таңба.",
+			"The population must be between 0 and %s.":              "Халық саны 0 мен %s аралығында болуы керек.",
+			"The population must be a whole number.":                "Халық саны бүтін сан болуы керек.",
+			"Pick a cost from the list.":                            "Тізімнен құнын таңдаңыз.",
+			"Pick a climate from the list.":                         "Тізімнен климатты таңдаңыз.",
+			"The latitude must be between -90 and 90.":              "Ендік -90 мен 90 аралығында болуы керек.",
+			"The longitude must be between -180 and 180.":           "Бойлық -180 мен 180 аралығында болуы керек.",
+			"Please check the city":                                 "Қаланы тексеріңіз",
+			"Please check %s":                                       "%s қаласын тексеріңіз",
+			"Go back and try again":                                 "Қайтып, қайта көріңіз",
+			"Find my dream city":                                    "Арман қаламды табу",
+			"Step %d of 3":                                          "3 қадамның %d-қадамы",
+			"How much do you care about":                            "Сіз үшін қаншалықты маңызды",
+			"the weather":                                           "ауа райы",
+			"the cost of living":                                    "өмір сүру құны",
+			"the size of the city":                                  "қаланың көлемі",
+			"not at all":                                            "мүлдем маңызды емес",
+			"a little":                                              "аздап",
+			"a lot":                                                 "өте",
+			"above all":                                             "бәрінен маңызды",
+			"How big a city would you like?":                        "Қандай көлемдегі қала керек?",
+			"small, under 500 000 people":                           "шағын, 500 000 тұрғынға дейін",
+			"medium, 500 000 to 2 million people":                   "орташа, 500 000-нан 2 миллионға дейін тұрғын",
+			"big, over 2 million people":                            "үлкен, 2 миллионнан астам тұрғын",
+			"any size":                                              "кез келген",
+			"Which of these are deal-breakers?":                     "Бұлардың қайсысы мүлдем келмейді?",
+			"an expensive city":                                     "қымбат қала",
+			"nasty or poor weather":                                 "сұмдық не нашар ауа райы",
+			"Show my cities":                                        "Қалаларымды көрсету",
+			"Next":                                                  "Әрі қарай",
+			"Your dream cities":                                     "Арман қалаларыңыз",
+			"By %s, out of %d cities that pass your deal-breakers:": "%s бойынша, сізге келетін %d қаланың ішінен:",
+			"No city passes your deal-breakers. Try fewer of them.": "Сізге бірде-бір қала келмейді. Шарттарды азайтып көріңіз.",
+			"Recommend":                                             "Ұсыну",
+			"See all the cities ranked this way":                    "Барлық қалаларды осылай сұрыптап көру",
+			"Start again":                                           "Қайта бастау",
+			"%s, better than %d of the other %d cities":             "%s, басқа %[3]d қаланың %[2]d қаласынан жақсы",
+			"Answer a few questions and we'll recommend three":      "Бірнеше сұраққа жауап беріңіз, біз үш қала ұсынамыз",
+			"%s: %s instead of %s":                                  "%s: %[3]s емес, %[2]s",
+			"Cities like %s":                                        "%s сияқты қалалар",
+			"Cities like %s but %s":                                 "%s сияқты, бірақ %s қалалар",
+			"cheaper":                                               "арзанырақ",
+			"with better weather":                                   "ауа райы жақсырақ",
+			"bigger":                                                "үлкенірек",
+			"%s alike":                                              "ұқсастығы %s",
+			"Like %s, but:":                                         "%s сияқты, бірақ:",
+			"Alike":                                                 "Ұқсастығы",
+			"Differences":                                           "Айырмашылықтар",
+			"There are no such cities yet.":                         "Әзірге мұндай қалалар жоқ.",
+			"Add to shortlist":                                      "Таңдаулыға қосу",
+			"Remove from shortlist":                                 "Таңдаулыдан алып тастау",
+			"Only the cities on your shortlist are shown,":          "Тек таңдаулы қалаларыңыз көрсетілген,",
+			"show all cities":                                       "барлық қалаларды көрсету",
+			"Only show my shortlist":                                "Тек таңдаулыларымды көрсету",
+			"My shortlist":                                          "Таңдаулыларым",
+			"Keep track of the cities you like:":                    "Ұнаған қалаларды сақтаңыз:",
+			"Rank just these:":                                      "Тек осыларды сұрыптау:",
+			"Compare them side by side":                             "Оларды салыстыру",
+			"Your shortlist is empty. Add cities to it from the rankings, e.g.": "Таңдаулыларыңыз әзірге бос. Қалаларды рейтинг беттерінен қосыңыз, мысалы",
+			"This ranking was saved on %s.":                                     "Бұл рейтинг %s сақталды.",
+			"The cities have changed since:":                                    "Содан бері қалалар өзгерді:",
+			"added":                                                             "қосылды",
+			"removed":                                                           "алынып тасталды",
+			"The order is different.":                                           "Реті басқа.",
+			"The cities are the same as then.":                                  "Қалалар сол кездегідей.",
+			"Share this ranking":                                                "Осы рейтингпен бөлісу",
+			"A city for your alert: %s":                                         "Хабарландыруыңызға қала: %s",
+			"%s matches your alert. Have a look:":                               "%s хабарландыруыңызға сәйкес келеді. Қараңыз:",
+			"To stop these alerts, go to:":                                      "Бұл хабарландыруларды тоқтату үшін мына жерге өтіңіз:",
+			"Give an email or a Slack member id.":                               "Поштаны немесе Slack қатысушысының ID-ін көрсетіңіз.",
+			"Give an email or a Slack member id, not both.":                     "Поштаны немесе Slack қатысушысының ID-ін көрсетіңіз, екеуін емес.",
+			"This doesn't look like an email.":                                  "Бұл пошта мекенжайына ұқсамайды.",
+			"A Slack member id looks like U012AB3CD.":                           "Slack қатысушысының ID-і U012AB3CD сияқты болады.",
+			"Pick at least one filter.":                                         "Кемінде бір сүзгіні таңдаңыз.",
+			"These filters don't work, is the city near you in our list?":       "Бұл сүзгілер жұмыс істемейді, жаныңыздағы қала біздің тізімде бар ма?",
+			"Alerts": "Хабарландырулар",
+			"Done! We'll tell %s when a city that matches is added or updated.": "Дайын! Сәйкес қала қосылғанда немесе жаңартылғанда %s хабарлаймыз.",
+			"To stop the alert:": "Хабарландыруды тоқтату үшін:",
+			"Tell me when a city like this is added or updated.": "Осындай қала қосылғанда немесе жаңартылғанда маған хабарлаңыз.",
+			"Cost at most:":            "Құны ең көбі:",
+			"any":                      "кез келген",
+			"Climate at least:":        "Климаты кемінде:",
+			"Population from:":         "Халқы:",
+			"to":                       "дейін",
+			"Near:":                    "Жанында:",
+			"within km:":               "км ішінде:",
+			"Your email:":              "Поштаңыз:",
+			"or your Slack member id:": "немесе Slack қатысушы ID-іңіз:",
+			"Save the alert":           "Хабарландыруды сақтау",
+			"Stop the alert":           "Хабарландыруды тоқтату",
+			"Done, you won't get this alert anymore.":          "Дайын, бұл хабарландыру енді келмейді.",
+			"Stop telling %s about new cities?":                "%s жаңа қалалар туралы хабарлауды тоқтату керек пе?",
+			"Unsubscribe":                                      "Жазылымнан бас тарту",
+			"Waiting for the right city?":                      "Лайықты қаланы күтіп жүрсіз бе?",
+			"Get an alert when it's added":                     "Ол қосылғанда хабарландыру алыңыз",
+			"Your conversation with Aruna":                     "Арунамен хат алмасуыңыз",
+			"Keep this link to come back to the conversation.": "Хат алмасуға оралу үшін осы сілтемені сақтаңыз.",
+			"You wrote on %s:":                                 "Сіз %s жаздыңыз:",
+			"Aruna answered on %s:":                            "Аруна %s жауап берді:",
+			"This page checks for answers every 15 seconds.":   "Бұл бет жауаптарды әр 15 секунд сайын тексереді.",
+			"Send":                               "Жіберу",
+			"Start the alert":                    "Хабарландыруды қосу",
+			"Start telling %s about new cities?": "%s жаңа қалалар туралы хабарлау керек пе?",
+			"Almost done! We sent a link to %s, follow it to start the alert.": "Аз қалды! Біз %s мекенжайына сілтеме жібердік, хабарландыруды қосу үшін соған өтіңіз.",
+			"To start your alert about new cities, go to:":                     "Жаңа қалалар туралы хабарландыруды қосу үшін мына жерге өтіңіз:",
+			"If you didn't ask for it, ignore this message.":                   "Егер сіз оны сұрамаған болсаңыз, бұл хабарламаны елемеңіз.",
+			"Confirm your alert":             "Хабарландыруды растаңыз",
+			"We don't know the currency %s.": "Біз %s валютасын білмейміз.",
+			"The costs can't be negative.":   "Шығындар теріс бола алмайды.",
+		},
+		"da": {
+			"cheap":           "billig",
+			"very reasonable": "meget rimelig",
+			"reasonable":      "rimelig",
+			"expensive":       "dyr",
+			"very expensive":  "meget dyr",
+			"nasty":           "elendigt",
+			"poor":            "dårligt",
+			"good":            "godt",
+			"great":           "rigtig godt",
+			"perfect":         "perfekt",
+
+			"cost":           "pris",
+			"climate":        "klima",
+			"population":     "indbyggertal",
+			"distance":       "afstand",
+			"Cost":           "Pris",
+			"Climate":        "Klima",
+			"Population":     "Indbyggertal",
+			"Monthly cost":   "Månedlige udgifter",
+			"distance to %s": "afstand til %s",
+			" and ":          " og ",
+
+			"%v: %v, cost: %v, climate: %v": "%v: %v, pris: %v, klima: %v",
+			"Country":                       "Land",
+			"Region":                        "Region",
+			"Location":                      "Placering",
+			"Rent, one bedroom":             "Husleje, et soveværelse",
+			"Rent, three bedrooms":          "Husleje, tre soveværelser",
+			"Groceries":                     "Dagligvarer",
+			"Transport":                     "Transport",
+			"Eating out":                    "Spise ude",
+			"Utilities":                     "Forbrug",
+			"Total for one person":          "I alt for én person",
+			"Cost index (%s is 100)":        "Prisindeks (%s er 100)",
+
+			"Welcome":                               "Velkommen",
+			"This is version %v":                    "Dette er version %v",
+			"Language:":                             "Sprog:",
+			"Are you in search of your dream city?": "Leder du efter din drømmeby?",
+			"Is this your dream city?":              "Er det din drømmeby?",
+			"Which one is your dream city?":         "Hvilken er din drømmeby?",
+			"Check out the sorted cities:":          "Se de sorterede byer:",
+			"by %s":                                 "efter %s",
+			"by distance to Stockholm":              "efter afstand til Stockholm",
+			"by climate and cost, or any mix":       "efter klima og pris, eller en hvilken som helst blanding",
+			"Too many cities?":                      "For mange byer?",
+			"Drop the no-brainers":                  "Drop de oplagte",
+			"Can't decide?":                         "Kan du ikke bestemme dig?",
+			"Compare cities side by side":           "Sammenlign byer side om side",
+			"Put all cities on a map:":              "Alle byer på et kort:",
+			"Put these on a map:":                   "Disse byer på et kort:",
+			"Enter your city":                       "Tilføj din by",
+			"City name:":                            "By:",
+			"Country:":                              "Land:",
+			"Population:":                           "Indbyggertal:",
+			"Cost:":                                 "Pris:",
+			"Climate:":                              "Klima:",
+			"don't know":                            "ved ikke",
+			"Enter":                                 "Tilføj",
+			"By %s":                                 "Efter %s",
+			"The sorted cities by %s are:":          "Byerne sorteret efter %s er:",
+			"The cost and climate are as rated by visitors,": "Pris og klima er som besøgende har bedømt dem,",
+			"use ours instead":                      "brug vores i stedet",
+			"The cost and climate are our guesses,": "Pris og klima er vores gæt,",
+			"use the ones visitors rated instead":   "brug de besøgendes bedømmelser i stedet",
+			"Go back to:":                           "Gå tilbage til:",
+			"home":                                  "forsiden",
+			"By a mix of criteria":                  "Efter en blanding af kriterier",
+			"City":                                  "By",
+			"Score":                                 "Point",
+			"The scores are normalized with %s, higher is better.": "Pointene er normaliseret med %s, højere er bedre.",
+			"Change the weights":                     "Skift vægtene",
+			"Criteria":                               "Kriterie",
+			"Weight":                                 "Vægt",
+			"Log scale":                              "Logaritmisk",
+			"Better is":                              "Bedst er",
+			"higher":                                 "højere",
+			"lower":                                  "lavere",
+			"Normalize with:":                        "Normaliser med:",
+			"Cost and climate:":                      "Pris og klima:",
+			"our guesses":                            "vores gæt",
+			"as rated by visitors":                   "som besøgende har bedømt dem",
+			"Rank":                                   "Placering",
+			"Cost of living per month":               "Leveomkostninger om måneden",
+			"What visitors think":                    "Hvad besøgende synes",
+			"The %s of %s":                           "%s i %s",
+			"We think it's %s.":                      "Vi synes, det er %s.",
+			"%d visitors rated it %s on average:":    "%d besøgende gav i gennemsnit %s:",
+			"Nobody has rated it yet.":               "Ingen har bedømt det endnu.",
+			"Your rating:":                           "Din bedømmelse:",
+			"Rate":                                   "Bedøm",
+			"Rankings":                               "Placeringer",
+			"Out of %d cities, where 1 is the best:": "Ud af %d byer, hvor 1 er bedst:",
+			"Value":                                  "Værdi",
+			"By %s, %s scores %s and is number %d of %d.": "Efter %s får %s %s point og er nummer %d af %d.",
+			"Adds":                       "Bidrag",
+			"See":                        "Se",
+			"all cities ranked this way": "alle byer rangeret sådan",
+			"the history of %s":          "historikken for %s",
+			"or":                         "eller",
+			"edit it":                    "ret den",
+			"if you are an admin.":       "hvis du er administrator.",
+			"Comparing %s":               "Sammenligner %s",
+			"%.1fx the %s of %s":         "%.1fx %s i forhold til %s",
+			"better than %s":             "bedre end %s",
+			"worse than %s":              "værre end %s",
+			"same as %s":                 "som %s",
+			"The best value in each row is highlighted.": "Den bedste værdi i hver række er fremhævet.",
+			"No-brainers": "De oplagte",
+			"Which cities can we drop before arguing over weights?":                                                   "Hvilke byer kan vi droppe, før vi skændes om vægtene?",
+			"By %s, no other city beats these on every count:":                                                        "Efter %s slår ingen anden by disse på alle punkter:",
+			"These are no-brainers to drop, since another city is at least as good on every count and better on one:": "Disse kan roligt droppes, da en anden by er mindst lige så god på alle punkter og bedre på et:",
+			"beaten by":                        "slået af",
+			"Compare by:":                      "Sammenlign efter:",
+			"Show":                             "Vis",
+			"Thank you":                        "Tak",
+			"Thank you for %s!":                "Tak for %s!",
+			"Your city is waiting for review.": "Din by venter på at blive gennemgået.",
+			"Once we have checked it, everyone will be able to see it.": "Når vi har tjekket den, kan alle se den.",
+			"Wanna find an ideal city?":                                 "Vil du finde en ideel by?",
+			"History of %s":                                             "Historik for %s",
+			"%s has been deleted.":                                      "%s er slettet.",
+			"When":                                                      "Hvornår",
+			"Who":                                                       "Hvem",
+			"What":                                                      "Hvad",
+			"Before":                                                    "Før",
+			"After":                                                     "Efter",
+			"Nobody has changed %s yet.":                                "Ingen har ændret %s endnu.",
+			"create":                                                    "oprettet",
+			"update":                                                    "ændret",
+			"delete":                                                    "slettet",
+			"The name is missing.":                                      "Navnet mangler.",
+			"The name needs a letter.":                                  "Navnet skal have mindst ét bogstav.",
+			"The name is too long, at most %d characters.":          "Navnet er for langt, højst %d tegn.",
+			"The country is too long, at most %d characters.":       "Landet er for langt, højst %d tegn.",
+			"The region is too long, at most %d characters.":        "Regionen er for lang, højst %d tegn.",
+			"The population must be between 0 and %s.":              "Indbyggertallet skal være mellem 0 og %s.",
+			"The population must be a whole number.":                "Indbyggertallet skal være et helt tal.",
+			"Pick a cost from the list.":                            "Vælg en pris fra listen.",
+			"Pick a climate from the list.":                         "Vælg et klima fra listen.",
+			"The latitude must be between -90 and 90.":              "Breddegraden skal være mellem -90 og 90.",
+			"The longitude must be between -180 and 180.":           "Længdegraden skal være mellem -180 og 180.",
+			"Please check the city":                                 "Tjek venligst byen",
+			"Please check %s":                                       "Tjek venligst %s",
+			"Go back and try again":                                 "Gå tilbage og prøv igen",
+			"Find my dream city":                                    "Find min drømmeby",
+			"Step %d of 3":                                          "Trin %d af 3",
+			"How much do you care about":                            "Hvor meget betyder",
+			"the weather":                                           "vejret",
+			"the cost of living":                                    "leveomkostningerne",
+			"the size of the city":                                  "byens størrelse",
+			"not at all":                                            "slet ikke",
+			"a little":                                              "lidt",
+			"a lot":                                                 "meget",
+			"above all":                                             "mest af alt",
+			"How big a city would you like?":                        "Hvor stor en by vil du gerne have?",
+			"small, under 500 000 people":                           "lille, under 500 000 indbyggere",
+			"medium, 500 000 to 2 million people":                   "mellemstor, 500 000 til 2 millioner indbyggere",
+			"big, over 2 million people":                            "stor, over 2 millioner indbyggere",
+			"any size":                                              "alle størrelser",
+			"Which of these are deal-breakers?":                     "Hvilke af disse er udelukket?",
+			"an expensive city":                                     "en dyr by",
+			"nasty or poor weather":                                 "elendigt eller dårligt vejr",
+			"Show my cities":                                        "Vis mine byer",
+			"Next":                                                  "Næste",
+			"Your dream cities":                                     "Dine drømmebyer",
+			"By %s, out of %d cities that pass your deal-breakers:": "Efter %s, ud af %d byer, der ikke er udelukket:",
+			"No city passes your deal-breakers. Try fewer of them.": "Alle byer er udelukket. Prøv med færre krav.",
+			"Recommend":                                             "Anbefal",
+			"See all the cities ranked this way":                    "Se alle byerne rangeret sådan",
+			"Start again":                                           "Start forfra",
+			"%s, better than %d of the other %d cities":             "%s, bedre end %d af de andre %d byer",
+			"Answer a few questions and we'll recommend three":      "Svar på et par spørgsmål, så anbefaler vi tre",
+			"%s: %s instead of %s":                                  "%s: %s i stedet for %s",
+			"Cities like %s":                                        "Byer som %s",
+			"Cities like %s but %s":                                 "Byer som %s, men %s",
+			"cheaper":                                               "billigere",
+			"with better weather":                                   "med bedre vejr",
+			"bigger":                                                "større",
+			"%s alike":                                              "%s ens",
+			"Like %s, but:":                                         "Som %s, men:",
+			"Alike":                                                 "Ens",
+			"Differences":                                           "Forskelle",
+			"There are no such cities yet.":                         "Der er ingen sådanne byer endnu.",
+			"Add to shortlist":                                      "Føj til kortlisten",
+			"Remove from shortlist":                                 "Fjern fra kortlisten",
+			"Only the cities on your shortlist are shown,":          "Kun byerne på din kortliste vises,",
+			"show all cities":                                       "vis alle byer",
+			"Only show my shortlist":                                "Vis kun min kortliste",
+			"My shortlist":                                          "Min kortliste",
+			"Keep track of the cities you like:":                    "Hold styr på de byer, du kan lide:",
+			"Rank just these:":                                      "Rangér kun disse:",
+			"Compare them side by side":                             "Sammenlign dem side om side",
+			"Your shortlist is empty. Add cities to it from the rankings, e.g.": "Din kortliste er tom. Tilføj byer fra ranglisterne, f.eks.",
+			"This ranking was saved on %s.":                                     "Denne rangering blev gemt %s.",
+			"The cities have changed since:":                                    "Byerne har ændret sig siden:",
+			"added":                                                             "tilføjet",
+			"removed":                                                           "fjernet",
+			"The order is different.":                                           "Rækkefølgen er anderledes.",
+			"The cities are the same as then.":                                  "Byerne er de samme som dengang.",
+			"Share this ranking":                                                "Del denne rangering",
+			"A city for your alert: %s":                                         "En by til din alarm: %s",
+			"%s matches your alert. Have a look:":                               "%s passer til din alarm. Tag et kig:",
+			"To stop these alerts, go to:":                                      "For at stoppe disse alarmer, gå til:",
+			"Give an email or a Slack member id.":                               "Angiv en e-mail eller et Slack-medlems-id.",
+			"Give an email or a Slack member id, not both.":                     "Angiv en e-mail eller et Slack-medlems-id, ikke begge.",
+			"This doesn't look like an email.":                                  "Det ligner ikke en e-mail.",
+			"A Slack member id looks like U012AB3CD.":                           "Et Slack-medlems-id ser ud som U012AB3CD.",
+			"Pick at least one filter.":                                         "Vælg mindst ét filter.",
+			"These filters don't work, is the city near you in our list?":       "Disse filtre virker ikke, er byen nær dig på vores liste?",
+			"Alerts": "Alarmer",
+			"Done! We'll tell %s when a city that matches is added or updated.": "Færdig! Vi giver %s besked, når en by, der passer, bliver tilføjet eller opdateret.",
+			"To stop the alert:": "For at stoppe alarmen:",
+			"Tell me when a city like this is added or updated.": "Giv mig besked, når en by som denne bliver tilføjet eller opdateret.",
+			"Cost at most:":            "Pris højst:",
+			"any":                      "alle",
+			"Climate at least:":        "Klima mindst:",
+			"Population from:":         "Indbyggertal fra:",
+			"to":                       "til",
+			"Near:":                    "Nær:",
+			"within km:":               "inden for km:",
+			"Your email:":              "Din e-mail:",
+			"or your Slack member id:": "eller dit Slack-medlems-id:",
+			"Save the alert":           "Gem alarmen",
+			"Stop the alert":           "Stop alarmen",
+			"Done, you won't get this alert anymore.":          "Færdig, du får ikke denne alarm mere.",
+			"Stop telling %s about new cities?":                "Stop med at fortælle %s om nye byer?",
+			"Unsubscribe":                                      "Afmeld",
+			"Waiting for the right city?":                      "Venter du på den rette by?",
+			"Get an alert when it's added":                     "Få en alarm, når den bliver tilføjet",
+			"Your conversation with Aruna":                     "Din samtale med Aruna",
+			"Keep this link to come back to the conversation.": "Gem dette link for at komme tilbage til samtalen.",
+			"You wrote on %s:":                                 "Du skrev %s:",
+			"Aruna answered on %s:":                            "Aruna svarede %s:",
+			"This page checks for answers every 15 seconds.":   "Denne side tjekker for svar hvert 15. sekund.",
+			"Send":                               "Send",
+			"Start the alert":                    "Start alarmen",
+			"Start telling %s about new cities?": "Skal vi fortælle %s om nye byer?",
+			"Almost done! We sent a link to %s, follow it to start the alert.": "Næsten færdig! Vi har sendt et link til %s, følg det for at starte alarmen.",
+			"To start your alert about new cities, go to:":                     "For at starte din alarm om nye byer, gå til:",
+			"If you didn't ask for it, ignore this message.":                   "Hvis du ikke har bedt om den, så ignorer denne besked.",
+			"Confirm your alert":             "Bekræft din alarm",
+			"We don't know the currency %s.": "Vi kender ikke valutaen %s.",
+			"The costs can't be negative.":   "Udgifterne kan ikke være negative.",
+		},
+	}
+)
+
+// supportedLang returns true if we have a catalog for the language.
+func supportedLang(tag string) bool {
+	for _, l := range languages {
+		if l.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tr returns the text in the language, or the English text if there is no translation.
+func tr(lang, text string) string {
+	if t, ok := catalogs[lang][text]; ok {
+		return t
+	}
+	return text
+}
+
+// joinAnd returns the items as a list in the language, e.g. "Barcelona, Seattle and Paradisio".
+func joinAnd(lang string, items []string) string {
+	n := len(items)
+	if n < 2 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:n-1], ", ") + tr(lang, " and ") + items[n-1]
+}
+
+// formatPopulationIn returns a short description of the population the way
+// the language writes it, e.g. "562 379" or "1.6M" in English and "1,6 mio." in Danish.
+func formatPopulationIn(lang string, population int) string {
+	nf, ok := numberFormats[lang]
+	if !ok {
+		nf = numberFormats[languages[0].Tag]
+	}
+	if population >= 1e6 {
+		m := strings.SplitN(strconv.FormatFloat(float64(population)/1e6, 'f', 1, 64), ".", 2)
+		if nf.groupMillions {
+			m[0] = nf.group(m[0])
+		}
+		return m[0] + nf.decimal + m[1] + nf.million
+	}
+	return nf.group(strconv.Itoa(population))
+}
+
+// group returns the digits with the thousands separator between groups of
+// three, e.g. "562 379" for "562379".
+func (nf numberFormat) group(digits string) string {
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + nf.thousands + digits[i:]
+	}
+	return digits
+}
+
+// localString returns a description of the city in the language, like String does in English.
+func (c city) localString(lang string) string {
+	if c.name == "" {
+		return c.String()
+	}
+	return fmt.Sprintf(
+		tr(lang, "%v: %v, cost: %v, climate: %v"),
+		c.name,
+		formatPopulationIn(lang, c.population),
+		tr(lang, c.cost.String()),
+		tr(lang, c.climate.String()),
+	)
+}
+
+// parseAcceptLanguage returns the language we have a catalog for that the
+// Accept-Language header likes the most, e.g. "ru" for "ru-RU,ru;q=0.9,en;q=0.8".
+//
+// It is empty if the header doesn't ask for any language we have.
+func parseAcceptLanguage(header string) string {
+	for _, a := range parseAccept(header) {
+		if tag := strings.SplitN(a.value, "-", 2)[0]; supportedLang(tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// visitorLang returns the language to show the pages in.
+//
+// A ?lang= parameter wins and is remembered in a cookie, then the cookie,
+// then the Accept-Language header, and English if none of them say.
+func visitorLang(w http.ResponseWriter, r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); supportedLang(lang) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     langCookie,
+			Value:    lang,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+		})
+		return lang
+	}
+	if c, err := r.Cookie(langCookie); err == nil && supportedLang(c.Value) {
+		return c.Value
+	}
+	if lang := parseAcceptLanguage(r.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return languages[0].Tag
+}
+
+// templateFuncs returns the functions templates use to show text in the language.
+func templateFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"t":         func(text string) string { return tr(lang, text) },
+		"city":      func(c city) string { return c.localString(lang) },
+		"pop":       func(p int) string { return formatPopulationIn(lang, p) },
+		"list":      func(items []string) string { return joinAnd(lang, items) },
+		"lang":      func() string { return lang },
+		"languages": func() []language { return languages },
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	type testCase struct {
+		header string
+		want   string
+	}
+	cases := []testCase{
+		{header: "", want: ""},
+		{header: "ru-RU,ru;q=0.9,en;q=0.8", want: "ru"},
+		{header: "de-DE, da;q=0.5, en;q=0.7", want: "en"},
+		{header: "fr, kk;q=0.1", want: "kk"},
+		{header: "DA", want: "da"},
+		{header: "da;q=0, de", want: ""},
+		{header: "*", want: ""},
+	}
+	for _, tc := range cases {
+		if got := parseAcceptLanguage(tc.header); got != tc.want {
+			t.Errorf("parseAcceptLanguage(%q) = %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestVisitorLang(t *testing.T) {
+	type testCase struct {
+		url        string
+		cookie     string
+		header     string
+		want       string
+		wantCookie bool
+	}
+	cases := []testCase{
+		{url: "/", want: "en"},
+		{url: "/", header: "ru,en;q=0.5", want: "ru"},
+		{url: "/", cookie: "kk", header: "ru", want: "kk"},
+		{url: "/?lang=da", cookie: "kk", header: "ru", want: "da", wantCookie: true},
+		{url: "/?lang=xx", header: "ru", want: "ru"},
+		{url: "/", cookie: "xx", want: "en"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: langCookie, Value: tc.cookie})
+		}
+		if tc.header != "" {
+			req.Header.Set("Accept-Language", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		if got := visitorLang(rec, req); got != tc.want {
+			t.Errorf("visitorLang(%v, cookie %q, header %q) = %q, want %q", tc.url, tc.cookie, tc.header, got, tc.want)
+		}
+		gotCookie := strings.Contains(rec.Header().Get("Set-Cookie"), langCookie+"="+tc.want)
+		if gotCookie != tc.wantCookie {
+			t.Errorf("visitorLang(%v) set cookie: %q, want one: %v", tc.url, rec.Header().Get("Set-Cookie"), tc.wantCookie)
+		}
+	}
+}
+
+func TestTr(t *testing.T) {
+	type testCase struct {
+		lang string
+		text string
+		want string
+	}
+	cases := []testCase{
+		{lang: "en", text: "expensive", want: "expensive"},
+		{lang: "ru", text: "expensive", want: "дорого"},
+		{lang: "da", text: "perfect", want: "perfekt"},
+		{lang: "kk", text: "no such text", want: "no such text"},
+		{lang: "xx", text: "cheap", want: "cheap"},
+	}
+	for _, tc := range cases {
+		if got := tr(tc.lang, tc.text); got != tc.want {
+			t.Errorf("tr(%q, %q) = %q, want %q", tc.lang, tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestFormatPopulationIn(t *testing.T) {
+	type testCase struct {
+		lang       string
+		population int
+		want       string
+	}
+	cases := []testCase{
+		{lang: "en", population: 562379, want: "562 379"},
+		{lang: "en", population: 1.6e6, want: "1.6M"},
+		{lang: "en", population: 1233567890, want: "1233.6M"},
+		{lang: "da", population: 1233567890, want: "1.233,6\u00a0mio."},
+		{lang: "da", population: 562379, want: "562.379"},
+		{lang: "da", population: 1.6e6, want: "1,6\u00a0mio."},
+		{lang: "ru", population: 1.6e6, want: "1,6\u00a0млн"},
+		{lang: "ru", population: 999, want: "999"},
+		{lang: "kk", population: 1234, want: "1\u00a0234"},
+	}
+	for _, tc := range cases {
+		if got := formatPopulationIn(tc.lang, tc.population); got != tc.want {
+			t.Errorf("formatPopulationIn(%q, %v) = %q, want %q", tc.lang, tc.population, got, tc.want)
+		}
+	}
+}
+
+func TestPagesInLanguage(t *testing.T) {
+	type testCase struct {
+		url      string
+		header   string
+		wantText string
+	}
+	cases := []testCase{
+		{url: "/by-cost", header: "ru", wantText: "Barcelona: 1,6\u00a0млн, стоимость: доступно, климат: отличный"},
+		{url: "/by-cost?lang=da", header: "ru", wantText: "Barcelona: 1,6\u00a0mio., pris: rimelig, klima: rigtig godt"},
+		{url: "/by-cost", wantText: "Barcelona: 1.6M, cost: reasonable, climate: great"},
+		{url: "/city/Barcelona", header: "da", wantText: "Er det din drømmeby?"},
+		{url: "/rank", header: "kk", wantText: `lang="kk"`},
+		{url: "/rank?lang=ru", wantText: "стоимость (33%) и климат (67%)"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.header != "" {
+			req.Header.Set("Accept-Language", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		mux := http.NewServeMux()
+		mux.Handle("/by-cost", citiesHandler{"cost"})
+		mux.HandleFunc("/city/", cityHandler)
+		mux.HandleFunc("/rank", rankHandler)
+		mux.ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("GET %v in %q: expected %q in:\n%v", tc.url, tc.header, tc.wantText, rec.Body.String())
+		}
+	}
+}
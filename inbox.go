@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// inboxMessage is a message a visitor sent on the talk page.
+	inboxMessage struct {
+		ID         string    `json:"id"`
+		Token      string    `json:"token"` // for the visitor's link to the conversation
+		Username   string    `json:"username"`
+		Email      string    `json:"email,omitempty"` // to reply to, if they gave one
+		Text       string    `json:"text"`
+		IP         string    `json:"ip"`
+		CreatedAt  time.Time `json:"created_at"`
+		Deliveries []string  `json:"deliveries,omitempty"` // the outbox entries that tell Aruna about it
+		Thread     string    `json:"thread,omitempty"`     // the Slack thread it started
+		Handled    bool      `json:"handled,omitempty"`
+		HandledBy  string    `json:"handled_by,omitempty"`
+		Replies    []reply   `json:"replies,omitempty"`
+	}
+
+	// reply is an answer from an admin to a message, or more from the
+	// visitor who sent it.
+	reply struct {
+		Text        string    `json:"text"`
+		By          string    `json:"by"`
+		At          time.Time `json:"at"`
+		Delivery    string    `json:"delivery,omitempty"`     // the outbox entry that sends it
+		FromVisitor bool      `json:"from_visitor,omitempty"` // true for more from the visitor
+		SlackTS     string    `json:"slack_ts,omitempty"`     // the Slack message, for answers in the thread
+	}
+
+	// inboxStore keeps the messages of visitors.
+	inboxStore struct {
+		mu       sync.Mutex
+		file     string // where the messages are saved, or "" to not save them
+		messages []*inboxMessage
+	}
+
+	// inboxRow is a message on the admin page, with how its delivery went.
+	inboxRow struct {
+		inboxMessage
+		Delivery string // e.g. "sent" or "pending over slack: slack is down"
+		Replies  []replyRow
+	}
+
+	// replyRow is a reply on the admin page, with how its delivery went.
+	replyRow struct {
+		reply
+		Delivery string
+	}
+
+	// inboxPage is the data for the admin page of messages.
+	inboxPage struct {
+		Title    string
+		Query    string
+		Messages []inboxRow
+	}
+)
+
+// Inbox has the messages of visitors, they are only saved once main sets up the store.
+var Inbox = &inboxStore{}
+
+// newInboxStore returns an inbox that saves the messages in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newInboxStore(file string) (*inboxStore, error) {
+	s := &inboxStore{file: file}
+	if err := loadJSON(file, &s.messages); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the messages in %v: %v", file, err)
+	}
+	return s, nil
+}
+
+// save writes the messages to the file, the caller must hold the lock.
+func (s *inboxStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	return saveJSON(s.file, s.messages)
+}
+
+// add keeps a new message.
+func (s *inboxStore) add(m *inboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = randomID(8)
+	m.Token = randomID(16)
+	m.CreatedAt = time.Now()
+	s.messages = append(s.messages, m)
+	return s.save()
+}
+
+// find returns the message with the id, the caller must hold the lock.
+func (s *inboxStore) find(id string) (*inboxMessage, error) {
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no message %q", id)
+}
+
+// update changes the message with the id and saves it, leaving it as it
+// was if the change or the save fails.
+func (s *inboxStore) update(id string, change func(m *inboxMessage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	before := *m
+	before.Replies = append([]reply(nil), m.Replies...)
+	before.Deliveries = append([]string(nil), m.Deliveries...)
+	if err := change(m); err != nil {
+		*m = before
+		return err
+	}
+	if err := s.save(); err != nil {
+		*m = before
+		return err
+	}
+	return nil
+}
+
+// remove deletes the message with the id.
+func (s *inboxStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []*inboxMessage{}
+	for _, m := range s.messages {
+		if m.ID != id {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == len(s.messages) {
+		return fmt.Errorf("no message %q", id)
+	}
+	s.messages = kept
+	return s.save()
+}
+
+// search returns the messages with the query in their username, email or
+// text, ignoring case, the latest first. All messages match an empty query.
+func (s *inboxStore) search(query string) []inboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query = strings.ToLower(strings.TrimSpace(query))
+	found := []inboxMessage{}
+	for _, m := range s.messages {
+		if strings.Contains(strings.ToLower(m.Username+"\n"+m.Email+"\n"+m.Text), query) {
+			found = append(found, *m)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].CreatedAt.After(found[j].CreatedAt) })
+	return found
+}
+
+// deliveryStatus returns how the outbox entries are doing, e.g. "sent" when
+// they all were, or the error of the ones that aren't sent yet.
+//
+// Sent entries are forgotten by the outbox after a while, so entries it
+// doesn't have anymore were sent.
+func deliveryStatus(ids ...string) string {
+	if len(ids) == 0 {
+		return "not sent"
+	}
+	problems := []string{}
+	for _, id := range ids {
+		e, ok := Outbox.status(id)
+		if !ok || e.Status == sentDelivery {
+			continue
+		}
+		problem := e.Status + " over " + e.Channel
+		if e.LastError != "" {
+			problem += ": " + e.LastError
+		}
+		problems = append(problems, problem)
+	}
+	if len(problems) == 0 {
+		return sentDelivery
+	}
+	return strings.Join(problems, "; ")
+}
+
+// replyTo emails the reply to the visitor who sent the message with the id.
+//
+// The error is not nil if emails can't be sent, rather than keeping a reply
+// that never goes anywhere. The email is only queued once the reply is
+// saved, so a failed save sends nothing.
+func (s *inboxStore) replyTo(id, text, admin string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("the reply is empty")
+	}
+	if _, ok := Outbox.notifiers["email"]; !ok {
+		return fmt.Errorf("no email is set up for replies, set CITIES_SMTP_ADDR")
+	}
+	var n notification
+	i := 0 // of the reply, replies are only ever added
+	if err := s.update(id, func(m *inboxMessage) error {
+		if m.Email == "" {
+			return fmt.Errorf("%v didn't give an email", m.Username)
+		}
+		quoted := "> " + strings.Replace(m.Text, "\n", "\n> ", -1)
+		n = notification{To: m.Email, Subject: "Re: your message to cities", Text: text + "\n\n" + quoted}
+		i = len(m.Replies)
+		m.Replies = append(m.Replies, reply{Text: text, By: admin, At: time.Now()})
+		m.Handled, m.HandledBy = true, admin
+		return nil
+	}); err != nil {
+		return err
+	}
+	e, err := Outbox.enqueue("email", n)
+	if err != nil {
+		return fmt.Errorf("the reply is kept, but can't be sent: %v", err)
+	}
+	return s.update(id, func(m *inboxMessage) error {
+		m.Replies[i].Delivery = e.ID
+		return nil
+	})
+}
+
+// inboxHandler shows the messages of visitors to admins, searched with ?q=,
+// and lets them mark them handled, reply or delete them.
+func inboxHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method == "POST" {
+		id, admin := r.PostFormValue("id"), adminName(r)
+		var err error
+		switch action := r.PostFormValue("action"); action {
+		case "handle":
+			err = Inbox.update(id, func(m *inboxMessage) error {
+				m.Handled, m.HandledBy = true, admin
+				return nil
+			})
+		case "unhandle":
+			err = Inbox.update(id, func(m *inboxMessage) error {
+				m.Handled, m.HandledBy = false, ""
+				return nil
+			})
+		case "reply":
+			err = Inbox.replyTo(id, r.PostFormValue("reply"), admin)
+		case "delete":
+			err = Inbox.remove(id)
+		default:
+			err = fmt.Errorf("no action %q", action)
+		}
+		if err != nil {
+			log.Printf("Bozhechki, I can't do that: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Madam or Siree, %v\n", err)
+			return
+		}
+		log.Printf("Sirree %v did %v message %v\n", admin, r.PostFormValue("action"), id)
+		http.Redirect(w, r, "/admin/messages?q="+url.QueryEscape(r.PostFormValue("q")), http.StatusFound)
+		return
+	}
+	if r.Method != "GET" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	p := inboxPage{Title: "Messages", Query: r.URL.Query().Get("q")}
+	for _, m := range Inbox.search(p.Query) {
+		row := inboxRow{inboxMessage: m, Delivery: deliveryStatus(m.Deliveries...)}
+		for _, re := range m.Replies {
+			row.Replies = append(row.Replies, replyRow{re, deliveryStatus(re.Delivery)})
+		}
+		p.Messages = append(p.Messages, row)
+	}
+	render(w, languages[0].Tag, "html/admin_messages.html.tmpl", p)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInboxStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "messages.json")
+	s, err := newInboxStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newInboxStore() failed: %v", err)
+	}
+	anna := &inboxMessage{Username: "anna", Email: "anna@example.com", Text: "Please add Oslo", IP: "127.0.0.1"}
+	bob := &inboxMessage{Username: "bob", Text: "Deviltown is too hot"}
+	spam := &inboxMessage{Username: "spam", Text: "Buy now"}
+	s.add(anna)
+	s.add(bob)
+	s.add(spam)
+	s.update(anna.ID, func(m *inboxMessage) error {
+		m.Handled = true
+		return nil
+	})
+	if err := s.remove(spam.ID); err != nil {
+		t.Errorf("Oibai, remove() failed: %v", err)
+	}
+	if err := s.remove(spam.ID); err == nil {
+		t.Errorf("remove() of a message we don't have should fail")
+	}
+
+	reloaded, err := newInboxStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newInboxStore() failed to reload: %v", err)
+	}
+	type testCase struct {
+		query string
+		want  string
+	}
+	cases := []testCase{
+		{query: "", want: "bob, anna"},
+		{query: "OSLO", want: "anna"},
+		{query: "example.com", want: "anna"},
+		{query: "bob", want: "bob"},
+		{query: "buy", want: ""},
+	}
+	for _, tc := range cases {
+		names := []string{}
+		for _, m := range reloaded.search(tc.query) {
+			names = append(names, m.Username)
+		}
+		if got := strings.Join(names, ", "); got != tc.want {
+			t.Errorf("search(%q) = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+	if got := reloaded.search("anna"); !got[0].Handled || got[0].IP != "127.0.0.1" {
+		t.Errorf("Expected anna's message to be handled, got %+v", got[0])
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	defer func(o *outbox) { Outbox = o }(Outbox)
+	Outbox = newOutbox("", map[string]notifier{"slack": &fakeNotifier{}, "email": &fakeNotifier{err: errors.New("no mail today")}})
+	slack, _ := Outbox.enqueue("slack", notification{Text: "Hej!"})
+	email, _ := Outbox.enqueue("email", notification{To: "aruna@example.com", Text: "Hej!"})
+	Outbox.deliver()
+
+	type testCase struct {
+		ids  []string
+		want string
+	}
+	cases := []testCase{
+		{ids: nil, want: "not sent"},
+		{ids: []string{slack.ID}, want: "sent"},
+		{ids: []string{"forgotten"}, want: "sent"},
+		{ids: []string{slack.ID, email.ID}, want: "pending over email: no mail today"},
+	}
+	for _, tc := range cases {
+		if got := deliveryStatus(tc.ids...); got != tc.want {
+			t.Errorf("deliveryStatus(%v) = %q, want %q", tc.ids, got, tc.want)
+		}
+	}
+}
+
+func TestInboxStore_replyTo(t *testing.T) {
+	defer func(o *outbox) { Outbox = o }(Outbox)
+	Outbox = newOutbox("", map[string]notifier{"slack": &fakeNotifier{}})
+	s := &inboxStore{}
+	anna := &inboxMessage{Username: "anna", Email: "anna@example.com", Text: "Please add Oslo"}
+	s.add(anna)
+	if err := s.replyTo(anna.ID, "Done, enjoy!", "aruna"); err == nil || !strings.Contains(err.Error(), "no email is set up") {
+		t.Errorf("Expected the reply to be refused without email, got %v", err)
+	}
+	if got := s.search(""); len(got[0].Replies) != 0 || got[0].Handled || len(Outbox.entries) != 0 {
+		t.Errorf("Expected no reply to be kept or queued, got %+v and %+v", got[0], Outbox.entries)
+	}
+
+	// A reply that can't be saved isn't sent either.
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	Outbox = newOutbox("", map[string]notifier{"email": &fakeNotifier{}})
+	s.file = filepath.Join(blocker, "messages.json")
+	if err := s.replyTo(anna.ID, "Done, enjoy!", "aruna"); err == nil {
+		t.Errorf("Expected the reply to fail when it can't be saved")
+	}
+	if got := s.search(""); len(got[0].Replies) != 0 || got[0].Handled || len(Outbox.entries) != 0 {
+		t.Errorf("Expected no reply to be kept or queued, got %+v and %+v", got[0], Outbox.entries)
+	}
+}
+
+func TestInboxHandler(t *testing.T) {
+	defer func(o *outbox, i *inboxStore) { Outbox, Inbox = o, i }(Outbox, Inbox)
+	email := &fakeNotifier{}
+	Outbox = newOutbox("", map[string]notifier{"email": email})
+	Inbox = &inboxStore{}
+	anna := &inboxMessage{Username: "anna", Email: "anna@example.com", Text: "Please add Oslo"}
+	bob := &inboxMessage{Username: "bob", Text: "Deviltown is too hot"}
+	Inbox.add(anna)
+	Inbox.add(bob)
+
+	type testCase struct {
+		form     url.Values
+		wantCode int
+	}
+	cases := []testCase{
+		{form: url.Values{"id": {bob.ID}, "action": {"handle"}}, wantCode: http.StatusFound},
+		{form: url.Values{"id": {anna.ID}, "action": {"reply"}, "reply": {"Done, enjoy!"}}, wantCode: http.StatusFound},
+		{form: url.Values{"id": {anna.ID}, "action": {"reply"}, "reply": {" "}}, wantCode: http.StatusBadRequest},
+		{form: url.Values{"id": {bob.ID}, "action": {"reply"}, "reply": {"Cool it"}}, wantCode: http.StatusBadRequest},
+		{form: url.Values{"id": {"nope"}, "action": {"handle"}}, wantCode: http.StatusBadRequest},
+		{form: url.Values{"id": {bob.ID}, "action": {"frame"}}, wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/admin/messages", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("aruna", "")
+		rec := httptest.NewRecorder()
+		inboxHandler(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("POST %v: expected %v, got %v: %v", tc.form, tc.wantCode, rec.Code, rec.Body.String())
+		}
+	}
+	Outbox.deliver()
+	if len(email.sent) != 1 || email.sent[0].To != "anna@example.com" || email.sent[0].Text != "Done, enjoy!\n\n> Please add Oslo" {
+		t.Errorf("Expected a reply to anna, got %+v", email.sent)
+	}
+
+	rec := httptest.NewRecorder()
+	inboxHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/messages", nil))
+	for _, want := range []string{"bob (handled by aruna)", "anna &lt;anna@example.com&gt; (handled by aruna)", "aruna replied", "Done, enjoy!"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q on the admin page:\n%v", want, rec.Body.String())
+		}
+	}
+	rec = httptest.NewRecorder()
+	inboxHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/messages?q=deviltown", nil))
+	if strings.Contains(rec.Body.String(), "Please add Oslo") || !strings.Contains(rec.Body.String(), "Deviltown is too hot") {
+		t.Errorf("Expected only bob's message:\n%v", rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/messages", strings.NewReader("action=unhandle&id="+anna.ID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	inboxHandler(httptest.NewRecorder(), req)
+	if got, _ := Inbox.byToken(anna.Token); got.Handled || got.HandledBy != "" {
+		t.Errorf("Expected anna's message to be handled by nobody, got %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/messages", strings.NewReader("action=delete&q=x&id="+bob.ID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	inboxHandler(rec, req)
+	if rec.Header().Get("Location") != "/admin/messages?q=x" || len(Inbox.search("")) != 1 {
+		t.Errorf("Expected bob's message to be deleted, got %v to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// submission is a city a visitor entered, which an admin has to approve
+	// before it's shown to everyone.
+	submission struct {
+		ID          string     `json:"id"`
+		City        cityRecord `json:"city"`
+		Submitter   string     `json:"submitter"` // the visitor id
+		IP          string     `json:"ip"`
+		SubmittedAt time.Time  `json:"submitted_at"`
+		Status      string     `json:"status"` // pending, approved or rejected
+		Reason      string     `json:"reason,omitempty"`
+		DecidedBy   string     `json:"decided_by,omitempty"`
+		DecidedAt   time.Time  `json:"decided_at"`
+	}
+
+	// moderationStore keeps the submitted cities.
+	moderationStore struct {
+		mu          sync.Mutex
+		file        string // where the submissions are saved, or "" to not save them
+		submissions []*submission
+	}
+
+	// option is a choice in a select, e.g. a cost.
+	option struct {
+		Value       int
+		Description string
+	}
+
+	// moderationPage is the data for the admin page of submitted cities.
+	moderationPage struct {
+		Title    string
+		Pending  []submission
+		Decided  []submission
+		Costs    []option
+		Climates []option
+	}
+)
+
+const (
+	pendingStatus  = "pending"
+	approvedStatus = "approved"
+	rejectedStatus = "rejected"
+)
+
+// Moderation has the submitted cities, they are only saved once main sets up the store.
+var Moderation = &moderationStore{}
+
+// newModerationStore returns a moderation store that saves the submissions in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newModerationStore(file string) (*moderationStore, error) {
+	s := &moderationStore{file: file}
+	if err := loadJSON(file, &s.submissions); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the submissions in %v: %v", file, err)
+	}
+	return s, nil
+}
+
+// save writes the submissions to the file, the caller must hold the lock.
+func (s *moderationStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	return saveJSON(s.file, s.submissions)
+}
+
+// find returns the submission with the id, the caller must hold the lock.
+func (s *moderationStore) find(id string) (*submission, error) {
+	for _, sub := range s.submissions {
+		if sub.ID == id {
+			return sub, nil
+		}
+	}
+	return nil, fmt.Errorf("no submission %q", id)
+}
+
+// submit adds a city to the queue for review.
+//
+// The error is not nil if the city already exists or is waiting for review.
+func (s *moderationStore) submit(c city, visitor, ip string) (*submission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.add(c, visitor, ip)
+	if err != nil {
+		return nil, err
+	}
+	return sub, s.save()
+}
+
+// submitAll adds the cities to the queue for review, saving them only once
+// since there may be thousands, e.g. from an import.
+//
+// It returns how many were added and why the others weren't.
+func (s *moderationStore) submitAll(cs cities, visitor, ip string) (int, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := 0
+	errs := []error{}
+	for _, c := range cs {
+		if _, err := s.add(c, visitor, ip); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		added++
+	}
+	if added > 0 {
+		if err := s.save(); err != nil {
+			return 0, append(errs, err)
+		}
+	}
+	return added, errs
+}
+
+// add adds a city to the queue without saving it, the caller must hold the lock.
+//
+// The error is not nil if the city isn't valid, already exists or is waiting for review.
+func (s *moderationStore) add(c city, visitor, ip string) (*submission, error) {
+	c, err := validateCity(c)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", c.name, err)
+	}
+	cs := allCities()
+	if i := cs.indexFold(c.name); i >= 0 {
+		return nil, fmt.Errorf("we already have %v", cs[i].name)
+	}
+	for _, sub := range s.submissions {
+		if sub.Status == pendingStatus && strings.EqualFold(sub.City.Name, c.name) {
+			return nil, fmt.Errorf("%v is already waiting for review", c.name)
+		}
+	}
+	sub := &submission{
+		ID:          randomID(8),
+		City:        c.record(),
+		Submitter:   visitor,
+		IP:          ip,
+		SubmittedAt: time.Now(),
+		Status:      pendingStatus,
+	}
+	s.submissions = append(s.submissions, sub)
+	return sub, nil
+}
+
+// edit changes a pending submission.
+func (s *moderationStore) edit(id string, c city) error {
+	c, err := validateCity(c)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if sub.Status != pendingStatus {
+		return fmt.Errorf("submission %v is already %v", id, sub.Status)
+	}
+	sub.City = c.record()
+	return s.save()
+}
+
+// approve adds the city of a pending submission, as edited by the admin, to the cities.
+func (s *moderationStore) approve(id string, c city, admin string) error {
+	if c.cost.String() == "" || c.climate.String() == "" || c.population <= 0 {
+		return fmt.Errorf("%v needs a population, cost and climate before it can be approved", c.name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if sub.Status != pendingStatus {
+		return fmt.Errorf("submission %v is already %v", id, sub.Status)
+	}
+	if err := addCity(c, admin); err != nil {
+		return err
+	}
+	sub.City = c.record()
+	sub.Status = approvedStatus
+	sub.DecidedBy = admin
+	sub.DecidedAt = time.Now()
+	return s.save()
+}
+
+// reject turns down a pending submission for the given reason.
+func (s *moderationStore) reject(id, reason, admin string) error {
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("need a reason to reject a city")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if sub.Status != pendingStatus {
+		return fmt.Errorf("submission %v is already %v", id, sub.Status)
+	}
+	sub.Status = rejectedStatus
+	sub.Reason = reason
+	sub.DecidedBy = admin
+	sub.DecidedAt = time.Now()
+	return s.save()
+}
+
+// list returns copies of the pending submissions, oldest first, and of the
+// decided ones, most recent first, so that they can be read without the lock.
+func (s *moderationStore) list() (pending, decided []submission) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.submissions {
+		if sub.Status == pendingStatus {
+			pending = append(pending, *sub)
+		} else {
+			decided = append(decided, *sub)
+		}
+	}
+	sort.SliceStable(decided, func(i, j int) bool { return decided[i].DecidedAt.After(decided[j].DecidedAt) })
+	return pending, decided
+}
+
+// costOptions returns all costs for a select.
+func costOptions() []option {
+	opts := []option{}
+	for c := CheapCost; c <= VeryExpensiveCost; c++ {
+		opts = append(opts, option{int(c), c.String()})
+	}
+	return opts
+}
+
+// climateOptions returns all climates for a select.
+func climateOptions() []option {
+	opts := []option{}
+	for c := NastyClimate; c <= PerfectClimate; c++ {
+		opts = append(opts, option{int(c), c.String()})
+	}
+	return opts
+}
+
+// cityFromForm returns the city in the form of the index or admin page,
+// normalized and validated with validateCity.
+//
+// Only the name is required, the rest are zero if left empty. The error is
+// fieldErrors, with everything that is wrong with the form.
+func cityFromForm(r *http.Request) (city, error) {
+	c := city{
+		name:    r.PostFormValue("cityname"),
+		country: r.PostFormValue("citycountry"),
+		region:  r.PostFormValue("cityregion"),
+	}
+	errs := fieldErrors{}
+	ints := []struct {
+		field, message string
+		v              *int
+	}{
+		{"citypopulation", "The population must be a whole number.", &c.population},
+		{"citycost", "Pick a cost from the list.", (*int)(&c.cost)},
+		{"cityclimate", "Pick a climate from the list.", (*int)(&c.climate)},
+	}
+	for _, f := range ints {
+		s := strings.TrimSpace(r.PostFormValue(f.field))
+		if s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			errs.add(strings.TrimPrefix(f.field, "city"), f.message)
+			continue
+		}
+		*f.v = i
+	}
+	floats := []struct {
+		field, message string
+		v              *float64
+	}{
+		{"citylat", "The latitude must be between -90 and 90.", &c.lat},
+		{"citylon", "The longitude must be between -180 and 180.", &c.lon},
+	}
+	for _, f := range floats {
+		s := strings.TrimSpace(r.PostFormValue(f.field))
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			errs.add(strings.TrimPrefix(f.field, "city"), f.message)
+			continue
+		}
+		*f.v = v
+	}
+	c, err := validateCity(c)
+	if err != nil {
+		errs = append(errs, err.(fieldErrors)...)
+	}
+	if len(errs) > 0 {
+		return city{}, errs
+	}
+	return c, nil
+}
+
+// moderationHandler shows the submitted cities to admins, and lets them
+// approve, edit or reject the pending ones.
+func moderationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method == "POST" {
+		if err := moderate(r); err != nil {
+			log.Printf("Bozhechki, I can't do that: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Madam or Siree, %v\n", err)
+			return
+		}
+		http.Redirect(w, r, "/admin/cities", http.StatusFound)
+		return
+	}
+	if r.Method != "GET" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	pending, decided := Moderation.list()
+	render(w, languages[0].Tag, "html/admin_cities.html.tmpl", moderationPage{
+		Title:    "Submitted cities",
+		Pending:  pending,
+		Decided:  decided,
+		Costs:    costOptions(),
+		Climates: climateOptions(),
+	})
+}
+
+// moderate does what the admin asked for in the form.
+func moderate(r *http.Request) error {
+	id := r.PostFormValue("id")
+	admin := adminName(r)
+	switch action := r.PostFormValue("action"); action {
+	case "reject":
+		log.Printf("Sirree %v rejected submission %v\n", admin, id)
+		return Moderation.reject(id, r.PostFormValue("reason"), admin)
+	case "save", "approve":
+		c, err := cityFromForm(r)
+		if err != nil {
+			return err
+		}
+		if action == "save" {
+			return Moderation.edit(id, c)
+		}
+		log.Printf("Hurray, %v approved %v\n", admin, c.name)
+		return Moderation.approve(id, c, admin)
+	default:
+		return fmt.Errorf("no action %q", action)
+	}
+}
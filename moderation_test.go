@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestModerationStore(t *testing.T) {
+	defer func(cs cities) { setCities(cs) }(allCities())
+	s := &moderationStore{}
+
+	oslo := city{name: "Oslo", population: 709037, cost: ExpensiveCost, climate: PoorClimate}
+	sub, err := s.submit(oslo, "visitor", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Oibai, submit() failed: %v", err)
+	}
+	if _, err := s.submit(city{name: "oslo"}, "visitor", "127.0.0.1"); err == nil {
+		t.Errorf("submit() of a city waiting for review should fail")
+	}
+	if _, err := s.submit(city{name: "Barcelona"}, "visitor", "127.0.0.1"); err == nil {
+		t.Errorf("submit() of a city we already have should fail")
+	}
+	if _, ok := allCities().find("Oslo"); ok {
+		t.Errorf("Oslo shouldn't be public before it is approved")
+	}
+	listed, _ := s.list()
+	if err := s.edit(sub.ID, city{name: "Kristiania"}); err != nil {
+		t.Fatalf("Oibai, edit() failed: %v", err)
+	}
+	if listed[0].City.Name != "Oslo" {
+		t.Errorf("Expected list() to return copies, got %v after an edit", listed[0].City.Name)
+	}
+	if err := s.reject(sub.ID, " ", "aruna"); err == nil {
+		t.Errorf("reject() without a reason should fail")
+	}
+	if err := s.approve(sub.ID, city{name: "Oslo"}, "aruna"); err == nil {
+		t.Errorf("approve() without a cost and climate should fail")
+	}
+	if err := s.approve(sub.ID, oslo, "aruna"); err != nil {
+		t.Fatalf("Oibai, approve() failed: %v", err)
+	}
+	if _, ok := allCities().find("Oslo"); !ok {
+		t.Errorf("Expected Oslo to be public once approved")
+	}
+	if err := s.reject(sub.ID, "too cold", "aruna"); err == nil {
+		t.Errorf("reject() of an approved city should fail")
+	}
+	pending, decided := s.list()
+	if len(pending) != 0 || len(decided) != 1 || decided[0].DecidedBy != "aruna" {
+		t.Errorf("Unexpected submissions: pending %v, decided %v", pending, decided)
+	}
+}
+
+func TestAddCityHandler(t *testing.T) {
+	defer func(m *moderationStore) { Moderation = m }(Moderation)
+	Moderation = &moderationStore{}
+
+	form := url.Values{"cityname": {"Reykjavik"}, "citypopulation": {"131136"}}
+	req := httptest.NewRequest(http.MethodPost, "/city", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	addCityHandler(rec, req)
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "waiting for review") {
+		t.Errorf("Expected to be told Reykjavik is waiting for review, got %v:\n%v", rec.Code, rec.Body.String())
+	}
+	if _, ok := allCities().find("Reykjavik"); ok {
+		t.Errorf("Reykjavik shouldn't be public before it is approved")
+	}
+}
+
+func TestModerationHandler_admin(t *testing.T) {
+	defer func(p string) { AdminPassword = p }(AdminPassword)
+	AdminPassword = "sekret"
+	h := requireAdmin(moderationHandler)
+
+	type testCase struct {
+		method   string
+		pass     string
+		origin   string
+		referer  string
+		wantCode int
+	}
+	cases := []testCase{
+		{method: http.MethodGet, pass: "", wantCode: http.StatusUnauthorized},
+		{method: http.MethodGet, pass: "guess", wantCode: http.StatusUnauthorized},
+		{method: http.MethodGet, pass: "sekret", wantCode: http.StatusOK},
+		{method: http.MethodPost, pass: "sekret", origin: "https://evil.example", wantCode: http.StatusForbidden},
+		{method: http.MethodPost, pass: "sekret", referer: "https://evil.example/admin/cities", wantCode: http.StatusForbidden},
+		{method: http.MethodPost, pass: "sekret", origin: "null", wantCode: http.StatusForbidden},
+		{method: http.MethodPost, pass: "sekret", wantCode: http.StatusForbidden},
+		// Our own form gets through, to fail on the missing submission.
+		{method: http.MethodPost, pass: "sekret", origin: "http://example.com", wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, pass: "sekret", referer: "http://example.com/admin/cities", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, "/admin/cities", strings.NewReader("id=nope&action=approve"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.pass != "" {
+			req.SetBasicAuth("aruna", tc.pass)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.referer != "" {
+			req.Header.Set("Referer", tc.referer)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v with password %q from %q: expected status %v, got %v", tc.method, tc.pass, tc.origin+tc.referer, tc.wantCode, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// format is a way to write out a list of cities.
+	format struct {
+		name      string // for ?format=, e.g. "csv"
+		mediaType string // for Accept, e.g. "text/csv"
+	}
+
+	// accepted is an item of an Accept or Accept-Language header with its quality.
+	accepted struct {
+		value string // e.g. "text/html" or "ru-RU"
+		q     float64
+	}
+
+	// cityJSON is a city in a ranking, as JSON.
+	cityJSON struct {
+		Rank       int     `json:"rank"`
+		Name       string  `json:"name"`
+		Country    string  `json:"country,omitempty"`
+		Region     string  `json:"region,omitempty"`
+		Population int     `json:"population"`
+		Cost       string  `json:"cost"`
+		Climate    string  `json:"climate"`
+		Lat        float64 `json:"lat"`
+		Lon        float64 `json:"lon"`
+		Value      float64 `json:"value"` // what the cities are ranked by
+	}
+)
+
+// formats are the formats the ranking pages come in, the first is the default.
+var formats = []format{
+	{"html", "text/html"},
+	{"text", "text/plain"},
+	{"json", "application/json"},
+	{"csv", "text/csv"},
+}
+
+// parseAccept returns the items of an Accept or Accept-Language header, the
+// ones with the highest quality first.
+//
+// Items with a quality of 0 are left out, since the client doesn't want them.
+func parseAccept(header string) []accepted {
+	items := []accepted{}
+	for _, a := range acceptItems(header) {
+		if a.q > 0 {
+			items = append(items, a)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].q > items[j].q })
+	return items
+}
+
+// acceptItems returns all the items of an Accept or Accept-Language header,
+// in the order they come in.
+func acceptItems(header string) []accepted {
+	items := []accepted{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		a := accepted{value: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		if a.value == "" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					a.q = v
+				}
+			}
+		}
+		items = append(items, a)
+	}
+	return items
+}
+
+// matches returns true if the media range of an Accept header, e.g.
+// "text/*", includes the media type.
+func matches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") &&
+		strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// quality returns how much the items of an Accept header want the media
+// type, as the most specific media range that includes it says, and how
+// specific that is: 2 for the media type itself, 1 for e.g. "text/*", 0 for
+// "*/*" and -1 if no range includes it.
+func quality(items []accepted, mediaType string) (float64, int) {
+	q, specificity := 0.0, -1
+	for _, a := range items {
+		if !matches(a.value, mediaType) {
+			continue
+		}
+		s := 1
+		if a.value == mediaType {
+			s = 2
+		} else if a.value == "*/*" {
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = a.q, s
+		}
+	}
+	return q, specificity
+}
+
+// negotiateFormat returns the format the request asks for, with ?format=
+// first and then the Accept header: the one it wants most, and of those the
+// one it names most specifically.
+//
+// Clients that take anything, like curl with its "Accept: */*", get text,
+// since they are mostly read in a terminal. It returns false if the request
+// only asks for formats we don't have.
+func negotiateFormat(r *http.Request) (format, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return formatNamed(name)
+	}
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return formats[0], true
+	}
+	items := acceptItems(header)
+	best, bestQ, bestSpecificity := format{}, 0.0, -1
+	for _, f := range formats {
+		q, s := quality(items, f.mediaType)
+		if q > bestQ || q == bestQ && q > 0 && s > bestSpecificity {
+			best, bestQ, bestSpecificity = f, q, s
+		}
+	}
+	if bestQ == 0 {
+		return format{}, false
+	}
+	text, _ := formatNamed("text")
+	if q, _ := quality(items, text.mediaType); bestSpecificity == 0 && q == bestQ {
+		return text, true
+	}
+	return best, true
+}
+
+// formatNamed returns the format with the name, e.g. "csv", and false if we
+// don't have it.
+func formatNamed(name string) (format, bool) {
+	for _, f := range formats {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+// serveNotAcceptable tells the client which formats we have.
+func serveNotAcceptable(w http.ResponseWriter) {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = fmt.Sprintf("%s (?format=%s)", f.mediaType, f.name)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusNotAcceptable)
+	fmt.Fprintf(w, "Madam or Siree, I can only give you %v\n", strings.Join(names, ", "))
+}
+
+// toCitiesJSON returns the ranked cities as JSON.
+func toCitiesJSON(ranked []rankedCity) []cityJSON {
+	list := make([]cityJSON, len(ranked))
+	for i, rc := range ranked {
+		list[i] = cityJSON{
+			Rank:       rc.rank,
+			Name:       rc.name,
+			Country:    rc.country,
+			Region:     rc.region,
+			Population: rc.population,
+			Cost:       rc.cost.String(),
+			Climate:    rc.climate.String(),
+			Lat:        rc.lat,
+			Lon:        rc.lon,
+			Value:      rc.score,
+		}
+	}
+	return list
+}
+
+// writeCities writes the ranked cities in the format, which isn't HTML.
+func writeCities(w http.ResponseWriter, f format, ranked []rankedCity) {
+	w.Header().Set("Content-Type", f.mediaType+"; charset=utf-8")
+	switch f.name {
+	case "text":
+		cs := make(cities, len(ranked))
+		for i := range ranked {
+			cs[i] = ranked[i].city
+		}
+		fmt.Fprintln(w, cs)
+	case "json":
+		if err := json.NewEncoder(w).Encode(toCitiesJSON(ranked)); err != nil {
+			log.Printf("Oibai, I couldn't write the JSON: %v\n", err)
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"rank", "name", "country", "region", "population", "cost", "climate", "lat", "lon", "value"})
+		for _, rc := range ranked {
+			cw.Write([]string{
+				strconv.Itoa(rc.rank),
+				rc.name,
+				rc.country,
+				rc.region,
+				strconv.Itoa(rc.population),
+				rc.cost.String(),
+				rc.climate.String(),
+				strconv.FormatFloat(rc.lat, 'f', -1, 64),
+				strconv.FormatFloat(rc.lon, 'f', -1, 64),
+				strconv.FormatFloat(rc.score, 'g', -1, 64),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Oibai, I couldn't write the CSV: %v\n", err)
+		}
+	default:
+		log.Panicf("Oibai, I don't know how to write %q\n", f.name)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	type testCase struct {
+		url    string
+		accept string
+		want   string
+		wantOK bool
+	}
+	cases := []testCase{
+		{url: "/by-cost", want: "html", wantOK: true},
+		{url: "/by-cost", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: "html", wantOK: true},
+		{url: "/by-cost", accept: "*/*", want: "text", wantOK: true},
+		{url: "/by-cost", accept: "text/plain;q=0, */*", want: "html", wantOK: true},
+		{url: "/by-cost", accept: "*/*;q=0.5, text/html;q=0.1", want: "text", wantOK: true},
+		{url: "/by-cost", accept: "text/*, text/html", want: "html", wantOK: true},
+		{url: "/by-cost", accept: "text/*;q=0.9, text/csv", want: "csv", wantOK: true},
+		{url: "/by-cost", accept: "text/plain", want: "text", wantOK: true},
+		{url: "/by-cost", accept: "application/json", want: "json", wantOK: true},
+		{url: "/by-cost", accept: "text/html;q=0.5, text/csv", want: "csv", wantOK: true},
+		{url: "/by-cost", accept: "text/*;q=0.1, application/json;q=0.2", want: "json", wantOK: true},
+		{url: "/by-cost", accept: "image/png", wantOK: false},
+		{url: "/by-cost", accept: "text/html;q=0", wantOK: false},
+		{url: "/by-cost?format=csv", accept: "text/html", want: "csv", wantOK: true},
+		{url: "/by-cost?format=xml", wantOK: false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		got, ok := negotiateFormat(req)
+		if ok != tc.wantOK || got.name != tc.want {
+			t.Errorf("negotiateFormat(%v, Accept %q) = %q, %v, want %q, %v", tc.url, tc.accept, got.name, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestCitiesHandler_formats(t *testing.T) {
+	type testCase struct {
+		url             string
+		accept          string
+		wantCode        int
+		wantContentType string
+	}
+	cases := []testCase{
+		{url: "/by-climate", wantCode: http.StatusOK, wantContentType: "text/html"},
+		{url: "/by-climate", accept: "text/plain", wantCode: http.StatusOK, wantContentType: "text/plain; charset=utf-8"},
+		{url: "/by-climate", accept: "*/*", wantCode: http.StatusOK, wantContentType: "text/plain; charset=utf-8"},
+		{url: "/by-climate", accept: "application/json", wantCode: http.StatusOK, wantContentType: "application/json; charset=utf-8"},
+		{url: "/by-climate?format=csv", wantCode: http.StatusOK, wantContentType: "text/csv; charset=utf-8"},
+		{url: "/by-climate", accept: "application/pdf", wantCode: http.StatusNotAcceptable, wantContentType: "text/plain; charset=utf-8"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		citiesHandler{"climate"}.ServeHTTP(rec, req)
+
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v with Accept %q: expected status %v, got %v", tc.url, tc.accept, tc.wantCode, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.wantContentType) {
+			t.Errorf("GET %v with Accept %q: expected Content-Type %q, got %q", tc.url, tc.accept, tc.wantContentType, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept, Accept-Language, Cookie" {
+			t.Errorf("GET %v: expected Vary: Accept, Accept-Language, Cookie, got %q", tc.url, got)
+		}
+	}
+}
+
+func TestCitiesHandler_bodies(t *testing.T) {
+	get := func(url string) string {
+		rec := httptest.NewRecorder()
+		citiesHandler{"climate"}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Body.String()
+	}
+
+	text := get("/by-climate?format=text")
+	if !strings.HasPrefix(text, "  * Deviltown: 1233.6M, cost: very expensive, climate: nasty\n") {
+		t.Errorf("Expected the text to start with Deviltown, got:\n%v", text)
+	}
+
+	list := []cityJSON{}
+	if err := json.Unmarshal([]byte(get("/by-climate?format=json&near=Stockholm&within_km=1500")), &list); err != nil {
+		t.Fatalf("Oibai, the JSON doesn't parse: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "Copenhagen" || list[0].Rank != 1 || list[0].Value != float64(PoorClimate) {
+		t.Errorf("Unexpected cities near Stockholm: %+v", list)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(get("/by-climate?format=csv"))).ReadAll()
+	if err != nil {
+		t.Fatalf("Oibai, the CSV doesn't parse: %v", err)
+	}
+	if len(records) != len(allCities())+1 || records[0][1] != "name" || records[len(records)-1][1] != "Paradisio" {
+		t.Errorf("Unexpected CSV: %v", records)
+	}
+}
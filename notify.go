@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// notification is what we tell someone, e.g. Aruna about a message from a
+	// visitor, or a visitor about a city for their alert.
+	notification struct {
+		To          string `json:"to,omitempty"` // an email or Slack member id, for the channels that need one
+		Subject     string `json:"subject"`
+		Text        string `json:"text"`
+		Unsubscribe string `json:"unsubscribe,omitempty"` // a link to stop them, if they can
+		Thread      string `json:"thread,omitempty"`      // the Slack thread to answer in, if any
+		Ref         string `json:"ref,omitempty"`         // what it is about, e.g. "message:abc123"
+		Reply       bool   `json:"reply,omitempty"`       // goes in the Slack thread that what it is about started
+	}
+
+	// notifier sends notifications over a channel, e.g. Slack.
+	notifier interface {
+		notify(n notification) error
+	}
+
+	// receiptNotifier is a notifier that says where the notification went,
+	// e.g. the Slack message it became, so that answers find their way back.
+	receiptNotifier interface {
+		notifier
+		notifyReceipt(n notification) (string, error)
+	}
+
+	// slackWebhook posts to a Slack incoming webhook, like sendslack does.
+	slackWebhook struct {
+		url string
+	}
+
+	// jsonWebhook posts the notification as JSON to any url.
+	jsonWebhook struct {
+		url string
+	}
+
+	// emailNotifier sends a plain text email through an SMTP server.
+	emailNotifier struct {
+		addr     string // e.g. "smtp.example.com:587"
+		from     string
+		user     string // to log in with, if not ""
+		password string
+		to       string // for notifications that aren't to anyone in particular
+	}
+
+	// slackDM sends a Slack direct message to the member in the notification.
+	slackDM struct {
+		api   string // e.g. "https://slack.com/api"
+		token string
+	}
+
+	// slackThread posts to a Slack channel, in the thread of the
+	// notification if it has one, and says which message it became.
+	slackThread struct {
+		api     string
+		token   string
+		channel string // e.g. "C012AB3CD"
+	}
+
+	// outboxEntry is a notification waiting to be sent, sent or given up on.
+	outboxEntry struct {
+		ID           string       `json:"id"`
+		Channel      string       `json:"channel"` // the notifier, e.g. "slack"
+		Notification notification `json:"notification"`
+		Status       string       `json:"status"`
+		Attempts     int          `json:"attempts"`
+		NextAttempt  time.Time    `json:"next_attempt"`
+		LastError    string       `json:"last_error,omitempty"`
+		Receipt      string       `json:"receipt,omitempty"` // where it went, e.g. the Slack message
+		CreatedAt    time.Time    `json:"created_at"`
+		SentAt       time.Time    `json:"sent_at,omitempty"`
+	}
+
+	// outbox keeps the notifications until they are sent, so that nothing is
+	// lost while e.g. Slack is down, and tries again with exponential backoff.
+	outbox struct {
+		mu        sync.Mutex
+		file      string // where the outbox is saved, or "" to not save it
+		entries   []*outboxEntry
+		notifiers map[string]notifier
+		now       func() time.Time
+		kick      chan struct{}
+		receipts  func(e outboxEntry)     // is told where the notifications with a receipt went
+		threads   func(ref string) string // tells the thread of what a reply is about, once it has one
+	}
+)
+
+const (
+	pendingDelivery = "pending"
+	sentDelivery    = "sent"
+	failedDelivery  = "failed"
+
+	// firstRetry is how long to wait after the first failure, it doubles
+	// with every failure after that up to maxRetry.
+	firstRetry = 30 * time.Second
+	maxRetry   = 6 * time.Hour
+	// maxAttempts is how many times a notification is tried before it
+	// fails for good, about 14 and a half hours after the first try.
+	maxAttempts = 12
+	// keepSent is how long sent notifications are kept.
+	keepSent = 30 * 24 * time.Hour
+	// keepFailed is how long notifications that were given up on are kept,
+	// for an admin to see them.
+	keepFailed = 90 * 24 * time.Hour
+)
+
+// notifyClient is for the webhooks and Slack, so that a slow one doesn't hold up the outbox.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// smtpTimeout is how long an email can take, for the same reason.
+var smtpTimeout = 30 * time.Second
+
+// Outbox has the notifications to send, they are only saved once main sets up the outbox.
+var Outbox = newOutbox("", map[string]notifier{})
+
+// newOutbox returns an outbox that sends over the notifiers, by channel name.
+func newOutbox(file string, notifiers map[string]notifier) *outbox {
+	return &outbox{file: file, notifiers: notifiers, now: time.Now, kick: make(chan struct{}, 1)}
+}
+
+// loadOutbox returns an outbox that is saved in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func loadOutbox(file string, notifiers map[string]notifier) (*outbox, error) {
+	o := newOutbox(file, notifiers)
+	if err := loadJSON(file, &o.entries); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the outbox in %v: %v", file, err)
+	}
+	return o, nil
+}
+
+// configuredNotifiers returns the notifiers that are set up with environment
+// variables, see the README.
+func configuredNotifiers() map[string]notifier {
+	notifiers := map[string]notifier{}
+	if SlackWebhook != "" {
+		notifiers["slack"] = slackWebhook{SlackWebhook}
+	}
+	if NotifyWebhook != "" {
+		notifiers["webhook"] = jsonWebhook{NotifyWebhook}
+	}
+	if SMTPAddr != "" {
+		notifiers["email"] = emailNotifier{addr: SMTPAddr, from: SMTPFrom, user: SMTPUser, password: SMTPPassword, to: NotifyEmail}
+	}
+	if SlackToken != "" {
+		notifiers["slack-dm"] = slackDM{api: SlackAPI, token: SlackToken}
+	}
+	if SlackToken != "" && SlackChannel != "" {
+		notifiers["slack-thread"] = slackThread{api: SlackAPI, token: SlackToken, channel: SlackChannel}
+	}
+	return notifiers
+}
+
+// save writes the outbox to the file, the caller must hold the lock.
+func (o *outbox) save() error {
+	if o.file == "" {
+		return nil
+	}
+	return saveJSON(o.file, o.entries)
+}
+
+// enqueue saves the notification to be sent over the channel as soon as possible.
+//
+// A channel that isn't set up yet is tried like one that is down.
+func (o *outbox) enqueue(channel string, n notification) (*outboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := &outboxEntry{ID: randomID(8), Channel: channel, Notification: n, Status: pendingDelivery, NextAttempt: o.now(), CreatedAt: o.now()}
+	o.entries = append(o.entries, e)
+	if err := o.save(); err != nil {
+		return nil, err
+	}
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+	return e, nil
+}
+
+// deliver tries to send the notifications that are due, and returns how
+// many were sent.
+//
+// The notifiers are called without the lock, so that visitors don't wait
+// for a slow Slack.
+func (o *outbox) deliver() int {
+	o.mu.Lock()
+	due := []outboxEntry{}
+	for _, e := range o.entries {
+		if e.Status == pendingDelivery && !e.NextAttempt.After(o.now()) {
+			due = append(due, *e)
+		}
+	}
+	o.mu.Unlock()
+
+	errs := make([]error, len(due))
+	for i, e := range due {
+		// A reply may be sent before what it is about has started a thread,
+		// so the thread is only looked up now.
+		if e.Notification.Reply && e.Notification.Thread == "" && o.threads != nil {
+			e.Notification.Thread = o.threads(e.Notification.Ref)
+		}
+		switch n := o.notifiers[e.Channel].(type) {
+		case receiptNotifier:
+			due[i].Receipt, errs[i] = n.notifyReceipt(e.Notification)
+		case notifier:
+			errs[i] = n.notify(e.Notification)
+		default:
+			errs[i] = fmt.Errorf("no channel %q is set up", e.Channel)
+		}
+	}
+
+	o.mu.Lock()
+	sent := 0
+	receipts := []outboxEntry{}
+	for i, d := range due {
+		e := o.find(d.ID)
+		if e == nil {
+			continue
+		}
+		e.Attempts++
+		if errs[i] == nil {
+			e.Status, e.SentAt, e.LastError, e.Receipt = sentDelivery, o.now(), "", d.Receipt
+			if e.Receipt != "" {
+				receipts = append(receipts, *e)
+			}
+			sent++
+			continue
+		}
+		e.LastError = errs[i].Error()
+		if e.Attempts >= maxAttempts {
+			e.Status = failedDelivery
+			log.Printf("Bozhechki, I gave up on %v over %v after %v tries: %v\n", e.ID, e.Channel, e.Attempts, errs[i])
+			continue
+		}
+		e.NextAttempt = o.now().Add(backoff(e.Attempts))
+		log.Printf("Oibai, I couldn't send %v over %v, I'll try again at %v: %v\n", e.ID, e.Channel, e.NextAttempt.Format(time.RFC3339), errs[i])
+	}
+	kept := []*outboxEntry{}
+	for _, e := range o.entries {
+		switch {
+		case e.Status == sentDelivery && o.now().Sub(e.SentAt) >= keepSent:
+		case e.Status == failedDelivery && o.now().Sub(e.CreatedAt) >= keepFailed:
+		default:
+			kept = append(kept, e)
+		}
+	}
+	o.entries = kept
+	if len(due) > 0 {
+		if err := o.save(); err != nil {
+			log.Printf("Oibai, I can't save the outbox: %v\n", err)
+		}
+	}
+	o.mu.Unlock()
+
+	// Told without the lock, in case they want to send more.
+	if o.receipts != nil {
+		for _, e := range receipts {
+			o.receipts(e)
+		}
+	}
+	return sent
+}
+
+// find returns the entry with the id, the caller must hold the lock.
+func (o *outbox) find(id string) *outboxEntry {
+	for _, e := range o.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// status returns the entry with the id as it is now.
+func (o *outbox) status(id string) (outboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e := o.find(id); e != nil {
+		return *e, true
+	}
+	return outboxEntry{}, false
+}
+
+// failed returns the notifications that were given up on, the latest first.
+func (o *outbox) failed() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	failed := []outboxEntry{}
+	for _, e := range o.entries {
+		if e.Status == failedDelivery {
+			failed = append(failed, *e)
+		}
+	}
+	sort.SliceStable(failed, func(i, j int) bool { return failed[i].CreatedAt.After(failed[j].CreatedAt) })
+	return failed
+}
+
+// run delivers the notifications forever, as they come in and every interval
+// for the ones to try again.
+func (o *outbox) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		o.deliver()
+		select {
+		case <-t.C:
+		case <-o.kick:
+		}
+	}
+}
+
+// backoff returns how long to wait after the attempts failed.
+func backoff(attempts int) time.Duration {
+	d := firstRetry
+	for i := 1; i < attempts && d < maxRetry; i++ {
+		d *= 2
+	}
+	if d > maxRetry {
+		return maxRetry
+	}
+	return d
+}
+
+// postJSON posts v as JSON to the url, and returns the response body if the
+// status is 2xx.
+func postJSON(url string, v interface{}, header http.Header) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%v answered %v: %q", url, resp.Status, body)
+	}
+	return body, nil
+}
+
+// text returns the subject and text of the notification as one message.
+func (n notification) text() string {
+	if n.Subject == "" {
+		return n.Text
+	}
+	return n.Subject + "\n\n" + n.Text
+}
+
+// slackText returns the message for Slack, where what visitors write can't
+// become links or mentions.
+func (n notification) slackText() string {
+	return slackEscape(n.text())
+}
+
+func (s slackWebhook) notify(n notification) error {
+	body, err := postJSON(s.url, map[string]string{"text": n.slackText()}, nil)
+	if err != nil {
+		return err
+	}
+	if string(body) != "ok" {
+		return fmt.Errorf("slack says %q", body)
+	}
+	return nil
+}
+
+func (j jsonWebhook) notify(n notification) error {
+	_, err := postJSON(j.url, n, nil)
+	return err
+}
+
+func (s slackDM) notify(n notification) error {
+	if n.To == "" {
+		return fmt.Errorf("no Slack member to send %q to", n.Subject)
+	}
+	_, err := postSlack(s.api, s.token, map[string]string{"channel": n.To, "text": n.slackText()})
+	return err
+}
+
+func (s slackThread) notify(n notification) error {
+	_, err := s.notifyReceipt(n)
+	return err
+}
+
+// notifyReceipt returns the ts of the Slack message, which is also the id
+// of its thread.
+func (s slackThread) notifyReceipt(n notification) (string, error) {
+	if n.Reply && n.Thread == "" {
+		return "", fmt.Errorf("%v hasn't started a thread yet", n.Ref)
+	}
+	msg := map[string]string{"channel": s.channel, "text": n.slackText()}
+	if n.Thread != "" {
+		msg["thread_ts"] = n.Thread
+	}
+	return postSlack(s.api, s.token, msg)
+}
+
+// postSlack posts the message with chat.postMessage and returns its ts.
+func postSlack(api, token string, msg map[string]string) (string, error) {
+	body, err := postJSON(api+"/chat.postMessage", msg, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		return "", err
+	}
+	result := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		TS    string `json:"ts"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("slack answered %q: %v", body, err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("slack says %q", result.Error)
+	}
+	return result.TS, nil
+}
+
+func (e emailNotifier) notify(n notification) error {
+	to := n.To
+	if to == "" {
+		to = e.to
+	}
+	if to == "" {
+		return fmt.Errorf("no one to email %q to", n.Subject)
+	}
+	var auth smtp.Auth
+	if e.user != "" {
+		host, _, err := net.SplitHostPort(e.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", e.user, e.password, host)
+	}
+	headers := []string{
+		"From: " + e.from,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", n.Subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	if n.Unsubscribe != "" {
+		headers = append(headers, "List-Unsubscribe: <"+n.Unsubscribe+">")
+	}
+	msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Replace(n.Text, "\n", "\r\n", -1) + "\r\n"
+	return e.send(to, auth, []byte(msg))
+}
+
+// send sends the email like smtp.SendMail, but gives up after smtpTimeout
+// so that a mail server that doesn't answer doesn't hold up the outbox.
+func (e emailNotifier) send(to string, auth smtp.Auth, msg []byte) error {
+	if strings.ContainsAny(e.from+to, "\r\n") {
+		return fmt.Errorf("no new lines in the addresses, please")
+	}
+	host, _, err := net.SplitHostPort(e.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", e.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier remembers what it was asked to send, and fails while err isn't nil.
+type fakeNotifier struct {
+	err  error
+	sent []notification
+}
+
+func (f *fakeNotifier) notify(n notification) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, n)
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	type testCase struct {
+		attempts int
+		want     time.Duration
+	}
+	cases := []testCase{
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 5, want: 8 * time.Minute},
+		{attempts: 10, want: 256 * time.Minute},
+		{attempts: 11, want: 6 * time.Hour},
+		{attempts: 50, want: 6 * time.Hour},
+	}
+	for _, tc := range cases {
+		if got := backoff(tc.attempts); got != tc.want {
+			t.Errorf("backoff(%v) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "outbox.json")
+	slack := &fakeNotifier{err: errors.New("slack is down")}
+	o, err := loadOutbox(file, map[string]notifier{"slack": slack})
+	if err != nil {
+		t.Fatalf("Oibai, loadOutbox() failed: %v", err)
+	}
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+
+	e, _ := o.enqueue("slack", notification{Subject: "A message from anna", Text: "Hej!"})
+	lost, _ := o.enqueue("pigeon", notification{Text: "Coo"})
+	if sent := o.deliver(); sent != 0 {
+		t.Errorf("Expected nothing to be sent while Slack is down, %v were", sent)
+	}
+	got, _ := o.status(e.ID)
+	if got.Status != pendingDelivery || got.Attempts != 1 || got.LastError != "slack is down" || !got.NextAttempt.Equal(now.Add(30*time.Second)) {
+		t.Errorf("Expected a retry in 30s, got %+v", got)
+	}
+
+	now = now.Add(10 * time.Second)
+	o.deliver()
+	if got, _ := o.status(e.ID); got.Attempts != 1 {
+		t.Errorf("Expected no retry before it is due, got %v attempts", got.Attempts)
+	}
+
+	// Whatever happens, it is all in the file.
+	reloaded, err := loadOutbox(file, map[string]notifier{"slack": slack})
+	if err != nil {
+		t.Fatalf("Oibai, loadOutbox() failed to reload: %v", err)
+	}
+	reloaded.now = o.now
+	o = reloaded
+
+	slack.err = nil
+	now = now.Add(20 * time.Second)
+	if sent := o.deliver(); sent != 1 || len(slack.sent) != 1 || slack.sent[0].Text != "Hej!" {
+		t.Errorf("Expected the message to be sent once Slack is back, sent %v: %+v", sent, slack.sent)
+	}
+	if got, _ := o.status(e.ID); got.Status != sentDelivery || got.Attempts != 2 || got.LastError != "" {
+		t.Errorf("Expected the message to be sent on the second try, got %+v", got)
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		now = now.Add(maxRetry)
+		o.deliver()
+	}
+	failed := o.failed()
+	if len(failed) != 1 || failed[0].ID != lost.ID || failed[0].Attempts != maxAttempts || failed[0].LastError != `no channel "pigeon" is set up` {
+		t.Errorf("Expected the pigeon to fail after %v tries, got %+v", maxAttempts, failed)
+	}
+	now = now.Add(keepSent)
+	o.deliver()
+	if _, ok := o.status(e.ID); ok {
+		t.Errorf("Expected the sent message to be forgotten after %v", keepSent)
+	}
+	if _, ok := o.status(lost.ID); !ok {
+		t.Errorf("Expected the pigeon to be kept for an admin to see")
+	}
+	now = now.Add(keepFailed)
+	o.deliver()
+	if _, ok := o.status(lost.ID); ok {
+		t.Errorf("Expected the pigeon to be forgotten after %v", keepFailed)
+	}
+}
+
+func TestSlackWebhook(t *testing.T) {
+	got := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid_token"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	if err := (slackWebhook{ts.URL + "/ok"}).notify(notification{Subject: "A message from anna", Text: "Hej!"}); err != nil {
+		t.Errorf("Oibai, notify() failed: %v", err)
+	}
+	if got["text"] != "A message from anna\n\nHej!" {
+		t.Errorf("Unexpected Slack text %q", got["text"])
+	}
+	if err := (slackWebhook{ts.URL + "/ok"}).notify(notification{Subject: "A message from <!channel>", Text: "<https://evil.example|Barcelona> & co"}); err != nil {
+		t.Errorf("Oibai, notify() failed: %v", err)
+	}
+	if got["text"] != "A message from &lt;!channel&gt;\n\n&lt;https://evil.example|Barcelona&gt; &amp; co" {
+		t.Errorf("Expected what visitors write to be escaped, got %q", got["text"])
+	}
+	if err := (slackWebhook{ts.URL + "/broken"}).notify(notification{Text: "Hej!"}); err == nil || !strings.Contains(err.Error(), "invalid_token") {
+		t.Errorf("Expected Slack's error, got %v", err)
+	}
+}
+
+func TestJSONWebhook(t *testing.T) {
+	got := notification{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer ts.Close()
+	n := notification{To: "aruna", Subject: "A message from anna", Text: "Hej!"}
+	if err := (jsonWebhook{ts.URL}).notify(n); err != nil || got != n {
+		t.Errorf("Expected %+v to be posted, got %+v, %v", n, got, err)
+	}
+	if err := (jsonWebhook{ts.URL + "/broken"}).notify(n); err == nil {
+		t.Errorf("notify() should fail when the webhook does")
+	}
+}
+
+func TestSlackDM(t *testing.T) {
+	got := map[string]string{}
+	auth := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		if got["channel"] == "UBROKEN" {
+			w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+	dm := slackDM{api: ts.URL, token: "xoxb-secret"}
+	if err := dm.notify(notification{To: "U012AB3CD", Text: "Barcelona matches your alert."}); err != nil {
+		t.Fatalf("Oibai, notify() failed: %v", err)
+	}
+	if auth != "Bearer xoxb-secret" || got["channel"] != "U012AB3CD" || got["text"] != "Barcelona matches your alert." {
+		t.Errorf("Unexpected Slack message %v with %q", got, auth)
+	}
+	if err := dm.notify(notification{To: "UBROKEN", Text: "Hej!"}); err == nil || !strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("Expected Slack's error, got %v", err)
+	}
+	if err := dm.notify(notification{Text: "Hej!"}); err == nil {
+		t.Errorf("notify() without a member should fail")
+	}
+}
+
+func TestSlackThread(t *testing.T) {
+	got := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = map[string]string{}
+		json.NewDecoder(r.Body).Decode(&got)
+		if got["thread_ts"] == "broken" {
+			w.Write([]byte(`{"ok":false,"error":"thread_not_found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"ts":"1585742400.000100"}`))
+	}))
+	defer ts.Close()
+	s := slackThread{api: ts.URL, token: "xoxb-secret", channel: "C012AB3CD"}
+	receipt, err := s.notifyReceipt(notification{Subject: "A message from anna", Text: "Hej!"})
+	if err != nil || receipt != "1585742400.000100" || got["channel"] != "C012AB3CD" || got["thread_ts"] != "" {
+		t.Errorf("Expected a new thread, got %q, %v from %v", receipt, err, got)
+	}
+	if _, err := s.notifyReceipt(notification{Text: "More", Thread: receipt}); err != nil || got["thread_ts"] != receipt {
+		t.Errorf("Expected an answer in the thread, got %v from %v", err, got)
+	}
+	if err := s.notify(notification{Text: "Hej!", Thread: "broken"}); err == nil || !strings.Contains(err.Error(), "thread_not_found") {
+		t.Errorf("Expected Slack's error, got %v", err)
+	}
+}
+
+// fakeSMTP is a mail server that takes one email and sends what it got to the channel.
+func fakeSMTP(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		transcript := []string{}
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				got <- strings.Join(transcript, "\n")
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			transcript = append(transcript, line)
+			switch {
+			case inData && line == ".":
+				inData = false
+				conn.Write([]byte("250 OK\r\n"))
+			case inData:
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				conn.Write([]byte("250 localhost\r\n"))
+			case line == "DATA":
+				inData = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case line == "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				got <- strings.Join(transcript, "\n")
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestEmailNotifier(t *testing.T) {
+	addr, got := fakeSMTP(t)
+	e := emailNotifier{addr: addr, from: "cities@example.com", to: "aruna@example.com"}
+	n := notification{To: "anna@example.com", Subject: "En by til din alarm: Zürich", Text: "Tag et kig:\nhttps://cities.example/city/Z%C3%BCrich", Unsubscribe: "https://cities.example/alerts/unsubscribe?token=abc"}
+	if err := e.notify(n); err != nil {
+		t.Fatalf("Oibai, notify() failed: %v", err)
+	}
+	transcript := <-got
+	for _, want := range []string{
+		"MAIL FROM:<cities@example.com>",
+		"RCPT TO:<anna@example.com>",
+		"Subject: =?utf-8?q?En_by_til_din_alarm:_Z=C3=BCrich?=",
+		"List-Unsubscribe: <https://cities.example/alerts/unsubscribe?token=abc>",
+		"Tag et kig:\nhttps://cities.example/city/Z%C3%BCrich",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected %q in the email:\n%v", want, transcript)
+		}
+	}
+
+	addr, got = fakeSMTP(t)
+	e.addr = addr
+	if err := e.notify(notification{Subject: "A message from anna", Text: "Hej!"}); err != nil {
+		t.Fatalf("Oibai, notify() failed: %v", err)
+	}
+	if transcript := <-got; !strings.Contains(transcript, "RCPT TO:<aruna@example.com>") || strings.Contains(transcript, "List-Unsubscribe") {
+		t.Errorf("Expected a message to Aruna without a way to unsubscribe:\n%v", transcript)
+	}
+
+	// A mail server that never answers.
+	defer func(d time.Duration) { smtpTimeout = d }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	e.addr = l.Addr().String()
+	start := time.Now()
+	if err := e.notify(notification{Subject: "A message from anna", Text: "Hej!"}); err == nil {
+		t.Errorf("Expected a mail server that doesn't answer to fail")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Expected to give up after %v, it took %v", smtpTimeout, took)
+	}
+}
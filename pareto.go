@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+type (
+	// paretoCity is a city with the cities that dominate it.
+	paretoCity struct {
+		City        city
+		DominatedBy []string
+	}
+
+	// paretoPage is the data for the pareto page.
+	paretoPage struct {
+		Title     string
+		Criteria  string
+		Front     []paretoCity
+		Dominated []paretoCity
+		Links     []criterionLink
+		Selected  map[string]bool
+	}
+)
+
+// dominates returns true if a is at least as good as b by all criteria,
+// and better by at least one.
+func dominates(a, b city, crs []*criterion) bool {
+	better := false
+	for _, cr := range crs {
+		if cr.better(b, a) {
+			return false
+		}
+		if cr.better(a, b) {
+			better = true
+		}
+	}
+	return better
+}
+
+// pareto returns the cities that no other city dominates by the criteria (the
+// pareto front), and the dominated cities with the cities that dominate them.
+func (cs cities) pareto(crs []*criterion) (front, dominated []paretoCity) {
+	for _, c := range cs {
+		pc := paretoCity{City: c}
+		for _, other := range cs {
+			if dominates(other, c, crs) {
+				pc.DominatedBy = append(pc.DominatedBy, other.name)
+			}
+		}
+		if len(pc.DominatedBy) == 0 {
+			front = append(front, pc)
+		} else {
+			dominated = append(dominated, pc)
+		}
+	}
+	return front, dominated
+}
+
+// paretoHandler shows which cities are no-brainers to drop, e.g.
+// /pareto?criteria=cost,climate.
+//
+// All registered criteria are used by default.
+func paretoHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	names := splitList(strings.Join(q["criteria"], ","))
+	if len(names) == 0 {
+		for _, cr := range criteriaRegistry {
+			names = append(names, cr.name)
+		}
+	}
+	crs := []*criterion{}
+	selected := map[string]bool{}
+	for _, n := range names {
+		cr, err := criterionFor(n, q)
+		if err != nil {
+			log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+		crs = append(crs, cr)
+		selected[n] = true
+	}
+	cs, err := allCities().view("name", shortlistQuery(r, q))
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	lang := visitorLang(w, r)
+	labels := make([]string, len(names))
+	for i, n := range names {
+		labels[i] = tr(lang, n)
+	}
+	front, dominated := cs.pareto(crs)
+	render(w, lang, "html/pareto.html.tmpl", paretoPage{
+		Title:     "No-brainers",
+		Criteria:  strings.Join(labels, ", "),
+		Front:     front,
+		Dominated: dominated,
+		Links:     criteriaLinks(),
+		Selected:  selected,
+	})
+}
+
+// String returns which cities dominate the city, e.g. "Barcelona and Paradisio".
+func (pc paretoCity) String() string {
+	return joinAnd("en", pc.DominatedBy)
+}
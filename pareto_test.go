@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCities_pareto(t *testing.T) {
+	cost, _ := lookupCriterion("cost")
+	climate, _ := lookupCriterion("climate")
+	front, dominated := allCities().pareto([]*criterion{cost, climate})
+
+	if len(front) != 1 || front[0].City.name != "Paradisio" {
+		t.Errorf("Expected only Paradisio on the front, got %+v", front)
+	}
+	for _, pc := range dominated {
+		if pc.City.name == "Copenhagen" && !strings.Contains(pc.String(), "Barcelona") {
+			t.Errorf("Expected Barcelona to dominate Copenhagen, got %v", pc)
+		}
+		if pc.City.name == "Copenhagen" && strings.Contains(pc.String(), "Stockholm") {
+			t.Errorf("Stockholm ties with Copenhagen so shouldn't dominate it, got %v", pc)
+		}
+	}
+}
+
+func TestParetoHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+	}
+	cases := []testCase{
+		{url: "/pareto", wantCode: http.StatusOK},
+		{url: "/pareto?criteria=cost,population", wantCode: http.StatusOK},
+		{url: "/pareto?criteria=distance&to=Stockholm&criteria=cost", wantCode: http.StatusOK},
+		{url: "/pareto?criteria=happiness", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		paretoHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// permalink is a saved ranking, e.g. /r/abc123.
+	permalink struct {
+		ID        string    `json:"id"`
+		Query     string    `json:"query"`  // for the rank page, e.g. "climate=2&cost=1"
+		Cities    []string  `json:"cities"` // the ids of the cities as ranked when it was saved, the best first
+		Names     []string  `json:"names"`  // what the cities were called then
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// permalinkStore keeps the saved rankings.
+	permalinkStore struct {
+		mu    sync.Mutex
+		file  string // where the rankings are saved, or "" to not save them
+		links map[string]*permalink
+	}
+
+	// permalinkStatus is what changed in a saved ranking since it was saved.
+	permalinkStatus struct {
+		ID        string
+		SavedAt   string
+		Added     []string // cities that weren't there
+		Removed   []string // cities that aren't there anymore
+		Reordered bool     // the cities that are still there are in another order
+	}
+)
+
+// maxPermalinkQuery is how long the query of a saved ranking can be, in bytes.
+const maxPermalinkQuery = 2000
+
+// permalinkThrottle stops anyone from filling the store with rankings.
+var permalinkThrottle = newThrottle(30, time.Hour)
+
+// Permalinks are the saved rankings, they are only saved once main sets up the store.
+var Permalinks = &permalinkStore{links: map[string]*permalink{}}
+
+// newPermalinkStore returns a permalink store that saves the rankings in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newPermalinkStore(file string) (*permalinkStore, error) {
+	s := &permalinkStore{file: file, links: map[string]*permalink{}}
+	if err := loadJSON(file, &s.links); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the saved rankings in %v: %v", file, err)
+	}
+	// Rankings saved before cities had ids have the cities by name.
+	all := allCities()
+	for _, link := range s.links {
+		if len(link.Names) > 0 {
+			continue
+		}
+		link.Names = append([]string{}, link.Cities...)
+		for i, n := range link.Cities {
+			if c, ok := all.find(n); ok && c.id != "" {
+				link.Cities[i] = c.id
+			} else if id, ok := History.idOf(n); ok && id != "" {
+				link.Cities[i] = id
+			}
+		}
+	}
+	return s, nil
+}
+
+// rankQuery returns the parameters of the query that the rank page knows
+// about: the weights, how they are scored and the filters.
+//
+// The error is not nil if they are too long to be saved.
+func rankQuery(q url.Values) (url.Values, error) {
+	names := []string{"distance", "norm", "log", "better", "values"}
+	for _, c := range criteriaRegistry {
+		names = append(names, c.name)
+	}
+	kept := url.Values{}
+	for _, name := range append(names, rankFilters...) {
+		if v, ok := q[name]; ok {
+			kept[name] = v
+		}
+	}
+	if n := len(kept.Encode()); n > maxPermalinkQuery {
+		return nil, fmt.Errorf("the query is %d bytes, at most %d", n, maxPermalinkQuery)
+	}
+	return kept, nil
+}
+
+// add saves the ranking for the query with the cities as they are ranked now,
+// keeping only what the rank page knows about from the query, see rankQuery.
+//
+// The id is made from the query, so the same ranking always gets the same
+// link. Saving it again reuses the link with the cities it was first saved
+// with, however they are ranked now, so that whoever has the link sees the
+// same ranking.
+func (s *permalinkStore) add(q url.Values, ranked cities) (*permalink, error) {
+	q, err := rankQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	query := q.Encode()
+	sum := sha256.Sum256([]byte(query))
+	id := hex.EncodeToString(sum[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Six characters are plenty, unless two rankings happen to share them.
+	for n := 6; n <= len(id); n++ {
+		link, ok := s.links[id[:n]]
+		if !ok {
+			link = &permalink{ID: id[:n], Query: query, Cities: []string{}, Names: []string{}, CreatedAt: time.Now()}
+			for _, c := range ranked {
+				link.Cities = append(link.Cities, c.id)
+				link.Names = append(link.Names, c.name)
+			}
+			s.links[link.ID] = link
+			if s.file == "" {
+				return link, nil
+			}
+			return link, saveJSON(s.file, s.links)
+		}
+		if link.Query == query {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no id left for %q", query)
+}
+
+// find returns the saved ranking with the id.
+func (s *permalinkStore) find(id string) (*permalink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[id]
+	return link, ok
+}
+
+// status returns what changed between the cities of the saved ranking and
+// the cities as they are ranked now, the best first.
+//
+// The cities are told apart by their ids, so a renamed city is still the
+// same city, and is called what it is called now.
+func (link *permalink) status(ranked cities) *permalinkStatus {
+	st := &permalinkStatus{ID: link.ID, SavedAt: link.CreatedAt.Format("2006-01-02")}
+	ids := make([]string, len(ranked))
+	for i, c := range ranked {
+		ids[i] = c.id
+		if !contains(link.Cities, c.id) {
+			st.Added = append(st.Added, c.name)
+		}
+	}
+	all := allCities()
+	kept := []string{}
+	for i, id := range link.Cities {
+		if contains(ids, id) {
+			kept = append(kept, id)
+		} else if j := all.indexID(id); j >= 0 {
+			st.Removed = append(st.Removed, all[j].name)
+		} else {
+			st.Removed = append(st.Removed, link.Names[i])
+		}
+	}
+	i := 0
+	for _, id := range ids {
+		if contains(kept, id) {
+			st.Reordered = st.Reordered || kept[i] != id
+			i++
+		}
+	}
+	return st
+}
+
+// Changed returns true if the cities aren't the same as when the ranking was saved.
+func (st *permalinkStatus) Changed() bool {
+	return len(st.Added) > 0 || len(st.Removed) > 0 || st.Reordered
+}
+
+// bestFirst returns the scored cities, the best first.
+func bestFirst(scored []scoredCity) cities {
+	cs := make(cities, len(scored))
+	for i := range scored {
+		cs[len(scored)-1-i] = scored[i].city
+	}
+	return cs
+}
+
+// permalinkHandler saves a ranking with a POST to /r of its "query", and
+// shows a saved ranking, e.g. /r/abc123, against the cities as they are now.
+//
+// Nobody can save more than 30 rankings an hour from the same IP.
+func permalinkHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method == "POST" && r.URL.Path == "/r" {
+		if !permalinkThrottle.allow(remoteIP(r)) {
+			log.Printf("Sirree %v, that's enough saved rankings for now!\n", r.RemoteAddr)
+			serveErrorPage(w, http.StatusTooManyRequests)
+			return
+		}
+		q, err := url.ParseQuery(r.PostFormValue("query"))
+		if err == nil {
+			q, err = rankQuery(q)
+		}
+		if err != nil {
+			log.Printf("Ai-ai-ai, bad query %q: %v\n", r.PostFormValue("query"), err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+		if len(q) == 0 {
+			q = defaultRankQuery()
+		}
+		// The shortlist is the visitor's, whoever gets the link should see the same cities.
+		q = shortlistQuery(r, q)
+		_, scored, err := rankCities(q)
+		if err != nil {
+			log.Printf("Ai-ai-ai, bad query %q: %v\n", q.Encode(), err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+		link, err := Permalinks.add(q, bestFirst(scored))
+		if err != nil {
+			log.Printf("Oibai, I can't save the ranking: %v\n", err)
+			http.Error(w, "Oibai, I can't save the ranking", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Howdy mam, %v saved the ranking %q as %v\n", r.RemoteAddr, link.Query, link.ID)
+		http.Redirect(w, r, "/r/"+link.ID, http.StatusSeeOther)
+		return
+	}
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	link, ok := Permalinks.find(strings.TrimPrefix(r.URL.Path, "/r/"))
+	if !ok {
+		log.Printf("Sirree, there is no saved ranking %q!\n", r.URL.Path)
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	q, err := url.ParseQuery(link.Query)
+	if err != nil {
+		log.Printf("Oibai, the saved ranking %v is broken: %v\n", link.ID, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	serveRank(w, r, q, link)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPermalinkStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "permalinks.json")
+	s, err := newPermalinkStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newPermalinkStore() failed: %v", err)
+	}
+	link, err := s.add(url.Values{"climate": {"2"}, "cost": {"1"}}, citiesNamed("Paradisio", "Barcelona"))
+	if err != nil {
+		t.Fatalf("Oibai, add() failed: %v", err)
+	}
+	if len(link.ID) != 6 {
+		t.Errorf("Expected a 6 character id, got %q", link.ID)
+	}
+	again, _ := s.add(url.Values{"cost": {"1"}, "climate": {"2"}}, citiesNamed("Barcelona"))
+	if again.ID != link.ID || len(again.Cities) != 2 {
+		t.Errorf("The same ranking should keep its link and cities, got %+v for %+v", again, link)
+	}
+	other, _ := s.add(url.Values{"climate": {"1"}}, nil)
+	if other.ID == link.ID {
+		t.Errorf("Different rankings should get different links, both got %q", link.ID)
+	}
+
+	junk, err := s.add(url.Values{"climate": {"2"}, "cost": {"1"}, "spam": {"buy pills"}, "lang": {"ru"}}, nil)
+	if err != nil || junk.ID != link.ID {
+		t.Errorf("Expected what the rank page doesn't know to be dropped, got %+v, %v", junk, err)
+	}
+	if _, err := s.add(url.Values{"climate": {"2"}, "only": {strings.Repeat("a", maxPermalinkQuery)}}, nil); err == nil {
+		t.Errorf("Expected a query longer than %d bytes to be refused", maxPermalinkQuery)
+	}
+
+	reloaded, err := newPermalinkStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newPermalinkStore() failed to reload: %v", err)
+	}
+	got, ok := reloaded.find(link.ID)
+	if !ok || got.Query != "climate=2&cost=1" || strings.Join(got.Cities, ", ") != "paradisio, barcelona" || strings.Join(got.Names, ", ") != "Paradisio, Barcelona" {
+		t.Errorf("find(%v) = %+v, %v after reloading", link.ID, got, ok)
+	}
+
+	// Rankings saved before cities had ids have their names.
+	saveJSON(file, map[string]*permalink{"old123": {ID: "old123", Query: "climate=1", Cities: []string{"Paradisio", "Barcelona"}}})
+	reloaded, err = newPermalinkStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newPermalinkStore() failed to load old rankings: %v", err)
+	}
+	if got, _ := reloaded.find("old123"); strings.Join(got.Cities, ", ") != "paradisio, barcelona" || strings.Join(got.Names, ", ") != "Paradisio, Barcelona" {
+		t.Errorf("Expected the old ranking to get the ids of its cities, got %+v", got)
+	}
+}
+
+// citiesNamed returns cities with the names, and ids like the seed cities have.
+func citiesNamed(names ...string) cities {
+	cs := cities{}
+	for _, n := range names {
+		cs = append(cs, city{id: strings.ToLower(n), name: n})
+	}
+	return cs
+}
+
+func TestPermalink_status(t *testing.T) {
+	type testCase struct {
+		now           string
+		wantAdded     string
+		wantRemoved   string
+		wantReordered bool
+	}
+	cases := []testCase{
+		{now: "Paradisio,Barcelona,Seattle"},
+		{now: "Paradisio,Seattle,Barcelona", wantReordered: true},
+		{now: "Paradisio,Oslo,Barcelona,Seattle", wantAdded: "Oslo"},
+		{now: "Paradisio,Seattle", wantRemoved: "Barcelona"},
+		{now: "Seattle,Oslo", wantAdded: "Oslo", wantRemoved: "Paradisio, Barcelona"},
+	}
+	link := &permalink{ID: "abc123", Cities: []string{"paradisio", "barcelona", "seattle"}, Names: []string{"Paradisio", "Barcelona", "Seattle"}}
+	for _, tc := range cases {
+		st := link.status(citiesNamed(strings.Split(tc.now, ",")...))
+		if strings.Join(st.Added, ", ") != tc.wantAdded || strings.Join(st.Removed, ", ") != tc.wantRemoved || st.Reordered != tc.wantReordered {
+			t.Errorf("status(%v) = %+v, want added %q, removed %q, reordered %v", tc.now, st, tc.wantAdded, tc.wantRemoved, tc.wantReordered)
+		}
+		if changed := tc.wantAdded != "" || tc.wantRemoved != "" || tc.wantReordered; st.Changed() != changed {
+			t.Errorf("status(%v).Changed() = %v, want %v", tc.now, st.Changed(), changed)
+		}
+	}
+
+	// A renamed city is still the same city.
+	renamed := citiesNamed("Paradisio", "Barcelona", "Seattle")
+	renamed[1].name = "Barcino"
+	if st := link.status(renamed); st.Changed() {
+		t.Errorf("Expected no change when Barcelona is renamed, got %+v", st)
+	}
+}
+
+func TestPermalinkHandler(t *testing.T) {
+	defer func(cs cities) { setCities(cs) }(allCities())
+	defer func(s *permalinkStore) { Permalinks = s }(Permalinks)
+	defer func(s *shortlistStore) { Shortlists = s }(Shortlists)
+	defer func(th *throttle) { permalinkThrottle = th }(permalinkThrottle)
+	Permalinks = &permalinkStore{links: map[string]*permalink{}}
+	permalinkThrottle = newThrottle(1, time.Hour)
+	Shortlists = &shortlistStore{lists: map[string][]string{"anna": {"stockholm", "barcelona"}}}
+
+	form := url.Values{"query": {"climate=2&cost=1&shortlist=1&lang=ru"}}
+	req := httptest.NewRequest(http.MethodPost, "/r", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: visitorCookie, Value: "anna"})
+	rec := httptest.NewRecorder()
+	permalinkHandler(rec, req)
+	loc := rec.Header().Get("Location")
+	if rec.Code != http.StatusSeeOther || !strings.HasPrefix(loc, "/r/") {
+		t.Fatalf("POST /r: expected a redirect to the link, got %v to %q", rec.Code, loc)
+	}
+	link, _ := Permalinks.find(strings.TrimPrefix(loc, "/r/"))
+	if link.Query != "climate=2&cost=1&only=Stockholm%2CBarcelona" {
+		t.Errorf("Expected the shortlist to be saved as its cities, got %q", link.Query)
+	}
+
+	rec = httptest.NewRecorder()
+	permalinkHandler(rec, httptest.NewRequest(http.MethodGet, loc, nil))
+	for _, want := range []string{"The cities are the same as then.", `<a href="/city/Barcelona">`, `name="only" value="Stockholm,Barcelona"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("GET %v: expected %q in:\n%v", loc, want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), `<a href="/city/Paradisio">`) {
+		t.Errorf("GET %v: Paradisio isn't on the shortlist", loc)
+	}
+
+	// Stockholm is deleted since.
+	kept := cities{}
+	for _, c := range allCities() {
+		if c.name != "Stockholm" {
+			kept = append(kept, c)
+		}
+	}
+	setCities(kept)
+	rec = httptest.NewRecorder()
+	permalinkHandler(rec, httptest.NewRequest(http.MethodGet, loc, nil))
+	if !strings.Contains(rec.Body.String(), "The cities have changed since:") || !strings.Contains(rec.Body.String(), "removed Stockholm.") {
+		t.Errorf("GET %v: expected Stockholm to be gone:\n%v", loc, rec.Body.String())
+	}
+
+	type testCase struct {
+		method   string
+		url      string
+		form     url.Values
+		wantCode int
+	}
+	cases := []testCase{
+		{method: http.MethodGet, url: "/r/nope42", wantCode: http.StatusNotFound},
+		{method: http.MethodDelete, url: loc, wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, url: "/r", form: url.Values{"query": {"climate=1"}}, wantCode: http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		permalinkHandler(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v %v: expected %v, got %v", tc.method, tc.url, tc.wantCode, rec.Code)
+		}
+	}
+}
+
+func TestRankHandler_share(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rankHandler(rec, httptest.NewRequest(http.MethodGet, "/rank?climate=1&max_cost=2", nil))
+	if !strings.Contains(rec.Body.String(), `<input type="hidden" name="query" value="climate=1&amp;max_cost=2" />`) {
+		t.Errorf("Expected a form to share the ranking:\n%v", rec.Body.String())
+	}
+}
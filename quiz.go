@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+type (
+	// quizAnswers are the answers to the dream city questionnaire.
+	quizAnswers struct {
+		care  map[string]int // how much each criterion matters, from 0 (not at all) to 3 (above all)
+		size  string         // "small", "medium", "big" or "" for any
+		avoid []string       // the deal-breakers, e.g. "expensive"
+	}
+
+	// quizChoice is an answer to pick in the questionnaire.
+	quizChoice struct {
+		Value   string
+		Label   string
+		Checked bool
+	}
+
+	// quizQuestion is how much a criterion matters, in the first step.
+	quizQuestion struct {
+		Name  string // the criterion, e.g. "climate"
+		Label string // e.g. "the weather"
+		Value int
+	}
+
+	// quizPick is a recommended city and why.
+	quizPick struct {
+		Rank    int
+		City    city
+		Score   string
+		Reasons []string
+	}
+
+	// hiddenInput carries an answer or a filter from one form to the next.
+	hiddenInput struct {
+		Name  string
+		Value string
+	}
+
+	// quizPage is the data for a step of the questionnaire or its results.
+	quizPage struct {
+		Title      string
+		Step       int
+		NextStep   int
+		Hidden     []hiddenInput
+		Questions  []quizQuestion
+		Levels     []option
+		Sizes      []quizChoice
+		Avoid      []quizChoice
+		Summary    string
+		Picks      []quizPick
+		Considered int
+		Weights    []weightInput
+		RankURL    string
+	}
+)
+
+const (
+	// quizResults is the step with the recommendation.
+	quizResults = 4
+	// quizPicks is how many cities we recommend.
+	quizPicks = 3
+)
+
+var (
+	// quizCriteria are the criteria the questionnaire asks about, with how
+	// the question calls them.
+	quizCriteria = []quizQuestion{
+		{Name: "climate", Label: "the weather"},
+		{Name: "cost", Label: "the cost of living"},
+		{Name: "population", Label: "the size of the city"},
+	}
+
+	// quizLevels are the answers to how much a criterion matters.
+	quizLevels = []string{"not at all", "a little", "a lot", "above all"}
+
+	// quizSizes are the city sizes to choose from, with the population limits they set.
+	quizSizes = []struct {
+		value, label string
+		min, max     int
+	}{
+		{"small", "small, under 500 000 people", 0, 500000},
+		{"medium", "medium, 500 000 to 2 million people", 500000, 2000000},
+		{"big", "big, over 2 million people", 2000000, 0},
+		{"", "any size", 0, 0},
+	}
+
+	// quizDealBreakers are what a visitor can refuse, with the limit each sets.
+	quizDealBreakers = []struct {
+		value, label, param string
+		limit               int
+	}{
+		{"expensive", "an expensive city", "max_cost", int(ReasonableCost)},
+		{"bad-weather", "nasty or poor weather", "min_climate", int(GoodClimate)},
+	}
+)
+
+// parseQuizAnswers returns the answers in the query, e.g.
+// ?care_climate=3&care_cost=1&size=small&avoid=expensive.
+//
+// The error is not nil if an answer isn't one we asked for.
+func parseQuizAnswers(q url.Values) (quizAnswers, error) {
+	a := quizAnswers{care: map[string]int{}}
+	for _, qq := range quizCriteria {
+		s := q.Get("care_" + qq.Name)
+		if s == "" {
+			continue
+		}
+		level, err := strconv.Atoi(s)
+		if err != nil || level < 0 || level >= len(quizLevels) {
+			return quizAnswers{}, fmt.Errorf("bad care_%v %q", qq.Name, s)
+		}
+		a.care[qq.Name] = level
+	}
+	a.size = q.Get("size")
+	found := false
+	for _, s := range quizSizes {
+		found = found || s.value == a.size
+	}
+	if !found {
+		return quizAnswers{}, fmt.Errorf("no size called %q", a.size)
+	}
+	for _, v := range q["avoid"] {
+		found := false
+		for _, d := range quizDealBreakers {
+			found = found || d.value == v
+		}
+		if !found {
+			return quizAnswers{}, fmt.Errorf("no deal-breaker called %q", v)
+		}
+		a.avoid = append(a.avoid, v)
+	}
+	return a, nil
+}
+
+// rankQuery returns the query for the rank page that the answers add up to:
+// the weights, and the limits for the size and the deal-breakers.
+//
+// If nothing matters, everything counts the same.
+func (a quizAnswers) rankQuery() url.Values {
+	q := url.Values{}
+	for _, qq := range quizCriteria {
+		if level := a.care[qq.Name]; level > 0 {
+			q.Set(qq.Name, strconv.Itoa(level))
+		}
+	}
+	if len(q) == 0 {
+		for _, qq := range quizCriteria {
+			q.Set(qq.Name, "1")
+		}
+	}
+	for _, s := range quizSizes {
+		if s.value != a.size || s.value == "" {
+			continue
+		}
+		if s.min > 0 {
+			q.Set("min_population", strconv.Itoa(s.min))
+		}
+		if s.max > 0 {
+			q.Set("max_population", strconv.Itoa(s.max))
+		}
+		if s.value == "small" {
+			q.Set("better", "population:lower")
+		}
+	}
+	for _, d := range quizDealBreakers {
+		if contains(a.avoid, d.value) {
+			q.Set(d.param, strconv.Itoa(d.limit))
+		}
+	}
+	return q
+}
+
+// quizReasons returns why the city is recommended: for each weighted
+// criterion, the most important first, how it does against the other cities.
+func quizReasons(c city, rc rankConfig, considered cities, lang string) []string {
+	criteria := make([]weightedCriterion, len(rc.criteria))
+	copy(criteria, rc.criteria)
+	sort.SliceStable(criteria, func(i, j int) bool { return criteria[i].weight > criteria[j].weight })
+	reasons := []string{}
+	for _, wc := range criteria {
+		beaten := 0
+		for _, other := range considered {
+			if wc.higherIsBetter && wc.value(c) > wc.value(other) || !wc.higherIsBetter && wc.value(c) < wc.value(other) {
+				beaten++
+			}
+		}
+		reason := fmt.Sprintf("%s: %s", tr(lang, wc.label), wc.describe(c, lang))
+		if len(considered) > 1 {
+			reason = fmt.Sprintf(tr(lang, "%s, better than %d of the other %d cities"), reason, beaten, len(considered)-1)
+		}
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+// newQuizPage returns the data for a step of the questionnaire, carrying the
+// answers given so far in hidden inputs.
+func newQuizPage(step int, a quizAnswers, q url.Values) quizPage {
+	p := quizPage{Title: "Find my dream city", Step: step, NextStep: step + 1}
+	for i, l := range quizLevels {
+		p.Levels = append(p.Levels, option{i, l})
+	}
+	for _, qq := range quizCriteria {
+		qq.Value = a.care[qq.Name]
+		p.Questions = append(p.Questions, qq)
+	}
+	for _, s := range quizSizes {
+		p.Sizes = append(p.Sizes, quizChoice{Value: s.value, Label: s.label, Checked: s.value == a.size})
+	}
+	for _, d := range quizDealBreakers {
+		p.Avoid = append(p.Avoid, quizChoice{Value: d.value, Label: d.label, Checked: contains(a.avoid, d.value)})
+	}
+	// Each step asks again for its own answers, the rest are carried along.
+	asked := map[int][]string{
+		1:           {"care_climate", "care_cost", "care_population"},
+		2:           {"size"},
+		3:           {"avoid"},
+		quizResults: {"climate", "cost", "population"},
+	}
+	names := []string{}
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "step" || name == "lang" || contains(asked[step], name) {
+			continue
+		}
+		for _, v := range q[name] {
+			p.Hidden = append(p.Hidden, hiddenInput{name, v})
+		}
+	}
+	return p
+}
+
+// quizHandler asks a visitor what they care about a step at a time, e.g.
+// /quiz?step=2&care_climate=3, and recommends the three cities that fit best.
+//
+// The answers add up to the weights and limits of the rank page. On the
+// results the visitor can change the weights, e.g. &climate=2&cost=1.
+func quizHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	step := 1
+	if s := q.Get("step"); s != "" {
+		var err error
+		step, err = strconv.Atoi(s)
+		if err != nil || step < 1 || step > quizResults {
+			log.Printf("Ai-ai-ai, bad step %q\n", s)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+	}
+	a, err := parseQuizAnswers(q)
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	lang := visitorLang(w, r)
+	p := newQuizPage(step, a, q)
+	if step < quizResults {
+		render(w, lang, "html/quiz.html.tmpl", p)
+		return
+	}
+
+	rq := a.rankQuery()
+	// Weights the visitor changed on the results win over the answers.
+	for _, c := range criteriaRegistry {
+		if w := q.Get(c.name); w != "" {
+			rq.Set(c.name, w)
+		}
+	}
+	rc, err := parseRankConfig(rq)
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	considered, err := allCities().view("", rq)
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", r.URL.RawQuery, err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	scored := rc.score(considered)
+	for i := len(scored) - 1; i >= 0 && len(p.Picks) < quizPicks; i-- {
+		p.Picks = append(p.Picks, quizPick{
+			Rank:    len(p.Picks) + 1,
+			City:    scored[i].city,
+			Score:   fmt.Sprintf("%.2f", scored[i].score),
+			Reasons: quizReasons(scored[i].city, rc, considered, lang),
+		})
+	}
+	p.Considered = len(considered)
+	p.Summary = rc.describe(lang)
+	p.Weights = newRankPage(rc, nil, lang).Weights
+	p.RankURL = "/rank?" + rq.Encode()
+	render(w, lang, "html/quiz.html.tmpl", p)
+}
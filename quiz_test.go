@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestQuizAnswers_rankQuery(t *testing.T) {
+	type testCase struct {
+		query   string
+		want    string
+		wantErr bool
+	}
+	cases := []testCase{
+		{query: "", want: "climate=1&cost=1&population=1"},
+		{query: "care_climate=3&care_cost=1&care_population=0", want: "climate=3&cost=1"},
+		{query: "care_climate=2&size=small", want: "better=population%3Alower&climate=2&max_population=500000"},
+		{query: "care_cost=1&size=big&avoid=expensive&avoid=bad-weather", want: "cost=1&max_cost=3&min_climate=3&min_population=2000000"},
+		{query: "care_climate=4", wantErr: true},
+		{query: "care_climate=lots", wantErr: true},
+		{query: "size=huge", wantErr: true},
+		{query: "avoid=rain", wantErr: true},
+	}
+	for _, tc := range cases {
+		q, _ := url.ParseQuery(tc.query)
+		a, err := parseQuizAnswers(q)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseQuizAnswers(%q) error = %v, want error %v", tc.query, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := a.rankQuery().Encode(); got != tc.want {
+			t.Errorf("rankQuery() of %q = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestFilterLimits(t *testing.T) {
+	type testCase struct {
+		query   string
+		want    string
+		wantErr bool
+	}
+	cases := []testCase{
+		{query: "", want: allCities().getNames()},
+		{query: "min_population=1000000&max_population=2000000", want: "Barcelona, Paradisio"},
+		{query: "max_cost=3&min_climate=4", want: "Barcelona, Paradisio"},
+		{query: "max_cost=1", want: "Paradisio"},
+		{query: "min_climate=many", wantErr: true},
+	}
+	for _, tc := range cases {
+		q, _ := url.ParseQuery(tc.query)
+		cs, err := allCities().filterLimits(q)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("filterLimits(%q) error = %v, want error %v", tc.query, err, tc.wantErr)
+			continue
+		}
+		if err == nil && cs.getNames() != tc.want {
+			t.Errorf("filterLimits(%q) = %v, want %v", tc.query, cs.getNames(), tc.want)
+		}
+	}
+}
+
+func TestQuizHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+		wantText []string
+	}
+	cases := []testCase{
+		{url: "/quiz", wantCode: http.StatusOK, wantText: []string{"Step 1 of 3", `name="care_climate"`, `name="step" value="2"`}},
+		{url: "/quiz?step=2&care_climate=3", wantCode: http.StatusOK, wantText: []string{"Step 2 of 3", `name="care_climate" value="3"`, `name="size"`}},
+		{url: "/quiz?step=3&care_climate=3&size=medium", wantCode: http.StatusOK, wantText: []string{"deal-breakers", `name="size" value="medium"`, `name="avoid"`}},
+		{url: "/quiz?step=4&care_climate=3&care_cost=1&size=medium", wantCode: http.StatusOK, wantText: []string{
+			"By cost (25%) and climate (75%), out of 5 cities",
+			`<li><a href="/city/Paradisio">Paradisio`,
+			"Climate: perfect, better than 4 of the other 4 cities",
+			`name="climate" value="3"`,
+			`href="/rank?climate=3&amp;cost=1&amp;max_population=2000000&amp;min_population=500000"`,
+		}},
+		{url: "/quiz?step=4&care_climate=3&care_cost=1&size=medium&climate=0&cost=1", wantCode: http.StatusOK, wantText: []string{"By cost (100%)"}},
+		{url: "/quiz?step=4&care_climate=3&size=small", wantCode: http.StatusOK, wantText: []string{"No city passes your deal-breakers"}},
+		{url: "/quiz?step=4&care_climate=3&lang=da", wantCode: http.StatusOK, wantText: []string{"Dine drømmebyer"}},
+		{url: "/quiz?step=9", wantCode: http.StatusBadRequest},
+		{url: "/quiz?step=4&care_climate=9", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		quizHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %v: expected status %v, got %v", tc.url, tc.wantCode, rec.Code)
+			continue
+		}
+		for _, want := range tc.wantText {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("GET %v: expected %q in:\n%v", tc.url, want, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestRankHandler_keepsFilters(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rankHandler(rec, httptest.NewRequest(http.MethodGet, "/rank?climate=1&max_cost=2", nil))
+	if !strings.Contains(rec.Body.String(), `<input type="hidden" name="max_cost" value="2" />`) {
+		t.Errorf("Expected the form to keep max_cost:\n%v", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "Deviltown") {
+		t.Errorf("Deviltown is too expensive to be ranked")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// ratingStore keeps the votes of visitors on the cost and climate of cities.
+	ratingStore struct {
+		mu    sync.Mutex
+		file  string // where the votes are saved, or "" to not save them
+		votes votes
+	}
+
+	// votes are the ratings by city id, then attribute ("cost" or "climate"), then visitor.
+	votes map[string]map[string]map[string]int
+
+	// ratingSummary is what the crowd thinks of an attribute of a city.
+	ratingSummary struct {
+		Mean         float64
+		Count        int
+		Distribution [5]int // how many voted 1, 2, ... 5
+	}
+)
+
+// ratedAttributes are the attributes visitors can rate, with the descriptions of the ratings.
+var ratedAttributes = map[string]func(rating int) string{
+	"cost":    func(r int) string { return cost(r).String() },
+	"climate": func(r int) string { return climate(r).String() },
+}
+
+// Ratings are the votes of visitors, they are only saved once main sets up the store.
+var Ratings = &ratingStore{votes: votes{}}
+
+// voteThrottle stops anyone from voting too often from the same IP, even
+// with a new cookie every time.
+var voteThrottle = newThrottle(30, time.Hour)
+
+// newRatingStore returns a rating store that saves the votes in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newRatingStore(file string) (*ratingStore, error) {
+	s := &ratingStore{file: file, votes: votes{}}
+	if err := loadJSON(file, &s.votes); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the ratings in %v: %v", file, err)
+	}
+	// Votes from before cities had ids are by name.
+	for _, c := range allCities() {
+		if v, ok := s.votes[c.name]; ok && c.id != "" && s.votes[c.id] == nil {
+			s.votes[c.id] = v
+			delete(s.votes, c.name)
+		}
+	}
+	return s, nil
+}
+
+// rate records the visitor's rating of an attribute of a city, replacing any
+// rating they gave before.
+//
+// The error is not nil if the rating doesn't make sense or can't be saved.
+func (s *ratingStore) rate(cityName, attr, visitor string, rating int) error {
+	desc, ok := ratedAttributes[attr]
+	if !ok {
+		return fmt.Errorf("can't rate %q", attr)
+	}
+	if desc(rating) == "" {
+		return fmt.Errorf("bad %v rating %v", attr, rating)
+	}
+	c, ok := allCities().find(cityName)
+	if !ok || c.id == "" {
+		return fmt.Errorf("no city called %q", cityName)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The votes change once they are saved, so a failed save changes nothing.
+	updated := s.votes.with(c.id, attr, visitor, rating)
+	if s.file != "" {
+		if err := saveJSON(s.file, updated); err != nil {
+			return err
+		}
+	}
+	s.votes = updated
+	return nil
+}
+
+// with returns the votes with the visitor's rating, leaving the votes as
+// they are. Only the maps on the way to the rating are copied.
+func (v votes) with(cityID, attr, visitor string, rating int) votes {
+	updated := make(votes, len(v)+1)
+	for id, attrs := range v {
+		updated[id] = attrs
+	}
+	attrs := make(map[string]map[string]int, len(v[cityID])+1)
+	for a, ratings := range v[cityID] {
+		attrs[a] = ratings
+	}
+	ratings := make(map[string]int, len(v[cityID][attr])+1)
+	for who, r := range v[cityID][attr] {
+		ratings[who] = r
+	}
+	ratings[visitor] = rating
+	attrs[attr] = ratings
+	updated[cityID] = attrs
+	return updated
+}
+
+// summary returns what the crowd thinks of an attribute of the city with the id.
+func (s *ratingStore) summary(cityID, attr string) ratingSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := ratingSummary{}
+	total := 0
+	for _, r := range s.votes[cityID][attr] {
+		if r < 1 || r > len(sum.Distribution) {
+			continue
+		}
+		sum.Count++
+		sum.Distribution[r-1]++
+		total += r
+	}
+	if sum.Count > 0 {
+		sum.Mean = float64(total) / float64(sum.Count)
+	}
+	return sum
+}
+
+// mine returns the visitor's rating of an attribute of the city with the id,
+// or 0 if they haven't rated it.
+func (s *ratingStore) mine(cityID, attr, visitor string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.votes[cityID][attr][visitor]
+}
+
+// crowdCities returns a copy of the cities with the cost and climate the
+// crowd rated them, rounded to the nearest rating.
+//
+// Cities or attributes that nobody rated keep the curated values.
+func (s *ratingStore) crowdCities(cs cities) cities {
+	crowd := make(cities, len(cs))
+	copy(crowd, cs)
+	for i := range crowd {
+		if sum := s.summary(crowd[i].id, "cost"); sum.Count > 0 {
+			crowd[i].cost = cost(math.Floor(sum.Mean + 0.5))
+		}
+		if sum := s.summary(crowd[i].id, "climate"); sum.Count > 0 {
+			crowd[i].climate = climate(math.Floor(sum.Mean + 0.5))
+		}
+	}
+	return crowd
+}
+
+// rateHandler records a visitor's rating from the form on the city page.
+//
+// Nobody can vote more than 30 times an hour from the same IP.
+func rateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	if !voteThrottle.allow(remoteIP(r)) {
+		log.Printf("Sirree %v, that's enough votes for now!\n", r.RemoteAddr)
+		serveErrorPage(w, http.StatusTooManyRequests)
+		return
+	}
+	n := r.PostFormValue("city")
+	attr := r.PostFormValue("attribute")
+	rating, err := strconv.Atoi(r.PostFormValue("rating"))
+	if err == nil {
+		err = Ratings.rate(n, attr, visitorID(w, r), rating)
+	}
+	if err != nil {
+		log.Printf("Bozhechki, I can't record the rating: %v\n", err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Howdy mam, %v rated the %v of %v as %v\n", r.RemoteAddr, attr, n, rating)
+	c, _ := allCities().find(n)
+	http.Redirect(w, r, c.URL(), http.StatusFound)
+}
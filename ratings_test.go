@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRatingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ratings.json")
+	s, err := newRatingStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newRatingStore() failed: %v", err)
+	}
+	s.rate("Stockholm", "climate", "anna", int(GreatClimate))
+	s.rate("Stockholm", "climate", "bob", int(PoorClimate))
+	s.rate("Stockholm", "climate", "bob", int(PerfectClimate))
+	if err := s.rate("Stockholm", "climate", "bob", 9); err == nil {
+		t.Errorf("rate() with a rating of 9 should fail")
+	}
+	if err := s.rate("Stockholm", "population", "bob", 1); err == nil {
+		t.Errorf("rate() of the population should fail")
+	}
+	if err := s.rate("Atlantis", "cost", "bob", 1); err == nil {
+		t.Errorf("rate() of a city we don't know should fail")
+	}
+
+	reloaded, err := newRatingStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newRatingStore() failed to reload: %v", err)
+	}
+	got := reloaded.summary("stockholm", "climate")
+	want := ratingSummary{Mean: 4.5, Count: 2, Distribution: [5]int{0, 0, 0, 1, 1}}
+	if got != want {
+		t.Errorf("summary() = %+v, want %+v", got, want)
+	}
+	crowd := reloaded.crowdCities(allCities())
+	c, _ := crowd.find("Stockholm")
+	if c.climate != PerfectClimate || c.cost != ExpensiveCost {
+		t.Errorf("Expected crowd Stockholm to have a perfect climate and curated cost, got %v", c)
+	}
+
+	// A vote that can't be saved isn't kept either.
+	reloaded.file = filepath.Join(file, "nope.json")
+	if err := reloaded.rate("Stockholm", "climate", "carol", int(NastyClimate)); err == nil {
+		t.Errorf("rate() should fail when the votes can't be saved")
+	}
+	if got := reloaded.summary("stockholm", "climate"); got != want {
+		t.Errorf("Expected the unsaved vote to be forgotten, got %+v", got)
+	}
+}
+
+func TestNewRatingStore_byName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ratings.json")
+	saveJSON(file, votes{"Stockholm": {"climate": {"anna": int(GreatClimate)}}, "Atlantis": {"cost": {"anna": 1}}})
+	s, err := newRatingStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newRatingStore() failed: %v", err)
+	}
+	if got := s.mine("stockholm", "climate", "anna"); got != int(GreatClimate) {
+		t.Errorf("Expected anna's vote to follow Stockholm to its id, got %v", got)
+	}
+	if got := s.mine("Atlantis", "cost", "anna"); got != 1 {
+		t.Errorf("Expected the votes of cities we don't have to be kept, got %v", got)
+	}
+}
+
+func TestRateHandler(t *testing.T) {
+	defer func(r *ratingStore, th *throttle) { Ratings, voteThrottle = r, th }(Ratings, voteThrottle)
+	Ratings = &ratingStore{votes: votes{}}
+	voteThrottle = newThrottle(1, time.Hour)
+
+	form := url.Values{"city": {"Deviltown"}, "attribute": {"climate"}, "rating": {"5"}}
+	req := httptest.NewRequest(http.MethodPost, "/rate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	rateHandler(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Dude, expected status 302, got %v", rec.Code)
+	}
+	if !strings.Contains(rec.Header().Get("Set-Cookie"), visitorCookie) {
+		t.Errorf("Expected a visitor cookie, got %q", rec.Header().Get("Set-Cookie"))
+	}
+	q, _ := url.ParseQuery("values=crowd")
+	cs, _ := allCities().view("climate", q)
+	if cs[len(cs)-1].name != "Deviltown" && cs[len(cs)-2].name != "Deviltown" {
+		t.Errorf("Expected Deviltown among the best climates by the crowd, got %v", cs.getNames())
+	}
+
+	// A new cookie doesn't get anyone more votes.
+	req = httptest.NewRequest(http.MethodPost, "/rate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	rateHandler(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a second vote in the hour to be refused, got %v", rec.Code)
+	}
+}
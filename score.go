@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// normalization is how criteria values are made comparable with each other.
+	normalization string
+
+	// weightedCriterion is a criterion with how much it counts in a score.
+	weightedCriterion struct {
+		*criterion
+		weight         float64
+		logScale       bool // e.g. for population, so a billion people don't drown out the rest
+		higherIsBetter bool
+	}
+
+	// rankConfig is how to score cities by a weighted set of criteria.
+	rankConfig struct {
+		criteria []weightedCriterion
+		norm     normalization
+	}
+
+	// scoredCity is a city with its score.
+	scoredCity struct {
+		city
+		scores []float64 // the normalized score for each criterion, where higher is better
+		score  float64   // the weighted average of the scores
+	}
+
+	// rankPage is the data for the rank page.
+	rankPage struct {
+		Title   string
+		Summary string
+		Norm    string
+		Norms   []string
+		Labels  []string
+		Rows    []rankRow
+		Weights []weightInput
+		Crowd   bool
+		Filters []hiddenInput    // kept when the weights change, e.g. near=Stockholm
+		Query   string           // to save the ranking as a permalink
+		Saved   *permalinkStatus // for a saved ranking, what changed since
+	}
+	rankRow struct {
+		Rank   int // 1 for the best
+		City   city
+		Score  string
+		Scores []string
+	}
+	// weightInput is a criterion in the form for changing the weights.
+	weightInput struct {
+		Name   string
+		Label  string
+		Weight float64
+		Log    bool
+		Higher bool
+	}
+)
+
+const (
+	// minMaxNorm scales values to 0 for the worst and 1 for the best city.
+	minMaxNorm normalization = "minmax"
+	// rankNorm uses the place of a city when sorted, scaled to 0 to 1.
+	rankNorm normalization = "rank"
+	// zScoreNorm uses the number of standard deviations from the mean.
+	zScoreNorm normalization = "zscore"
+)
+
+// normalizations are all the supported normalizations, the first is the default.
+var normalizations = []normalization{minMaxNorm, rankNorm, zScoreNorm}
+
+// logScaled are the criteria that are log scaled unless the user says otherwise.
+var logScaled = map[string]bool{"population": true}
+
+// weigh returns the criterion with the given weight and its default options.
+func weigh(c *criterion, weight float64) weightedCriterion {
+	return weightedCriterion{
+		criterion:      c,
+		weight:         weight,
+		logScale:       logScaled[c.name],
+		higherIsBetter: c.higherIsBetter,
+	}
+}
+
+// parseRankConfig returns the rank config in the query, e.g.
+// ?climate=2&cost=1&norm=rank&log=population&better=population:lower.
+//
+// Any registered criterion (or "distance", with "to") may be given a weight.
+// "log" is a comma separated list of criteria to log scale, and "better" says
+// whether "higher" or "lower" values are better for a criterion. Both may be
+// given more than once, as forms do.
+//
+// The error is not nil when the query doesn't make sense or has no weights.
+func parseRankConfig(q url.Values) (rankConfig, error) {
+	rc := rankConfig{norm: normalizations[0]}
+	names := []string{}
+	for _, c := range criteriaRegistry {
+		names = append(names, c.name)
+	}
+	names = append(names, "distance")
+	for _, name := range names {
+		w := q.Get(name)
+		if w == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(w, 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			return rankConfig{}, fmt.Errorf("bad weight %q for %v", w, name)
+		}
+		if weight == 0 {
+			continue
+		}
+		c, err := criterionFor(name, q)
+		if err != nil {
+			return rankConfig{}, err
+		}
+		rc.criteria = append(rc.criteria, weigh(c, weight))
+	}
+	if len(rc.criteria) == 0 {
+		return rankConfig{}, fmt.Errorf("no criteria with a weight")
+	}
+	if n := q.Get("norm"); n != "" {
+		if err := rc.setNorm(n); err != nil {
+			return rankConfig{}, err
+		}
+	}
+	if _, ok := q["log"]; ok {
+		logged := splitList(strings.Join(q["log"], ","))
+		for i := range rc.criteria {
+			rc.criteria[i].logScale = contains(logged, rc.criteria[i].name)
+		}
+	}
+	for _, b := range splitList(strings.Join(q["better"], ",")) {
+		parts := strings.SplitN(b, ":", 2)
+		if len(parts) != 2 || (parts[1] != "higher" && parts[1] != "lower") {
+			return rankConfig{}, fmt.Errorf("bad better %q, want e.g. population:lower", b)
+		}
+		for i := range rc.criteria {
+			if rc.criteria[i].name == parts[0] {
+				rc.criteria[i].higherIsBetter = parts[1] == "higher"
+			}
+		}
+	}
+	return rc, nil
+}
+
+// setNorm sets the normalization by name.
+func (rc *rankConfig) setNorm(name string) error {
+	for _, n := range normalizations {
+		if string(n) == name {
+			rc.norm = n
+			return nil
+		}
+	}
+	return fmt.Errorf("no normalization called %q", name)
+}
+
+// String returns a description of the weights, e.g. "climate (67%) and cost (33%)".
+func (rc rankConfig) String() string {
+	return rc.describe("en")
+}
+
+// describe returns a description of the weights in the language.
+func (rc rankConfig) describe(lang string) string {
+	total := rc.totalWeight()
+	desc := make([]string, len(rc.criteria))
+	for i, wc := range rc.criteria {
+		desc[i] = fmt.Sprintf("%s (%.0f%%)", tr(lang, wc.name), 100*wc.weight/total)
+	}
+	return joinAnd(lang, desc)
+}
+
+// totalWeight returns the sum of the weights.
+func (rc rankConfig) totalWeight() float64 {
+	total := 0.0
+	for _, wc := range rc.criteria {
+		total += wc.weight
+	}
+	return total
+}
+
+// score returns the cities with their scores, sorted in ascending order (worst to best).
+func (rc rankConfig) score(cs cities) []scoredCity {
+	scored := make([]scoredCity, len(cs))
+	for i := range cs {
+		scored[i] = scoredCity{city: cs[i], scores: make([]float64, len(rc.criteria))}
+	}
+	total := rc.totalWeight()
+	for j, wc := range rc.criteria {
+		values := make([]float64, len(cs))
+		for i := range cs {
+			values[i] = wc.value(cs[i])
+			if wc.logScale {
+				values[i] = math.Log10(math.Max(values[i], 1))
+			}
+			if !wc.higherIsBetter {
+				values[i] = -values[i]
+			}
+		}
+		normalized := normalize(values, rc.norm)
+		for i := range scored {
+			scored[i].scores[j] = normalized[i]
+			if total > 0 {
+				scored[i].score += wc.weight / total * normalized[i]
+			}
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].score < scored[j].score })
+	return scored
+}
+
+// normalize returns the values normalized so that they are comparable with other criteria.
+func normalize(values []float64, norm normalization) []float64 {
+	normalized := make([]float64, len(values))
+	if len(values) == 0 {
+		return normalized
+	}
+	switch norm {
+	case rankNorm:
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Float64s(sorted)
+		for i, v := range values {
+			if len(values) == 1 {
+				normalized[i] = 0.5
+				continue
+			}
+			// Ties share the average of their ranks.
+			first := sort.SearchFloat64s(sorted, v)
+			last := sort.Search(len(sorted), func(k int) bool { return sorted[k] > v }) - 1
+			normalized[i] = float64(first+last) / 2 / float64(len(values)-1)
+		}
+	case zScoreNorm:
+		mean := 0.0
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+		variance := 0.0
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		sd := math.Sqrt(variance / float64(len(values)))
+		for i, v := range values {
+			if sd > 0 {
+				normalized[i] = (v - mean) / sd
+			}
+		}
+	default:
+		min, max := values[0], values[0]
+		for _, v := range values {
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		for i, v := range values {
+			if max > min {
+				normalized[i] = (v - min) / (max - min)
+			} else {
+				normalized[i] = 0.5
+			}
+		}
+	}
+	return normalized
+}
+
+// rankFilters are the query parameters that choose which cities to rank,
+// rather than how.
+var rankFilters = []string{"to", "near", "within_km", "min_population", "max_population", "max_cost", "min_climate", "only", "shortlist"}
+
+// defaultRankQuery returns the weights used when the user hasn't given any.
+func defaultRankQuery() url.Values {
+	return url.Values{"climate": {"2"}, "cost": {"1"}}
+}
+
+// rankHandler shows cities ranked by a weighted set of criteria, with the
+// normalized score for each criterion.
+//
+// Without a query it ranks by climate (67%) and cost (33%).
+func rankHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	q.Del("lang")
+	if len(q) == 0 {
+		q = defaultRankQuery()
+	}
+	serveRank(w, r, q, nil)
+}
+
+// rankCities returns the ranking for the query and the cities it ranks,
+// sorted in ascending order (worst to best).
+func rankCities(q url.Values) (rankConfig, []scoredCity, error) {
+	rc, err := parseRankConfig(q)
+	if err != nil {
+		return rc, nil, err
+	}
+	cs, err := allCities().view("", q)
+	if err != nil {
+		return rc, nil, err
+	}
+	return rc, rc.score(cs), nil
+}
+
+// serveRank writes the rank page for the query, and what changed since the
+// ranking was saved if it comes from a permalink.
+func serveRank(w http.ResponseWriter, r *http.Request, q url.Values, link *permalink) {
+	rc, scored, err := rankCities(shortlistQuery(r, q))
+	if err != nil {
+		log.Printf("Ai-ai-ai, bad query %q: %v\n", q.Encode(), err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	lang := visitorLang(w, r)
+	p := newRankPage(rc, scored, lang)
+	p.Crowd = q.Get("values") == "crowd"
+	for _, name := range rankFilters {
+		if v := q.Get(name); v != "" {
+			p.Filters = append(p.Filters, hiddenInput{name, v})
+		}
+	}
+	p.Query = q.Encode()
+	if link != nil {
+		p.Saved = link.status(bestFirst(scored))
+	}
+	render(w, lang, "html/rank.html.tmpl", p)
+}
+
+// newRankPage returns the data for the rank page, described in the language.
+func newRankPage(rc rankConfig, scored []scoredCity, lang string) rankPage {
+	p := rankPage{
+		Title:   "By a mix of criteria",
+		Summary: rc.describe(lang),
+		Norm:    string(rc.norm),
+	}
+	for _, n := range normalizations {
+		p.Norms = append(p.Norms, string(n))
+	}
+	for _, wc := range rc.criteria {
+		p.Labels = append(p.Labels, wc.label)
+	}
+	// The rows go from the worst to the best, but the best is number 1, as
+	// on the city page and in Slack.
+	for i, sc := range scored {
+		row := rankRow{Rank: len(scored) - i, City: sc.city, Score: fmt.Sprintf("%.2f", sc.score)}
+		for _, s := range sc.scores {
+			row.Scores = append(row.Scores, fmt.Sprintf("%.2f", s))
+		}
+		p.Rows = append(p.Rows, row)
+	}
+	for _, c := range criteriaRegistry {
+		wi := weightInput{Name: c.name, Label: c.label, Log: logScaled[c.name], Higher: c.higherIsBetter}
+		for _, wc := range rc.criteria {
+			if wc.name == c.name {
+				wi.Weight = wc.weight
+				wi.Log = wc.logScale
+				wi.Higher = wc.higherIsBetter
+			}
+		}
+		p.Weights = append(p.Weights, wi)
+	}
+	return p
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// contains returns true if the item is in the list.
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRankConfig_score(t *testing.T) {
+	q, _ := url.ParseQuery("climate=2&cost=1")
+	rc, err := parseRankConfig(q)
+	if err != nil {
+		t.Fatalf("Oibai, parseRankConfig() failed: %v", err)
+	}
+	if rc.String() != "cost (33%) and climate (67%)" {
+		t.Errorf("Unexpected description %q", rc.String())
+	}
+	c := cities{}
+	for _, n := range []string{"Barcelona", "Copenhagen", "Deviltown", "New York", "Paradisio", "Stockholm"} {
+		found, _ := allCities().find(n)
+		c = append(c, found)
+	}
+	got := cities{}
+	for _, sc := range rc.score(c) {
+		got = append(got, sc.city)
+	}
+	want := "Deviltown, Copenhagen, Stockholm, New York, Barcelona, Paradisio"
+	if got.getNames() != want {
+		t.Errorf("The sorted cities by %v are:\n%v\nWant\n%v\n", rc, got.getNames(), want)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	type testCase struct {
+		values []float64
+		norm   normalization
+		want   []float64
+	}
+	cases := []testCase{
+		{values: []float64{1, 3, 5}, norm: minMaxNorm, want: []float64{0, 0.5, 1}},
+		{values: []float64{2, 2}, norm: minMaxNorm, want: []float64{0.5, 0.5}},
+		{values: []float64{10, 1000, 20, 20}, norm: rankNorm, want: []float64{0, 1, 0.5, 0.5}},
+		{values: []float64{1, 3}, norm: zScoreNorm, want: []float64{-1, 1}},
+		{values: []float64{4, 4}, norm: zScoreNorm, want: []float64{0, 0}},
+	}
+	for _, tc := range cases {
+		got := normalize(tc.values, tc.norm)
+		for i := range got {
+			if math.Abs(got[i]-tc.want[i]) > 1e-9 {
+				t.Errorf("normalize(%v, %v) = %v, want %v", tc.values, tc.norm, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseRankConfig(t *testing.T) {
+	type testCase struct {
+		query   string
+		wantErr bool
+	}
+	cases := []testCase{
+		{query: "population=1&log=&better=population:lower&norm=zscore"},
+		{query: "distance=1&to=Stockholm"},
+		{query: "", wantErr: true},
+		{query: "climate=0", wantErr: true},
+		{query: "climate=lots", wantErr: true},
+		{query: "climate=NaN&cost=1", wantErr: true},
+		{query: "climate=-1", wantErr: true},
+		{query: "climate=Inf", wantErr: true},
+		{query: "climate=1&norm=magic", wantErr: true},
+		{query: "climate=1&better=climate:sideways", wantErr: true},
+		{query: "distance=1", wantErr: true},
+	}
+	for _, tc := range cases {
+		q, _ := url.ParseQuery(tc.query)
+		rc, err := parseRankConfig(q)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseRankConfig(%q) error = %v, wantErr %v", tc.query, err, tc.wantErr)
+			continue
+		}
+		if tc.query == cases[0].query {
+			wc := rc.criteria[0]
+			if wc.logScale || wc.higherIsBetter || rc.norm != zScoreNorm {
+				t.Errorf("parseRankConfig(%q) ignored the options: %+v", tc.query, rc)
+			}
+		}
+	}
+}
+
+func TestRankHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rankHandler(rec, httptest.NewRequest(http.MethodGet, "/rank", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Dude, expected status 200, got %v", rec.Code)
+	}
+}
+
+func TestNewRankPage(t *testing.T) {
+	rc, scored, err := rankCities(url.Values{"climate": {"1"}})
+	if err != nil {
+		t.Fatalf("Oibai, rankCities() failed: %v", err)
+	}
+	p := newRankPage(rc, scored, "en")
+	best, worst := p.Rows[len(p.Rows)-1], p.Rows[0]
+	if best.Rank != 1 || best.City.name != "Paradisio" || worst.Rank != len(p.Rows) {
+		t.Errorf("Expected Paradisio, the best, to be number 1, got %+v and %+v", best, worst)
+	}
+}
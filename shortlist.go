@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type (
+	// shortlistStore keeps the cities each visitor is considering.
+	shortlistStore struct {
+		mu    sync.Mutex
+		file  string              // where the shortlists are saved, or "" to not save them
+		lists map[string][]string // city ids by visitor, in the order they were added
+	}
+
+	// shortlistPage is the data for the shortlist page.
+	shortlistPage struct {
+		Title    string
+		Cities   cities
+		Names    string // for links, e.g. "Barcelona,Stockholm"
+		Rankings []criterionLink
+	}
+)
+
+// Shortlists are the shortlists of visitors, they are only saved once main sets up the store.
+var Shortlists = &shortlistStore{lists: map[string][]string{}}
+
+// newShortlistStore returns a shortlist store that saves the shortlists in the file.
+//
+// The error is not nil when the file exists but can't be read.
+func newShortlistStore(file string) (*shortlistStore, error) {
+	s := &shortlistStore{file: file, lists: map[string][]string{}}
+	if err := loadJSON(file, &s.lists); err != nil {
+		return nil, fmt.Errorf("Oibai, I can't read the shortlists in %v: %v", file, err)
+	}
+	// Shortlists from before cities had ids have the cities by name.
+	all := allCities()
+	for _, ids := range s.lists {
+		for i, n := range ids {
+			if all.indexID(n) >= 0 {
+				continue
+			}
+			if c, ok := all.find(n); ok && c.id != "" {
+				ids[i] = c.id
+			} else if id, ok := History.idOf(n); ok && id != "" {
+				ids[i] = id
+			}
+		}
+	}
+	return s, nil
+}
+
+// add puts a city on the visitor's shortlist, if it isn't there yet.
+//
+// The error is not nil if there is no such city or the shortlist can't be saved.
+func (s *shortlistStore) add(visitor, cityName string) error {
+	c, ok := allCities().find(cityName)
+	if !ok || c.id == "" {
+		return fmt.Errorf("no city called %q", cityName)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if contains(s.lists[visitor], c.id) {
+		return nil
+	}
+	s.lists[visitor] = append(s.lists[visitor], c.id)
+	return s.save()
+}
+
+// remove takes a city off the visitor's shortlist.
+func (s *shortlistStore) remove(visitor, cityName string) error {
+	c, ok := allCities().find(cityName)
+	if !ok {
+		// Deleted cities are left out of the shortlist anyway.
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []string{}
+	for _, id := range s.lists[visitor] {
+		if id != c.id {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.lists, visitor)
+	} else {
+		s.lists[visitor] = kept
+	}
+	return s.save()
+}
+
+// of returns the names the cities on the visitor's shortlist have now,
+// leaving out cities that have been deleted since.
+func (s *shortlistStore) of(visitor string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := allCities()
+	names := []string{}
+	for _, id := range s.lists[visitor] {
+		if i := all.indexID(id); i >= 0 {
+			names = append(names, all[i].name)
+		}
+	}
+	return names
+}
+
+// save writes the shortlists to the file, the caller must hold the lock.
+func (s *shortlistStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	return saveJSON(s.file, s.lists)
+}
+
+// shortlisted returns which cities are on the visitor's shortlist, by name.
+func (s *shortlistStore) shortlisted(visitor string) map[string]bool {
+	on := map[string]bool{}
+	for _, n := range s.of(visitor) {
+		on[n] = true
+	}
+	return on
+}
+
+// visitorOf returns the id of the visitor, or "" if they don't have one yet.
+//
+// Unlike visitorID it doesn't set a cookie, for pages that only read.
+func visitorOf(r *http.Request) string {
+	if c, err := r.Cookie(visitorCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// shortlistQuery returns a copy of the query, with ?shortlist=1 turned into
+// the cities on the shortlist of the visitor making the request, e.g.
+// ?only=Barcelona,Stockholm, so that any ranking page can be limited to it.
+func shortlistQuery(r *http.Request, q url.Values) url.Values {
+	resolved := url.Values{}
+	for k, v := range q {
+		resolved[k] = v
+	}
+	if resolved.Get("shortlist") == "" {
+		return resolved
+	}
+	resolved.Del("shortlist")
+	resolved.Set("only", strings.Join(Shortlists.of(visitorOf(r)), ","))
+	return resolved
+}
+
+// filterOnly applies the "only" query parameter, e.g. ?only=Barcelona,Stockholm.
+//
+// The cities are returned as they are if there is no "only" parameter, and
+// none are if it is empty.
+func (cs cities) filterOnly(q url.Values) cities {
+	if _, ok := q["only"]; !ok {
+		return cs
+	}
+	names := splitList(strings.Join(q["only"], ","))
+	kept := cities{}
+	for _, c := range cs {
+		if contains(names, c.name) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// safeReturn returns the local path to go back to after a form, or the
+// fallback if it isn't one of ours.
+//
+// Browsers skip tabs and newlines in links and take a backslash for a slash,
+// so "/\t/evil.example" would take the visitor away; those aren't ours either.
+func safeReturn(back, fallback string) string {
+	if strings.IndexFunc(back, unicode.IsControl) >= 0 || strings.Contains(back, "\\") {
+		return fallback
+	}
+	u, err := url.Parse(back)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		return fallback
+	}
+	return back
+}
+
+// shortlistHandler shows the visitor's shortlist, and adds or removes a city
+// with a POST of "city" and "action", going back to "back" afterwards.
+func shortlistHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	visitor := visitorID(w, r)
+	if r.Method == "POST" {
+		if !sameOrigin(r) {
+			log.Printf("Stop right there, %v came to %v from %q!\n", r.RemoteAddr, r.URL, r.Header.Get("Origin")+r.Header.Get("Referer"))
+			serveErrorPage(w, http.StatusForbidden)
+			return
+		}
+		name := r.PostFormValue("city")
+		var err error
+		switch action := r.PostFormValue("action"); action {
+		case "add":
+			err = Shortlists.add(visitor, name)
+		case "remove":
+			err = Shortlists.remove(visitor, name)
+		default:
+			err = fmt.Errorf("no action %q", action)
+		}
+		if err != nil {
+			log.Printf("Bozhechki, I can't change the shortlist: %v\n", err)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, safeReturn(r.PostFormValue("back"), "/shortlist"), http.StatusSeeOther)
+		return
+	}
+	if r.Method != "GET" {
+		log.Printf("Madam, the method thou art using is wrong: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	names := Shortlists.of(visitor)
+	p := shortlistPage{Title: "My shortlist", Names: strings.Join(names, ","), Rankings: criteriaLinks()}
+	for _, n := range names {
+		c, _ := allCities().find(n)
+		p.Cities = append(p.Cities, c)
+	}
+	render(w, visitorLang(w, r), "html/shortlist.html.tmpl", p)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShortlistStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "shortlists.json")
+	s, err := newShortlistStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newShortlistStore() failed: %v", err)
+	}
+	s.add("anna", "Stockholm")
+	s.add("anna", "Barcelona")
+	s.add("anna", "Stockholm")
+	s.add("bob", "Paradisio")
+	if err := s.add("anna", "Atlantis"); err == nil {
+		t.Errorf("add() of a city we don't know should fail")
+	}
+	s.remove("bob", "Paradisio")
+
+	reloaded, err := newShortlistStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newShortlistStore() failed to reload: %v", err)
+	}
+	if got := strings.Join(reloaded.of("anna"), ", "); got != "Stockholm, Barcelona" {
+		t.Errorf("of(anna) = %v, want Stockholm, Barcelona", got)
+	}
+	if got := reloaded.of("bob"); len(got) != 0 {
+		t.Errorf("of(bob) = %v, want nothing", got)
+	}
+}
+
+func TestShortlistStore_renamed(t *testing.T) {
+	defer func(cs cities) { setCities(cs) }(allCities())
+	dir, err := ioutil.TempDir("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Shortlists from before cities had ids have their names.
+	file := filepath.Join(dir, "shortlists.json")
+	saveJSON(file, map[string][]string{"anna": {"Stockholm", "Barcelona"}})
+	s, err := newShortlistStore(file)
+	if err != nil {
+		t.Fatalf("Oibai, newShortlistStore() failed: %v", err)
+	}
+
+	renamed := append(cities{}, allCities()...)
+	renamed[renamed.index("Stockholm")].name = "Holmia"
+	setCities(renamed)
+	if got := strings.Join(s.of("anna"), ", "); got != "Holmia, Barcelona" {
+		t.Errorf("of(anna) = %v, want Holmia, Barcelona", got)
+	}
+	s.remove("anna", "Holmia")
+	if got := strings.Join(s.of("anna"), ", "); got != "Barcelona" {
+		t.Errorf("of(anna) = %v after removing Holmia, want Barcelona", got)
+	}
+}
+
+func TestSafeReturn(t *testing.T) {
+	type testCase struct {
+		back string
+		want string
+	}
+	cases := []testCase{
+		{back: "/by-climate?near=Oslo", want: "/by-climate?near=Oslo"},
+		{back: "/city/S%C3%A3o%20Paulo", want: "/city/S%C3%A3o%20Paulo"},
+		{back: "", want: "/shortlist"},
+		{back: "by-climate", want: "/shortlist"},
+		{back: "//evil.example", want: "/shortlist"},
+		{back: "/\\evil.example", want: "/shortlist"},
+		{back: "/\t/evil.example", want: "/shortlist"},
+		{back: "/\n/evil.example", want: "/shortlist"},
+		{back: "https://evil.example/", want: "/shortlist"},
+		{back: "javascript:alert(1)", want: "/shortlist"},
+		{back: "/%zz", want: "/shortlist"},
+	}
+	for _, tc := range cases {
+		if got := safeReturn(tc.back, "/shortlist"); got != tc.want {
+			t.Errorf("safeReturn(%q) = %q, want %q", tc.back, got, tc.want)
+		}
+	}
+}
+
+func TestShortlistHandler(t *testing.T) {
+	defer func(s *shortlistStore) { Shortlists = s }(Shortlists)
+	Shortlists = &shortlistStore{lists: map[string][]string{}}
+	cookie := &http.Cookie{Name: visitorCookie, Value: "anna"}
+
+	type testCase struct {
+		form     url.Values
+		origin   string // where the form was posted from, our own page if empty
+		wantCode int
+		wantLoc  string
+	}
+	cases := []testCase{
+		{form: url.Values{"city": {"Stockholm"}, "action": {"add"}, "back": {"/by-climate?near=Oslo"}}, wantCode: http.StatusSeeOther, wantLoc: "/by-climate?near=Oslo"},
+		{form: url.Values{"city": {"Barcelona"}, "action": {"add"}, "back": {"//evil.example"}}, wantCode: http.StatusSeeOther, wantLoc: "/shortlist"},
+		{form: url.Values{"city": {"Paradisio"}, "action": {"add"}}, wantCode: http.StatusSeeOther, wantLoc: "/shortlist"},
+		{form: url.Values{"city": {"Paradisio"}, "action": {"remove"}}, wantCode: http.StatusSeeOther, wantLoc: "/shortlist"},
+		{form: url.Values{"city": {"Atlantis"}, "action": {"add"}}, wantCode: http.StatusBadRequest},
+		{form: url.Values{"city": {"Stockholm"}, "action": {"dance"}}, wantCode: http.StatusBadRequest},
+		{form: url.Values{"city": {"Paradisio"}, "action": {"add"}}, origin: "https://evil.example", wantCode: http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/shortlist", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.origin == "" {
+			tc.origin = "http://example.com"
+		}
+		req.Header.Set("Origin", tc.origin)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		shortlistHandler(rec, req)
+		if rec.Code != tc.wantCode || rec.Header().Get("Location") != tc.wantLoc {
+			t.Errorf("POST %v: expected %v to %q, got %v to %q", tc.form, tc.wantCode, tc.wantLoc, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/shortlist", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	shortlistHandler(rec, req)
+	for _, want := range []string{`<a href="/city/Stockholm">`, `<a href="/city/Barcelona">`, "/compare?cities=Stockholm%2cBarcelona", "/by-climate?shortlist=1"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q on the shortlist page:\n%v", want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), "Paradisio") {
+		t.Errorf("Paradisio was removed from the shortlist")
+	}
+}
+
+func TestRankingPages_shortlist(t *testing.T) {
+	defer func(s *shortlistStore) { Shortlists = s }(Shortlists)
+	Shortlists = &shortlistStore{lists: map[string][]string{"anna": {"stockholm", "barcelona"}}}
+
+	type testCase struct {
+		url     string
+		handler http.Handler
+		cookie  string
+		want    []string
+		notWant string
+	}
+	cases := []testCase{
+		{url: "/by-climate?shortlist=1", handler: citiesHandler{"climate"}, cookie: "anna", want: []string{"Stockholm", "Barcelona", "Remove from shortlist", "show all cities"}, notWant: "Paradisio"},
+		{url: "/by-climate", handler: citiesHandler{"climate"}, cookie: "anna", want: []string{"Paradisio", "Add to shortlist", `value="/by-climate"`, "Only show my shortlist"}},
+		{url: "/by-climate?shortlist=1", handler: citiesHandler{"climate"}, cookie: "bob", want: []string{"show all cities"}, notWant: "Stockholm"},
+		{url: "/by-climate?shortlist=1&format=json", handler: citiesHandler{"climate"}, cookie: "anna", want: []string{`"name":"Barcelona"`}, notWant: "Paradisio"},
+		{url: "/rank?climate=1&shortlist=1", handler: http.HandlerFunc(rankHandler), cookie: "anna", want: []string{"Stockholm", `name="shortlist" value="1"`}, notWant: "Paradisio"},
+		{url: "/pareto?shortlist=1", handler: http.HandlerFunc(paretoHandler), cookie: "anna", want: []string{"Barcelona"}, notWant: "Paradisio"},
+		{url: "/cities.geojson?shortlist=1", handler: http.HandlerFunc(geoJSONHandler), cookie: "anna", want: []string{"Stockholm"}, notWant: "Paradisio"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.AddCookie(&http.Cookie{Name: visitorCookie, Value: tc.cookie})
+		rec := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %v: expected status 200, got %v", tc.url, rec.Code)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("GET %v as %v: expected %q in:\n%v", tc.url, tc.cookie, want, rec.Body.String())
+			}
+		}
+		if tc.notWant != "" && strings.Contains(rec.Body.String(), tc.notWant) {
+			t.Errorf("GET %v as %v: didn't expect %q in:\n%v", tc.url, tc.cookie, tc.notWant, rec.Body.String())
+		}
+	}
+}
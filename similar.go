@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type (
+	// similarCity is a city like another, with how alike they are.
+	similarCity struct {
+		City        city     `json:"-"`
+		Name        string   `json:"name"`
+		Similarity  float64  `json:"similarity"` // 1 for the same, 0 for as different as any two cities
+		Percent     string   `json:"-"`          // e.g. "92%"
+		Differences []string `json:"differences"`
+	}
+
+	// betterLink is a link to the cities like one but better by a criterion,
+	// e.g. "cheaper".
+	betterLink struct {
+		Name  string
+		Label string
+	}
+
+	// similarPage is the data for the page of cities like another.
+	similarPage struct {
+		Title   string        `json:"-"`
+		City    string        `json:"city"`
+		Better  string        `json:"better,omitempty"`
+		Label   string        `json:"-"` // e.g. "cheaper"
+		Similar []similarCity `json:"similar"`
+		Links   []betterLink  `json:"-"`
+	}
+)
+
+// maxSimilar is how many similar cities there may be at most.
+const maxSimilar = 50
+
+// features returns the values of the registered criteria for every city,
+// scaled from 0 to 1 over all the cities, by the name of the city.
+//
+// Criteria that are log scaled when ranking, e.g. population, are log
+// scaled here too, so that 1 and 2 million people are further apart than
+// 8.0 and 8.4 million.
+func (cs cities) features() map[string][]float64 {
+	f := map[string][]float64{}
+	for _, c := range cs {
+		f[c.name] = make([]float64, len(criteriaRegistry))
+	}
+	for j, cr := range criteriaRegistry {
+		values := make([]float64, len(cs))
+		for i, c := range cs {
+			values[i] = cr.value(c)
+			if logScaled[cr.name] {
+				values[i] = math.Log10(math.Max(values[i], 1))
+			}
+		}
+		for i, v := range normalize(values, minMaxNorm) {
+			f[cs[i].name][j] = v
+		}
+	}
+	return f
+}
+
+// similarTo returns the cities most like c, the most similar first.
+//
+// The similarity is 1 minus the root mean square of the differences of the
+// scaled criteria. With a better criterion, e.g. "cost", only the cities
+// that are better by it are returned, and it is left out of the
+// similarity, so that the rest is held close.
+func (cs cities) similarTo(c city, better *criterion, lang string) []similarCity {
+	f := cs.features()
+	similar := []similarCity{}
+	for _, other := range cs {
+		if other.name == c.name || (better != nil && !better.better(other, c)) {
+			continue
+		}
+		sum, n := 0.0, 0
+		for j, cr := range criteriaRegistry {
+			if better != nil && cr.name == better.name {
+				continue
+			}
+			d := f[c.name][j] - f[other.name][j]
+			sum += d * d
+			n++
+		}
+		s := 1.0
+		if n > 0 {
+			s = 1 - math.Sqrt(sum/float64(n))
+		}
+		sc := similarCity{City: other, Name: other.name, Similarity: math.Round(s*100) / 100, Percent: fmt.Sprintf("%.0f%%", 100*s)}
+		for _, cr := range criteriaRegistry {
+			if a, b := cr.describe(other, lang), cr.describe(c, lang); a != b {
+				sc.Differences = append(sc.Differences, fmt.Sprintf(tr(lang, "%s: %s instead of %s"), tr(lang, cr.label), a, b))
+			}
+		}
+		similar = append(similar, sc)
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Similarity > similar[j].Similarity })
+	return similar
+}
+
+// betterLinks returns the links to the cities like one but better by each criterion.
+func betterLinks() []betterLink {
+	links := []betterLink{}
+	for _, cr := range criteriaRegistry {
+		links = append(links, betterLink{Name: cr.name, Label: cr.improved})
+	}
+	return links
+}
+
+// similarHandler shows the cities like another, e.g. /similar?city=Barcelona,
+// or like it but better by a criterion, e.g. &better=cost for cheaper ones.
+//
+// At most 10 cities are shown, or as many as ?n= asks for. With
+// ?format=json the cities are JSON.
+func similarHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	if r.Method != "GET" {
+		log.Printf("This ain't right: %v!\n", r.Method)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	c, ok := allCities().find(q.Get("city"))
+	if !ok {
+		log.Printf("Sirree, there is no city %q!\n", q.Get("city"))
+		serveErrorPage(w, http.StatusNotFound)
+		return
+	}
+	var better *criterion
+	if name := q.Get("better"); name != "" {
+		if better, ok = lookupCriterion(name); !ok {
+			log.Printf("Ai-ai-ai, bad query %q: no criteria called %q\n", r.URL.RawQuery, name)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+	}
+	n := 10
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > maxSimilar {
+			log.Printf("Ai-ai-ai, bad query %q: n must be 1 to %v\n", r.URL.RawQuery, maxSimilar)
+			serveErrorPage(w, http.StatusBadRequest)
+			return
+		}
+	}
+	lang := visitorLang(w, r)
+	if q.Get("format") == "json" {
+		lang = languages[0].Tag
+	}
+	p := similarPage{Title: fmt.Sprintf(tr(lang, "Cities like %s"), c.name), City: c.name, Similar: allCities().similarTo(c, better, lang), Links: betterLinks()}
+	if better != nil {
+		p.Better = better.name
+		p.Label = better.improved
+		p.Title = fmt.Sprintf(tr(lang, "Cities like %s but %s"), c.name, tr(lang, better.improved))
+	}
+	if len(p.Similar) > n {
+		p.Similar = p.Similar[:n]
+	}
+	if q.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			log.Printf("Oibai, I couldn't write the JSON: %v\n", err)
+		}
+		return
+	}
+	render(w, lang, "html/similar.html.tmpl", p)
+}
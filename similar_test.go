@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSimilarTo(t *testing.T) {
+	cost, _ := lookupCriterion("cost")
+	climate, _ := lookupCriterion("climate")
+	type testCase struct {
+		name   string
+		better *criterion
+		want   string
+	}
+	cases := []testCase{
+		{name: "Stockholm", want: "Copenhagen, Seattle, New York, Barcelona, Deviltown, Paradisio"},
+		{name: "Barcelona", better: cost, want: "Paradisio"},
+		{name: "Stockholm", better: climate, want: "Seattle, Barcelona, New York, Paradisio"},
+		{name: "Paradisio", better: climate, want: ""},
+	}
+	for _, tc := range cases {
+		c, _ := allCities().find(tc.name)
+		names := []string{}
+		for _, s := range allCities().similarTo(c, tc.better, "en") {
+			names = append(names, s.Name)
+		}
+		if got := strings.Join(names, ", "); got != tc.want {
+			t.Errorf("similarTo(%v) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	s, _ := allCities().find("Stockholm")
+	similar := allCities().similarTo(s, nil, "en")
+	if similar[0].Similarity <= similar[len(similar)-1].Similarity || similar[0].Similarity > 1 || similar[len(similar)-1].Similarity < 0 {
+		t.Errorf("Expected similarities from 1 down to 0, got %+v", similar)
+	}
+	want := []string{"Population: 562 379 instead of 789 024"}
+	if d := similar[0].Differences; len(d) != 1 || d[0] != want[0] {
+		t.Errorf("Expected Copenhagen to only differ by %v, got %v", want, d)
+	}
+}
+
+func TestSimilarHandler(t *testing.T) {
+	type testCase struct {
+		url      string
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{url: "/similar?city=Stockholm", wantCode: http.StatusOK, wantText: "Cities like Stockholm"},
+		{url: "/similar?city=Barcelona&better=cost", wantCode: http.StatusOK, wantText: "Cities like Barcelona but cheaper"},
+		{url: "/similar?city=Barcelona&better=cost&lang=ru", wantCode: http.StatusOK, wantText: "Города как Barcelona, но дешевле"},
+		{url: "/similar?city=Paradisio&better=climate", wantCode: http.StatusOK, wantText: "There are no such cities yet."},
+		{url: "/similar?city=Atlantis", wantCode: http.StatusNotFound},
+		{url: "/similar?city=Barcelona&better=happiness", wantCode: http.StatusBadRequest},
+		{url: "/similar?city=Barcelona&n=0", wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		similarHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("GET %v: expected %v with %q, got %v:\n%v", tc.url, tc.wantCode, tc.wantText, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSimilarHandler_json(t *testing.T) {
+	rec := httptest.NewRecorder()
+	similarHandler(rec, httptest.NewRequest(http.MethodGet, "/similar?city=Stockholm&n=2&format=json", nil))
+	got := similarPage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Oibai, the JSON doesn't parse: %v\n%v", err, rec.Body.String())
+	}
+	if got.City != "Stockholm" || len(got.Similar) != 2 || got.Similar[0].Name != "Copenhagen" || got.Similar[0].Similarity != 0.97 {
+		t.Errorf("Unexpected similar cities: %+v", got)
+	}
+}
+
+func TestCityHandler_similar(t *testing.T) {
+	rec := httptest.NewRecorder()
+	cityHandler(rec, httptest.NewRequest(http.MethodGet, "/city/Stockholm", nil))
+	for _, want := range []string{"Cities like Stockholm", `<a href="/city/Copenhagen">`, `/similar?city=Stockholm&amp;better=cost">cheaper</a>`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q on the city page:\n%v", want, rec.Body.String())
+		}
+	}
+}
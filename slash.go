@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	// slackResponse is the answer to a slash command, see
+	// https://api.slack.com/interactivity/slash-commands#responding_to_commands.
+	slackResponse struct {
+		ResponseType string       `json:"response_type"` // "in_channel" for all to see, or "ephemeral"
+		Text         string       `json:"text"`          // for notifications, or all there is without blocks
+		Blocks       []slackBlock `json:"blocks,omitempty"`
+	}
+
+	// slackBlock is a Block Kit block, see https://api.slack.com/block-kit.
+	slackBlock struct {
+		Type     string      `json:"type"` // "section", "context" or "divider"
+		Text     *slackText  `json:"text,omitempty"`
+		Fields   []slackText `json:"fields,omitempty"`
+		Elements []slackText `json:"elements,omitempty"`
+	}
+
+	// slackText is Block Kit text in Slack's markdown.
+	slackText struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+)
+
+// slashTop is how many cities a ranking in Slack shows.
+const slashTop = 10
+
+// slackMaxFields is how many fields Slack takes in a section block, see
+// https://api.slack.com/reference/block-kit/blocks#section.
+const slackMaxFields = 10
+
+// slashHelp says what the slash command does.
+const slashHelp = "Howdy! Try `/cities rank climate=2 cost=1`, with the weights and filters of " +
+	"the rank page, e.g. `near=Stockholm`, `/cities by climate near=Stockholm` like on the " +
+	"/by-climate page, or `/cities show Barcelona`."
+
+// markdown returns Block Kit text in Slack's markdown.
+func markdown(format string, args ...interface{}) *slackText {
+	return &slackText{Type: "mrkdwn", Text: fmt.Sprintf(format, args...)}
+}
+
+// slackEscape escapes the characters Slack's markdown takes for links.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackMarkup matches Slack's links and mentions, e.g. <https://example.com|text> or <@U123>.
+var slackMarkup = regexp.MustCompile(`<([^<>]*)>`)
+
+// slackUnescape turns a message from Slack into plain text: links become
+// their text with the address after it, mentions their name, and the
+// escaped characters themselves, see
+// https://api.slack.com/reference/surfaces/formatting#escaping.
+func slackUnescape(s string) string {
+	s = slackMarkup.ReplaceAllStringFunc(s, func(m string) string {
+		target, label := m[1:len(m)-1], ""
+		if i := strings.Index(target, "|"); i >= 0 {
+			target, label = target[:i], target[i+1:]
+		}
+		switch {
+		case target == "":
+			return label
+		case target[0] == '@' || target[0] == '#':
+			// Users and channels, <@U123|aruna> or <#C123|general>.
+			if label == "" {
+				return target
+			}
+			return target[:1] + strings.TrimPrefix(label, target[:1])
+		case target[0] == '!':
+			// Special mentions, <!here> or <!subteam^S123|@team>.
+			if label == "" {
+				return "@" + target[1:]
+			}
+			return label
+		}
+		address := strings.TrimPrefix(target, "mailto:")
+		if label == "" || label == address || label == target {
+			return address
+		}
+		return label + " (" + address + ")"
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+// slackLink returns a link to our path in Slack's markdown.
+func slackLink(path, text string) string {
+	return fmt.Sprintf("<%s|%s>", BaseURL+path, slackEscape(text))
+}
+
+// slashQuery returns the query for the arguments of the command, e.g.
+// climate=2 cost=1 for ?climate=2&cost=1, or the default ranking without any.
+func slashQuery(args []string) (url.Values, error) {
+	if len(args) == 0 {
+		return defaultRankQuery(), nil
+	}
+	q := url.Values{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not like climate=2", arg)
+		}
+		q.Add(parts[0], parts[1])
+	}
+	return q, nil
+}
+
+// slashRank answers /cities rank with the best cities, ranked like on the
+// rank page by a weighted set of criteria, which citiesHandler doesn't do:
+// it ranks by one criterion, see slashBy.
+func slashRank(args []string) (slackResponse, error) {
+	q, err := slashQuery(args)
+	if err != nil {
+		return slackResponse{}, err
+	}
+	rc, scored, err := rankCities(q)
+	if err != nil {
+		return slackResponse{}, err
+	}
+	lang := languages[0].Tag
+	summary := "Cities by " + rc.describe(lang)
+	lines := []string{}
+	for i := len(scored) - 1; i >= 0 && len(lines) < slashTop; i-- {
+		sc := scored[i]
+		lines = append(lines, fmt.Sprintf("%d. %s, %s: %.2f", len(lines)+1, slackLink(sc.URL(), sc.name), slackEscape(sc.country), sc.score))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No cities match.")
+	}
+	more := fmt.Sprintf("%d cities in all, %s", len(scored), slackLink("/rank?"+q.Encode(), "see them on the rank page"))
+	return slackResponse{
+		ResponseType: "in_channel",
+		Text:         summary,
+		Blocks: []slackBlock{
+			{Type: "section", Text: markdown("*%s*", slackEscape(summary))},
+			{Type: "section", Text: markdown("%s", strings.Join(lines, "\n"))},
+			{Type: "context", Elements: []slackText{*markdown("%s", more)}},
+		},
+	}, nil
+}
+
+// slashBy answers /cities by with the best cities by one criterion, e.g.
+// "/cities by climate near=Stockholm", ranked by the same code as the
+// /by-climate page, see citiesHandler.
+func slashBy(args []string) (slackResponse, error) {
+	if len(args) == 0 {
+		return slackResponse{}, fmt.Errorf("by what, e.g. climate")
+	}
+	q := url.Values{}
+	if len(args) > 1 {
+		var err error
+		if q, err = slashQuery(args[1:]); err != nil {
+			return slackResponse{}, err
+		}
+	}
+	criteria := args[0]
+	q.Set("by", criteria)
+	c, err := criterionFor(criteria, q)
+	if err != nil {
+		return slackResponse{}, err
+	}
+	ranked, err := exportView(q)
+	if err != nil {
+		return slackResponse{}, err
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].rank < ranked[j].rank })
+	lang := languages[0].Tag
+	summary := "Cities by " + tr(lang, criteria)
+	lines := []string{}
+	for _, rc := range ranked {
+		if len(lines) == slashTop {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s, %s: %s", rc.rank, slackLink(rc.URL(), rc.name), slackEscape(rc.country), slackEscape(c.describe(rc.city, lang))))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No cities match.")
+	}
+	q.Del("by")
+	more := fmt.Sprintf("%d cities in all, %s", len(ranked), slackLink("/by-"+criteria+"?"+q.Encode(), "see them on the /by-"+criteria+" page"))
+	return slackResponse{
+		ResponseType: "in_channel",
+		Text:         summary,
+		Blocks: []slackBlock{
+			{Type: "section", Text: markdown("*%s*", slackEscape(summary))},
+			{Type: "section", Text: markdown("%s", strings.Join(lines, "\n"))},
+			{Type: "context", Elements: []slackText{*markdown("%s", more)}},
+		},
+	}, nil
+}
+
+// slashShow answers /cities show with what the city page says about a city.
+func slashShow(name string) (slackResponse, error) {
+	all := allCities()
+	c, ok := all.find(name)
+	if !ok {
+		return slackResponse{}, fmt.Errorf("there is no city %q", name)
+	}
+	lang := languages[0].Tag
+	rc, err := parseRankConfig(defaultRankQuery())
+	if err != nil {
+		return slackResponse{}, err
+	}
+	p := newCityPage(c, all, rc, defaultRankQuery(), "", lang)
+	blocks := []slackBlock{{Type: "section", Text: markdown("*%s*", slackLink(c.URL(), c.name))}}
+	for _, a := range append(p.Attributes, p.Costs...) {
+		if a.Value == "" {
+			continue
+		}
+		// Slack takes so many fields in a section, the rest go in the next.
+		if last := &blocks[len(blocks)-1]; last.Text == nil && len(last.Fields) < slackMaxFields {
+			last.Fields = append(last.Fields, *markdown("*%s*\n%s", a.Label, slackEscape(a.Value)))
+			continue
+		}
+		blocks = append(blocks, slackBlock{Type: "section", Fields: []slackText{*markdown("*%s*\n%s", a.Label, slackEscape(a.Value))}})
+	}
+	blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{*markdown("Number %d of %d by %s, with a score of %s.", p.ScoreRank, p.Of, slackEscape(p.Summary), p.Score)}})
+	return slackResponse{
+		ResponseType: "in_channel",
+		Text:         c.name,
+		Blocks:       blocks,
+	}, nil
+}
+
+// slashHandler answers the /cities slash command in Slack, e.g.
+// "/cities rank climate=2 cost=1" or "/cities show Barcelona".
+//
+// Mistakes are answered to whoever made them only, with how to do it right.
+func slashHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("You are all my minions, %q, beware  %v, %v!\n", r.RemoteAddr, r.Method, r.URL)
+	body, ok := readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		log.Printf("Ai-ai-ai, I can't read what Slack sent: %v\n", err)
+		serveErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	args := strings.Fields(form.Get("text"))
+	resp := slackResponse{ResponseType: "ephemeral", Text: slashHelp}
+	switch {
+	case len(args) == 0 || args[0] == "help":
+	case args[0] == "rank":
+		resp, err = slashRank(args[1:])
+	case args[0] == "by":
+		resp, err = slashBy(args[1:])
+	case args[0] == "show" && len(args) > 1:
+		resp, err = slashShow(strings.Join(args[1:], " "))
+	default:
+		err = fmt.Errorf("I don't know %q", form.Get("text"))
+	}
+	if err != nil {
+		log.Printf("Sirree %v, that's not right: %v\n", form.Get("user_name"), err)
+		resp = slackResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("Oibai, %v. %v", err, slashHelp)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Oibai, I couldn't write the JSON: %v\n", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// text returns all the text in the response.
+func (resp slackResponse) text() string {
+	all := []string{resp.Text}
+	for _, b := range resp.Blocks {
+		if b.Text != nil {
+			all = append(all, b.Text.Text)
+		}
+		for _, t := range append(b.Fields, b.Elements...) {
+			all = append(all, t.Text)
+		}
+	}
+	return strings.Join(all, "\n")
+}
+
+func TestSlashQuery(t *testing.T) {
+	type testCase struct {
+		args    string
+		want    string
+		wantErr bool
+	}
+	cases := []testCase{
+		{args: "", want: "climate=2&cost=1"},
+		{args: "climate=1 near=Stockholm", want: "climate=1&near=Stockholm"},
+		{args: "log=population log=cost", want: "log=population&log=cost"},
+		{args: "climate", wantErr: true},
+		{args: "=2", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := slashQuery(strings.Fields(tc.args))
+		if (err != nil) != tc.wantErr || (err == nil && got.Encode() != tc.want) {
+			t.Errorf("slashQuery(%q) = %v, %v, want %v", tc.args, got.Encode(), err, tc.want)
+		}
+	}
+}
+
+func TestSlackUnescape(t *testing.T) {
+	type testCase struct {
+		text string
+		want string
+	}
+	cases := []testCase{
+		{text: "Oslo &amp; Bergen are &lt;3 &gt; Lima", want: "Oslo & Bergen are <3 > Lima"},
+		{text: "See <https://example.com/city/Oslo|Oslo>", want: "See Oslo (https://example.com/city/Oslo)"},
+		{text: "See <https://example.com/>", want: "See https://example.com/"},
+		{text: "Mail <mailto:aruna@example.com|aruna@example.com>", want: "Mail aruna@example.com"},
+		{text: "Ask <@U123|aruna> or <@U456>", want: "Ask @aruna or @U456"},
+		{text: "In <#C123|general>, <!here>", want: "In #general, @here"},
+		{text: "<https://example.com/?a=1&amp;b=2|a &amp; b>", want: "a & b (https://example.com/?a=1&b=2)"},
+	}
+	for _, tc := range cases {
+		if got := slackUnescape(tc.text); got != tc.want {
+			t.Errorf("slackUnescape(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestSlashHandler(t *testing.T) {
+	defer func(secret, base string) { SlackSigningSecret, BaseURL = secret, base }(SlackSigningSecret, BaseURL)
+	SlackSigningSecret = "s3cret"
+	BaseURL = "https://cities.example"
+	_, scored, err := rankCities(url.Values{"climate": {"2"}, "cost": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	best := scored[len(scored)-1]
+
+	type testCase struct {
+		text     string
+		secret   string
+		wantCode int
+		wantType string
+		want     []string
+	}
+	cases := []testCase{
+		{text: "rank climate=2 cost=1", secret: "s3cret", wantCode: http.StatusOK, wantType: "in_channel", want: []string{
+			"*Cities by cost (33%) and climate (67%)*",
+			"1. <https://cities.example" + best.URL() + "|" + best.name + ">",
+			"<https://cities.example/rank?climate=2&cost=1|see them on the rank page>",
+		}},
+		{text: "rank", secret: "s3cret", wantCode: http.StatusOK, wantType: "in_channel", want: []string{"cost (33%) and climate (67%)"}},
+		{text: "show " + best.name, secret: "s3cret", wantCode: http.StatusOK, wantType: "in_channel", want: []string{
+			"*<https://cities.example" + best.URL() + "|" + best.name + ">*",
+			"*Country*\n" + best.country,
+			"Number 1 of ",
+		}},
+		{text: "by climate near=Stockholm within_km=1500", secret: "s3cret", wantCode: http.StatusOK, wantType: "in_channel", want: []string{
+			"*Cities by climate*",
+			"1. <https://cities.example/city/Stockholm|Stockholm>, Sweden: poor",
+			"<https://cities.example/by-climate?near=Stockholm&within_km=1500|see them on the /by-climate page>",
+		}},
+		{text: "by population", secret: "s3cret", wantCode: http.StatusOK, wantType: "in_channel", want: []string{"1. <https://cities.example/city/Deviltown|Deviltown>"}},
+		{text: "by happiness", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{`no criteria called "happiness"`}},
+		{text: "by", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{"by what"}},
+		{text: "show Atlantis", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{`there is no city "Atlantis"`, "Try `/cities rank"}},
+		{text: "rank climate=hot", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{"bad weight"}},
+		{text: "dance", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{`I don't know "dance"`}},
+		{text: "", secret: "s3cret", wantCode: http.StatusOK, wantType: "ephemeral", want: []string{"Howdy!"}},
+		{text: "rank", secret: "guess", wantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		body := url.Values{"command": {"/cities"}, "text": {tc.text}, "user_name": {"aruna"}}.Encode()
+		rec := httptest.NewRecorder()
+		slashHandler(rec, slackRequest("/slack/commands", body, tc.secret, time.Now()))
+		if rec.Code != tc.wantCode {
+			t.Errorf("/cities %v: expected %v, got %v: %v", tc.text, tc.wantCode, rec.Code, rec.Body.String())
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		got := slackResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Oibai, /cities %v didn't answer JSON: %v", tc.text, err)
+		}
+		if got.ResponseType != tc.wantType {
+			t.Errorf("/cities %v: expected a %v response, got %v", tc.text, tc.wantType, got.ResponseType)
+		}
+		for _, b := range got.Blocks {
+			if len(b.Fields) > slackMaxFields {
+				t.Errorf("/cities %v: Slack takes at most %v fields in a section, got %v", tc.text, slackMaxFields, len(b.Fields))
+			}
+		}
+		text := got.text()
+		for _, want := range tc.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("/cities %v: expected %q in:\n%v", tc.text, want, text)
+			}
+		}
+	}
+}
+
+func TestSlashShow_manyFields(t *testing.T) {
+	defer func(cs cities) { setCities(cs) }(allCities())
+	cs := append(cities{}, allCities()...)
+	i := cs.index("Barcelona")
+	cs[i].costs = costBreakdown{currency: "EUR", rent1BR: 900, rent3BR: 1600, groceries: 250, transport: 40, eatingOut: 200, utilities: 120}
+	setCities(cs)
+
+	got, err := slashShow("Barcelona")
+	if err != nil {
+		t.Fatalf("Oibai, slashShow() failed: %v", err)
+	}
+	all := []string{}
+	for _, b := range got.Blocks {
+		if len(b.Fields) > slackMaxFields {
+			t.Errorf("Slack takes at most %v fields in a section, got %v", slackMaxFields, len(b.Fields))
+		}
+		for _, f := range b.Fields {
+			all = append(all, f.Text)
+		}
+	}
+	if len(all) <= slackMaxFields || !strings.Contains(strings.Join(all, "\n"), "*Total for one person*") {
+		t.Errorf("Expected all the attributes of Barcelona over more than one section, got %q", all)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type (
+	// cityRecord is a city as we save it in JSON files.
+	cityRecord struct {
+		ID         string       `json:"id,omitempty"`
+		Name       string       `json:"name"`
+		Population int          `json:"population"`
+		Cost       cost         `json:"cost"`
+		Climate    climate      `json:"climate"`
+		Country    string       `json:"country,omitempty"`
+		Region     string       `json:"region,omitempty"`
+		Lat        float64      `json:"lat"`
+		Lon        float64      `json:"lon"`
+		Costs      *costsRecord `json:"costs,omitempty"`
+	}
+	costsRecord struct {
+		Currency  string  `json:"currency"`
+		Rent1BR   float64 `json:"rent_1br"`
+		Rent3BR   float64 `json:"rent_3br"`
+		Groceries float64 `json:"groceries"`
+		Transport float64 `json:"transport"`
+		EatingOut float64 `json:"eating_out"`
+		Utilities float64 `json:"utilities"`
+	}
+)
+
+// visitorCookie is the name of the cookie that tells visitors apart.
+const visitorCookie = "cities_visitor"
+
+// lockData takes the lock on the data in the directory, which the server
+// holds as long as it runs, so that a command that writes the data, e.g. an
+// import, doesn't have its work overwritten by a running server.
+//
+// The lock goes away with the process, close the file to let it go before.
+func lockData(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "cities.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("someone else is using the data in %v, is the server running? Stop it first", dir)
+	}
+	return f, nil
+}
+
+// loadJSON reads the JSON file into v.
+//
+// It's not an error if the file doesn't exist yet, v is left as it is.
+func loadJSON(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON writes v to the JSON file, creating its directory if needed.
+//
+// The file is written to a temporary file first, so it is never half written.
+func saveJSON(file string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// randomID returns a random hex string with n bytes of randomness.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// visitorID returns the id of the visitor, setting a cookie with a new id
+// if they don't have one yet.
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(visitorCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	id := randomID(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   10 * 365 * 24 * 60 * 60,
+		HttpOnly: true,
+	})
+	return id
+}
+
+// record returns the city as we save it.
+func (c city) record() cityRecord {
+	r := cityRecord{
+		ID:         c.id,
+		Name:       c.name,
+		Population: c.population,
+		Cost:       c.cost,
+		Climate:    c.climate,
+		Country:    c.country,
+		Region:     c.region,
+		Lat:        c.lat,
+		Lon:        c.lon,
+	}
+	if c.costs.known() {
+		r.Costs = &costsRecord{
+			Currency:  c.costs.currency,
+			Rent1BR:   c.costs.rent1BR,
+			Rent3BR:   c.costs.rent3BR,
+			Groceries: c.costs.groceries,
+			Transport: c.costs.transport,
+			EatingOut: c.costs.eatingOut,
+			Utilities: c.costs.utilities,
+		}
+	}
+	return r
+}
+
+// city returns the city that was saved.
+func (r cityRecord) city() city {
+	c := city{
+		id:         r.ID,
+		name:       r.Name,
+		population: r.Population,
+		cost:       r.Cost,
+		climate:    r.Climate,
+		country:    r.Country,
+		region:     r.Region,
+		lat:        r.Lat,
+		lon:        r.Lon,
+	}
+	if r.Costs != nil {
+		c.costs = costBreakdown{
+			currency:  r.Costs.Currency,
+			rent1BR:   r.Costs.Rent1BR,
+			rent3BR:   r.Costs.Rent3BR,
+			groceries: r.Costs.Groceries,
+			transport: r.Costs.Transport,
+			eatingOut: r.Costs.EatingOut,
+			utilities: r.Costs.Utilities,
+		}
+	}
+	return c
+}
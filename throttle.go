@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttle stops anyone from doing something more than a limit of times in
+// a window, e.g. voting 30 times an hour, telling them apart by their IP.
+type throttle struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	now       func() time.Time
+	seen      map[string][]time.Time // when each IP did it, in the last window
+	lastSweep time.Time
+}
+
+// newThrottle returns a throttle that allows the limit in the window.
+func newThrottle(limit int, window time.Duration) *throttle {
+	return &throttle{limit: limit, window: window, now: time.Now, seen: map[string][]time.Time{}}
+}
+
+// allow returns true and counts it if the IP did it less than the limit
+// of times in the last window.
+func (t *throttle) allow(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if now.Sub(t.lastSweep) > t.window {
+		// Forget the IPs that have been quiet, so the map doesn't grow forever.
+		for other := range t.seen {
+			t.forget(other, now)
+		}
+		t.lastSweep = now
+	}
+	if t.forget(ip, now) >= t.limit {
+		return false
+	}
+	t.seen[ip] = append(t.seen[ip], now)
+	return true
+}
+
+// forget drops the times before the window for the IP and returns how many
+// are left, the caller must hold the lock.
+func (t *throttle) forget(ip string, now time.Time) int {
+	times := t.seen[ip]
+	for len(times) > 0 && now.Sub(times[0]) >= t.window {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(t.seen, ip)
+		return 0
+	}
+	t.seen[ip] = times
+	return len(times)
+}
+
+// remoteIP returns the IP of the visitor, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(2, time.Hour)
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	th.now = func() time.Time { return now }
+
+	type testCase struct {
+		after time.Duration
+		ip    string
+		want  bool
+	}
+	cases := []testCase{
+		{ip: "10.0.0.1", want: true},
+		{after: time.Minute, ip: "10.0.0.1", want: true},
+		{after: time.Minute, ip: "10.0.0.1", want: false},
+		{ip: "10.0.0.2", want: true},
+		{after: 58 * time.Minute, ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: false},
+		{after: 2 * time.Hour, ip: "10.0.0.1", want: true},
+	}
+	for i, tc := range cases {
+		now = now.Add(tc.after)
+		if got := th.allow(tc.ip); got != tc.want {
+			t.Errorf("%v: allow(%q) = %v, want %v", i, tc.ip, got, tc.want)
+		}
+	}
+	if _, ok := th.seen["10.0.0.2"]; ok {
+		t.Errorf("Expected the quiet IP to be forgotten, got %v", th.seen)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	type testCase struct {
+		remoteAddr string
+		want       string
+	}
+	cases := []testCase{
+		{remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{remoteAddr: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{remoteAddr: "pipe", want: "pipe"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if got := remoteIP(req); got != tc.want {
+			t.Errorf("remoteIP(%q) = %q, want %q", tc.remoteAddr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type (
+	// fieldError is what is wrong with a field of a city, e.g. the name.
+	fieldError struct {
+		Field   string        // e.g. "name" or "population"
+		Message string        // in English, translated with tr, e.g. "The name is too long, at most %d characters."
+		Args    []interface{} // for the message
+	}
+
+	// fieldErrors is everything that is wrong with a city.
+	fieldErrors []fieldError
+)
+
+const (
+	maxNameLength = 100        // in characters, for the name, country and region
+	maxPopulation = 2000000000 // more than any city has, and than Deviltown
+)
+
+// normalizeName returns the name without leading, trailing or repeated
+// spaces, without invisible characters, and with letters and combining marks
+// composed, so that "  Malm\u00f6 " and "Malmo\u0308" are the same city.
+func normalizeName(name string) string {
+	out := []rune{}
+	for _, r := range name {
+		if unicode.IsSpace(r) {
+			out = append(out, ' ')
+			continue
+		}
+		if unicode.In(r, unicode.Cc, unicode.Cf) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return norm.NFC.String(strings.Join(strings.Fields(string(out)), " "))
+}
+
+// validateCity returns the city with its names normalized, and an error if
+// anything is wrong with it.
+//
+// A population, cost or climate of 0 means we don't know it yet, e.g. for a
+// submitted city. The error is fieldErrors, so it can be shown by the field.
+func validateCity(c city) (city, error) {
+	errs := fieldErrors{}
+	c.name = normalizeName(c.name)
+	c.country = normalizeName(c.country)
+	c.region = normalizeName(c.region)
+	if c.name == "" {
+		errs.add("name", "The name is missing.")
+	} else if strings.IndexFunc(c.name, unicode.IsLetter) < 0 {
+		errs.add("name", "The name needs a letter.")
+	}
+	lengths := []struct {
+		field, value, message string
+	}{
+		{"name", c.name, "The name is too long, at most %d characters."},
+		{"country", c.country, "The country is too long, at most %d characters."},
+		{"region", c.region, "The region is too long, at most %d characters."},
+	}
+	for _, l := range lengths {
+		if len([]rune(l.value)) > maxNameLength {
+			errs.add(l.field, l.message, maxNameLength)
+		}
+	}
+	if c.population < 0 || c.population > maxPopulation {
+		errs.add("population", "The population must be between 0 and %s.", formatPopulation(maxPopulation))
+	}
+	if c.cost != 0 && c.cost.String() == "" {
+		errs.add("cost", "Pick a cost from the list.")
+	}
+	if c.climate != 0 && c.climate.String() == "" {
+		errs.add("climate", "Pick a climate from the list.")
+	}
+	// Written so that NaN fails too.
+	if !(c.lat >= -90 && c.lat <= 90) {
+		errs.add("lat", "The latitude must be between -90 and 90.")
+	}
+	if !(c.lon >= -180 && c.lon <= 180) {
+		errs.add("lon", "The longitude must be between -180 and 180.")
+	}
+	if b := c.costs; b.known() {
+		if _, ok := EURRates[b.currency]; !ok {
+			errs.add("costs", "We don't know the currency %s.", b.currency)
+		}
+		for _, amount := range []float64{b.rent1BR, b.rent3BR, b.groceries, b.transport, b.eatingOut, b.utilities} {
+			// Written so that NaN fails too.
+			if !(amount >= 0) {
+				errs.add("costs", "The costs can't be negative.")
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// add adds what is wrong with a field.
+func (errs *fieldErrors) add(field, message string, args ...interface{}) {
+	*errs = append(*errs, fieldError{Field: field, Message: message, Args: args})
+}
+
+// In returns what is wrong with the field in the language.
+func (e fieldError) In(lang string) string {
+	return fmt.Sprintf(tr(lang, e.Message), e.Args...)
+}
+
+// Error returns everything that is wrong, in English.
+func (errs fieldErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.In("en")
+	}
+	return strings.Join(messages, " ")
+}
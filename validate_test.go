@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	type testCase struct {
+		name string
+		want string
+	}
+	cases := []testCase{
+		{name: "  barcelona ", want: "barcelona"},
+		{name: "New \t  York", want: "New York"},
+		{name: "Malmo\u0308", want: "Malm\u00f6"},
+		{name: "Krako\u0301w", want: "Krak\u00f3w"},
+		{name: "Sa\u0303o\u00a0Paulo", want: "S\u00e3o Paulo"},
+		{name: "Zu\u200b\u0308rich\x00", want: "Z\u00fcrich"},
+		{name: "Qa\u0308\u0308", want: "Q\u00e4\u0308"},
+		{name: "Алматы", want: "Алматы"},
+		{name: "Ha\u0302\u0323i Pho\u0300ng", want: "H\u1eadi Ph\u00f2ng"},
+		{name: " \n ", want: ""},
+	}
+	for _, tc := range cases {
+		if got := normalizeName(tc.name); got != tc.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateCity(t *testing.T) {
+	type testCase struct {
+		c          city
+		wantFields string
+	}
+	cases := []testCase{
+		{c: city{name: "Oslo", population: 709037, cost: ExpensiveCost, climate: PoorClimate, lat: 59.9, lon: 10.7}, wantFields: ""},
+		{c: city{name: "Oslo"}, wantFields: ""},
+		{c: city{name: "   "}, wantFields: "name"},
+		{c: city{name: "1234!"}, wantFields: "name"},
+		{c: city{name: strings.Repeat("a", maxNameLength+1)}, wantFields: "name"},
+		{c: city{name: "Oslo", country: strings.Repeat("ø", maxNameLength+1)}, wantFields: "country"},
+		{c: city{name: "Oslo", population: -1}, wantFields: "population"},
+		{c: city{name: "Oslo", population: maxPopulation + 1}, wantFields: "population"},
+		{c: city{name: "Deviltown", population: 1233567890}, wantFields: ""},
+		{c: city{name: "Oslo", cost: 9, climate: -1}, wantFields: "cost climate"},
+		{c: city{name: "Oslo", lat: 91, lon: math.NaN()}, wantFields: "lat lon"},
+		{c: city{name: "Oslo", costs: costBreakdown{currency: "NOK", rent1BR: 14000, groceries: 4000}}, wantFields: ""},
+		{c: city{name: "Oslo", costs: costBreakdown{currency: "XYZ", rent1BR: 14000}}, wantFields: "costs"},
+		{c: city{name: "Oslo", costs: costBreakdown{currency: "NOK", rent1BR: 14000, groceries: -1}}, wantFields: "costs"},
+		{c: city{name: "Oslo", costs: costBreakdown{currency: "NOK", transport: math.NaN()}}, wantFields: "costs"},
+	}
+	for _, tc := range cases {
+		_, err := validateCity(tc.c)
+		fields := []string{}
+		if err != nil {
+			for _, e := range err.(fieldErrors) {
+				fields = append(fields, e.Field)
+			}
+		}
+		if got := strings.Join(fields, " "); got != tc.wantFields {
+			t.Errorf("validateCity(%+v) has errors in %q, want %q: %v", tc.c, got, tc.wantFields, err)
+		}
+	}
+
+	c, err := validateCity(city{name: " Malmo\u0308 ", country: "Sweden  ", region: " Scania"})
+	if err != nil {
+		t.Fatalf("Oibai, validateCity() failed: %v", err)
+	}
+	if c.name != "Malm\u00f6" || c.country != "Sweden" || c.region != "Scania" {
+		t.Errorf("Expected the names to be normalized, got %+v", c)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	_, err := validateCity(city{name: "", cost: 9})
+	if err == nil {
+		t.Fatalf("validateCity() of a city without a name should fail")
+	}
+	want := "The name is missing. Pick a cost from the list."
+	if err.Error() != want {
+		t.Errorf("Expected %q, got %q", want, err.Error())
+	}
+	if got := err.(fieldErrors)[0].In("da"); got != "Navnet mangler." {
+		t.Errorf("Expected the error in Danish, got %q", got)
+	}
+}
+
+func TestAddCityHandler_invalid(t *testing.T) {
+	defer func(m *moderationStore) { Moderation = m }(Moderation)
+	Moderation = &moderationStore{}
+
+	type testCase struct {
+		form     url.Values
+		wantCode int
+		wantText string
+	}
+	cases := []testCase{
+		{form: url.Values{"cityname": {"  "}}, wantCode: http.StatusBadRequest, wantText: "The name is missing."},
+		{form: url.Values{"cityname": {"Oslo"}, "citypopulation": {"-5"}}, wantCode: http.StatusBadRequest, wantText: "The population must be between 0 and 2000.0M."},
+		{form: url.Values{"cityname": {"Oslo"}, "citypopulation": {"lots"}, "citycost": {"9"}}, wantCode: http.StatusBadRequest, wantText: "Pick a cost from the list."},
+		{form: url.Values{"cityname": {"Oslo"}, "citylat": {"north"}}, wantCode: http.StatusBadRequest, wantText: "The latitude must be between -90 and 90."},
+		{form: url.Values{"cityname": {"  barcelona "}}, wantCode: http.StatusConflict, wantText: "we already have Barcelona"},
+		{form: url.Values{"cityname": {"  Trondheim "}}, wantCode: http.StatusOK, wantText: "Thank you for Trondheim!"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/city", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		addCityHandler(rec, req)
+		if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantText) {
+			t.Errorf("Form %v: expected %v with %q, got %v:\n%v", tc.form, tc.wantCode, tc.wantText, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAddCity_invalid(t *testing.T) {
+	defer func(cs cities, h *historyStore) { setCities(cs); History = h }(allCities(), History)
+	History = &historyStore{}
+
+	if err := addCity(city{name: "Oslo", cost: 9}, "admin"); err == nil {
+		t.Errorf("addCity() of a city with a cost of 9 should fail")
+	}
+	if err := addCity(city{name: "seattle"}, "admin"); err == nil {
+		t.Errorf("addCity() of a city we have with another case should fail")
+	}
+	if err := updateCity("Barcelona", city{name: " Barcelona ", population: -1}, "admin"); err == nil {
+		t.Errorf("updateCity() with a negative population should fail")
+	}
+	if err := updateCity("Barcelona", city{name: " barcelona "}, "admin"); err != nil {
+		t.Errorf("updateCity() should let a city change the case of its name: %v", err)
+	}
+	if _, ok := allCities().find("barcelona"); !ok {
+		t.Errorf("Expected Barcelona to be renamed to barcelona")
+	}
+}